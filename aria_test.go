@@ -0,0 +1,62 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// https://datatracker.ietf.org/doc/html/rfc5794#appendix-A
+func TestARIAVectors(t *testing.T) {
+	for _, v := range []struct{ key, plaintext, ciphertext string }{
+		{"000102030405060708090a0b0c0d0e0f", "00112233445566778899aabbccddeeff", "d718fbd6ab644c739da95f3be6451778"},
+		{"000102030405060708090a0b0c0d0e0f1011121314151617", "00112233445566778899aabbccddeeff", "26449c1805dbe7aa25a468ce263a9e79"},
+		{"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f", "00112233445566778899aabbccddeeff", "f92bd7c79fb72e2f2b8f80c1972d24fc"},
+	} {
+		key, _ := hex.DecodeString(v.key)
+		plaintext, _ := hex.DecodeString(v.plaintext)
+		ciphertext, _ := hex.DecodeString(v.ciphertext)
+		block, err := newARIACipher(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dst := make([]byte, ariaBlockSize)
+		block.Encrypt(dst, plaintext)
+		if !bytes.Equal(dst, ciphertext) {
+			t.Fatalf("aria-%d: encrypted %x, expected %x", len(key)*8, dst, ciphertext)
+		}
+		block.Decrypt(dst, dst)
+		if !bytes.Equal(dst, plaintext) {
+			t.Fatalf("aria-%d: decrypted %x, expected %x", len(key)*8, dst, plaintext)
+		}
+	}
+
+	for _, size := range []int{0, 8, 15, 33} {
+		if _, err := NewARIABlockCrypt(make([]byte, size)); err == nil {
+			t.Fatal("aria accepted a key of", size, "bytes")
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"math/bits"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	asconKeySize   = 16
+	asconNonceSize = 16
+	asconTagSize   = 16
+	asconRate      = 8
+	asconIV        = 0x80400c0600000000 // key size, rate, rounds a and b of Ascon-128
+)
+
+// ascon128 implements cipher.AEAD with Ascon-128, the lightweight authenticated cipher
+// selected by NIST, https://ascon.iaik.tugraz.at.
+type ascon128 struct {
+	k0, k1 uint64
+}
+
+// asconState is the 320-bit state of Ascon.
+type asconState [5]uint64
+
+// newAscon128 creates Ascon-128 with a 16-byte key.
+func newAscon128(key []byte) (*ascon128, error) {
+	if len(key) != asconKeySize {
+		return nil, errors.Wrapf(errKeySize, "ascon: %d bytes", len(key))
+	}
+	return &ascon128{binary.BigEndian.Uint64(key), binary.BigEndian.Uint64(key[8:])}, nil
+}
+
+func (a *ascon128) NonceSize() int { return asconNonceSize }
+
+func (a *ascon128) Overhead() int { return asconTagSize }
+
+// Destroy zeroes the key.
+func (a *ascon128) Destroy() { a.k0, a.k1 = 0, 0 }
+
+func (a *ascon128) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != asconNonceSize {
+		panic("ascon: incorrect nonce length given to Ascon-128")
+	}
+	ret, out := sliceForAppend(dst, len(plaintext)+asconTagSize)
+
+	s := a.init(nonce, additionalData)
+	for len(plaintext) >= asconRate {
+		s[0] ^= binary.BigEndian.Uint64(plaintext)
+		binary.BigEndian.PutUint64(out, s[0])
+		s.permute(6)
+		plaintext, out = plaintext[asconRate:], out[asconRate:]
+	}
+	s[0] ^= asconLoad(plaintext)
+	for i := range plaintext {
+		out[i] = byte(s[0] >> (56 - 8*i))
+	}
+	a.final(&s, out[len(plaintext):])
+	return ret
+}
+
+func (a *ascon128) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != asconNonceSize {
+		panic("ascon: incorrect nonce length given to Ascon-128")
+	}
+	if len(ciphertext) < asconTagSize {
+		return nil, errShortPacket
+	}
+	tag := ciphertext[len(ciphertext)-asconTagSize:]
+	ciphertext = ciphertext[:len(ciphertext)-asconTagSize]
+	ret, out := sliceForAppend(dst, len(ciphertext))
+
+	s := a.init(nonce, additionalData)
+	p, c := out, ciphertext
+	for len(c) >= asconRate {
+		x := binary.BigEndian.Uint64(c)
+		binary.BigEndian.PutUint64(p, s[0]^x)
+		s[0] = x
+		s.permute(6)
+		p, c = p[asconRate:], c[asconRate:]
+	}
+	// the leading bytes of the rate become the ciphertext, the rest absorbs the padding
+	x := asconLoad(c)
+	for i := range c {
+		p[i] = c[i] ^ byte(s[0]>>(56-8*i))
+	}
+	s[0] = s[0]&(^uint64(0)>>(8*len(c))) ^ x
+
+	var expected [asconTagSize]byte
+	a.final(&s, expected[:])
+	if subtle.ConstantTimeCompare(expected[:], tag) != 1 {
+		clear(out)
+		return nil, errAuthFailed
+	}
+	return ret, nil
+}
+
+// init initializes the state with the key and nonce, and absorbs the additional data.
+func (a *ascon128) init(nonce, ad []byte) asconState {
+	s := asconState{asconIV, a.k0, a.k1, binary.BigEndian.Uint64(nonce), binary.BigEndian.Uint64(nonce[8:])}
+	s.permute(12)
+	s[3] ^= a.k0
+	s[4] ^= a.k1
+
+	if len(ad) > 0 {
+		for ; len(ad) >= asconRate; ad = ad[asconRate:] {
+			s[0] ^= binary.BigEndian.Uint64(ad)
+			s.permute(6)
+		}
+		s[0] ^= asconLoad(ad)
+		s.permute(6)
+	}
+	s[4] ^= 1 // domain separation
+	return s
+}
+
+// final finalizes the state with the key and writes the tag.
+func (a *ascon128) final(s *asconState, tag []byte) {
+	s[1] ^= a.k0
+	s[2] ^= a.k1
+	s.permute(12)
+	binary.BigEndian.PutUint64(tag, s[3]^a.k0)
+	binary.BigEndian.PutUint64(tag[8:], s[4]^a.k1)
+}
+
+// asconLoad loads a partial block of less than 8 bytes, padded with 0x80 0x00..
+func asconLoad(b []byte) uint64 {
+	var x uint64
+	for i := range b {
+		x |= uint64(b[i]) << (56 - 8*i)
+	}
+	return x | 0x80<<(56-8*len(b))
+}
+
+// permute applies the last rounds of the 12-round permutation of Ascon.
+func (s *asconState) permute(rounds int) {
+	x0, x1, x2, x3, x4 := s[0], s[1], s[2], s[3], s[4]
+	for r := 12 - rounds; r < 12; r++ {
+		// round constant
+		x2 ^= uint64(0xf0 - r*0x0f)
+
+		// substitution layer
+		x0 ^= x4
+		x4 ^= x3
+		x2 ^= x1
+		t0, t1, t2, t3, t4 := ^x0&x1, ^x1&x2, ^x2&x3, ^x3&x4, ^x4&x0
+		x0 ^= t1
+		x1 ^= t2
+		x2 ^= t3
+		x3 ^= t4
+		x4 ^= t0
+		x1 ^= x0
+		x0 ^= x4
+		x3 ^= x2
+		x2 = ^x2
+
+		// linear diffusion layer
+		x0 ^= bits.RotateLeft64(x0, -19) ^ bits.RotateLeft64(x0, -28)
+		x1 ^= bits.RotateLeft64(x1, -61) ^ bits.RotateLeft64(x1, -39)
+		x2 ^= bits.RotateLeft64(x2, -1) ^ bits.RotateLeft64(x2, -6)
+		x3 ^= bits.RotateLeft64(x3, -10) ^ bits.RotateLeft64(x3, -17)
+		x4 ^= bits.RotateLeft64(x4, -7) ^ bits.RotateLeft64(x4, -41)
+	}
+	s[0], s[1], s[2], s[3], s[4] = x0, x1, x2, x3, x4
+}
@@ -0,0 +1,96 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// TestAscon128Vectors checks entries of LWC_AEAD_KAT_128_128.txt of the Ascon-128
+// submission, with Key = Nonce = 00 01 02 .. 0f and PT, AD = 00 01 02 ..
+func TestAscon128Vectors(t *testing.T) {
+	key, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	aead, err := newAscon128(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []struct {
+		count         int
+		plaintext, ad string
+		ciphertext    string
+	}{
+		{1, "", "", "e355159f292911f794cb1432a0103a8a"},
+		{2, "", "00", "944df887cd4901614c5dedbc42fc0da0"},
+		{34, "00", "", "bc18c3f4e39eca7222490d967c79bffc92"},
+	} {
+		plaintext, _ := hex.DecodeString(v.plaintext)
+		ad, _ := hex.DecodeString(v.ad)
+		ciphertext, _ := hex.DecodeString(v.ciphertext)
+
+		sealed := aead.Seal(nil, key, plaintext, ad)
+		if !bytes.Equal(sealed, ciphertext) {
+			t.Fatalf("count %d: sealed %x, expected %x", v.count, sealed, ciphertext)
+		}
+		opened, err := aead.Open(nil, key, ciphertext, ad)
+		if err != nil || !bytes.Equal(opened, plaintext) {
+			t.Fatalf("count %d: opened %x, %v", v.count, opened, err)
+		}
+
+		// any flipped bit of the ciphertext or tag fails
+		for i := range ciphertext {
+			ciphertext[i] ^= 0x80
+			if _, err := aead.Open(nil, key, ciphertext, ad); err != errAuthFailed {
+				t.Fatalf("count %d: forged ciphertext accepted", v.count)
+			}
+			ciphertext[i] ^= 0x80
+		}
+	}
+
+	if _, err := NewAscon128Crypt(make([]byte, 32)); err == nil {
+		t.Fatal("ascon128 accepted a 32-byte key")
+	}
+}
+
+// TestAscon128InPlace seals and opens in place across the partial block boundaries.
+func TestAscon128InPlace(t *testing.T) {
+	aead, _ := newAscon128(pass[:16])
+	nonce := make([]byte, asconNonceSize)
+	for size := range 3 * asconRate {
+		plaintext := knownAnswerData()[:size]
+		expected := aead.Seal(nil, nonce, plaintext, nil)
+
+		buf := make([]byte, size, size+asconTagSize)
+		copy(buf, plaintext)
+		sealed := aead.Seal(buf[:0], nonce, buf, nil)
+		if !bytes.Equal(sealed, expected) {
+			t.Fatalf("%d bytes: in-place seal differs", size)
+		}
+		opened, err := aead.Open(sealed[:0], nonce, sealed, nil)
+		if err != nil || !bytes.Equal(opened, plaintext) {
+			t.Fatalf("%d bytes: in-place open failed: %v", size, err)
+		}
+	}
+}
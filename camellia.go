@@ -0,0 +1,244 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"encoding/binary"
+	"math/bits"
+
+	"github.com/pkg/errors"
+)
+
+// camelliaBlockSize defines the block size of Camellia in bytes.
+const camelliaBlockSize = 16
+
+// camelliaCipher implements Camellia of RFC 3713, the Japanese CRYPTREC cipher.
+type camelliaCipher struct {
+	rounds int
+	enc    camelliaSubkeys
+	dec    camelliaSubkeys
+}
+
+// camelliaSubkeys holds the whitening, round and FL/FL^-1 subkeys in the order they are used.
+type camelliaSubkeys struct {
+	kw [4]uint64
+	k  [24]uint64
+	ke [6]uint64
+}
+
+// Camellia key schedule constants.
+const (
+	camelliaSigma1 = 0xa09e667f3bcc908b
+	camelliaSigma2 = 0xb67ae8584caa73b2
+	camelliaSigma3 = 0xc6ef372fe94f82be
+	camelliaSigma4 = 0x54ff53a5f1d36f1c
+	camelliaSigma5 = 0x10e527fade682d1d
+	camelliaSigma6 = 0xb05688c2b3e6c1fd
+)
+
+// newCamelliaCipher creates Camellia with a 16, 24 or 32-byte key.
+func newCamelliaCipher(key []byte) (*camelliaCipher, error) {
+	c := new(camelliaCipher)
+	var kl, kr [2]uint64
+	switch len(key) {
+	case 16:
+		c.rounds = 18
+	case 24:
+		c.rounds = 24
+		kr[0] = binary.BigEndian.Uint64(key[16:])
+		kr[1] = ^kr[0]
+	case 32:
+		c.rounds = 24
+		kr[0], kr[1] = binary.BigEndian.Uint64(key[16:]), binary.BigEndian.Uint64(key[24:])
+	default:
+		return nil, errors.Wrapf(errKeySize, "camellia: %d bytes", len(key))
+	}
+	kl[0], kl[1] = binary.BigEndian.Uint64(key), binary.BigEndian.Uint64(key[8:])
+
+	d1, d2 := kl[0]^kr[0], kl[1]^kr[1]
+	d2 ^= camelliaF(d1, camelliaSigma1)
+	d1 ^= camelliaF(d2, camelliaSigma2)
+	d1, d2 = d1^kl[0], d2^kl[1]
+	d2 ^= camelliaF(d1, camelliaSigma3)
+	d1 ^= camelliaF(d2, camelliaSigma4)
+	ka := [2]uint64{d1, d2}
+
+	// rot returns the two halves of x rotated left by n bits
+	rot := func(x [2]uint64, n uint) (uint64, uint64) {
+		hi, lo := x[0], x[1]
+		if n >= 64 {
+			hi, lo = lo, hi
+			n -= 64
+		}
+		if n > 0 {
+			hi, lo = hi<<n|lo>>(64-n), lo<<n|hi>>(64-n)
+		}
+		return hi, lo
+	}
+
+	k := &c.enc
+	if c.rounds == 18 {
+		k.kw[0], k.kw[1] = rot(kl, 0)
+		k.k[0], k.k[1] = rot(ka, 0)
+		k.k[2], k.k[3] = rot(kl, 15)
+		k.k[4], k.k[5] = rot(ka, 15)
+		k.ke[0], k.ke[1] = rot(ka, 30)
+		k.k[6], k.k[7] = rot(kl, 45)
+		k.k[8], _ = rot(ka, 45)
+		_, k.k[9] = rot(kl, 60)
+		k.k[10], k.k[11] = rot(ka, 60)
+		k.ke[2], k.ke[3] = rot(kl, 77)
+		k.k[12], k.k[13] = rot(kl, 94)
+		k.k[14], k.k[15] = rot(ka, 94)
+		k.k[16], k.k[17] = rot(kl, 111)
+		k.kw[2], k.kw[3] = rot(ka, 111)
+	} else {
+		d1, d2 = ka[0]^kr[0], ka[1]^kr[1]
+		d2 ^= camelliaF(d1, camelliaSigma5)
+		d1 ^= camelliaF(d2, camelliaSigma6)
+		kb := [2]uint64{d1, d2}
+
+		k.kw[0], k.kw[1] = rot(kl, 0)
+		k.k[0], k.k[1] = rot(kb, 0)
+		k.k[2], k.k[3] = rot(kr, 15)
+		k.k[4], k.k[5] = rot(ka, 15)
+		k.ke[0], k.ke[1] = rot(kr, 30)
+		k.k[6], k.k[7] = rot(kb, 30)
+		k.k[8], k.k[9] = rot(kl, 45)
+		k.k[10], k.k[11] = rot(ka, 45)
+		k.ke[2], k.ke[3] = rot(kl, 60)
+		k.k[12], k.k[13] = rot(kr, 60)
+		k.k[14], k.k[15] = rot(kb, 60)
+		k.k[16], k.k[17] = rot(kl, 77)
+		k.ke[4], k.ke[5] = rot(ka, 77)
+		k.k[18], k.k[19] = rot(kr, 94)
+		k.k[20], k.k[21] = rot(ka, 94)
+		k.k[22], k.k[23] = rot(kl, 111)
+		k.kw[2], k.kw[3] = rot(kb, 111)
+	}
+
+	// decryption uses the same subkeys in reverse order
+	fl := c.rounds/3 - 2
+	c.dec.kw = [4]uint64{k.kw[2], k.kw[3], k.kw[0], k.kw[1]}
+	for i := 0; i < c.rounds; i++ {
+		c.dec.k[i] = k.k[c.rounds-1-i]
+	}
+	for i := 0; i < fl; i++ {
+		c.dec.ke[i] = k.ke[fl-1-i]
+	}
+	return c, nil
+}
+
+func (c *camelliaCipher) BlockSize() int { return camelliaBlockSize }
+
+func (c *camelliaCipher) Encrypt(dst, src []byte) { c.crypt(&c.enc, dst, src) }
+
+func (c *camelliaCipher) Decrypt(dst, src []byte) { c.crypt(&c.dec, dst, src) }
+
+// Destroy zeroes the subkeys.
+func (c *camelliaCipher) Destroy() {
+	c.enc = camelliaSubkeys{}
+	c.dec = camelliaSubkeys{}
+}
+
+// crypt runs the Feistel network of Camellia with the subkeys k, both encryption and decryption.
+func (c *camelliaCipher) crypt(k *camelliaSubkeys, dst, src []byte) {
+	if len(src) < camelliaBlockSize || len(dst) < camelliaBlockSize {
+		panic("camellia: input not full block")
+	}
+
+	d1 := binary.BigEndian.Uint64(src) ^ k.kw[0]
+	d2 := binary.BigEndian.Uint64(src[8:]) ^ k.kw[1]
+	for r := 0; r < c.rounds; r += 2 {
+		if r > 0 && r%6 == 0 {
+			d1 = camelliaFL(d1, k.ke[r/3-2])
+			d2 = camelliaFLInv(d2, k.ke[r/3-1])
+		}
+		d2 ^= camelliaF(d1, k.k[r])
+		d1 ^= camelliaF(d2, k.k[r+1])
+	}
+	binary.BigEndian.PutUint64(dst, d2^k.kw[2])
+	binary.BigEndian.PutUint64(dst[8:], d1^k.kw[3])
+}
+
+// camelliaF is the round function F.
+func camelliaF(in, ke uint64) uint64 {
+	x := in ^ ke
+	t1 := camelliaSBOX1[byte(x>>56)]
+	t2 := bits.RotateLeft8(camelliaSBOX1[byte(x>>48)], 1)
+	t3 := bits.RotateLeft8(camelliaSBOX1[byte(x>>40)], 7)
+	t4 := camelliaSBOX1[bits.RotateLeft8(byte(x>>32), 1)]
+	t5 := bits.RotateLeft8(camelliaSBOX1[byte(x>>24)], 1)
+	t6 := bits.RotateLeft8(camelliaSBOX1[byte(x>>16)], 7)
+	t7 := camelliaSBOX1[bits.RotateLeft8(byte(x>>8), 1)]
+	t8 := camelliaSBOX1[byte(x)]
+
+	y1 := t1 ^ t3 ^ t4 ^ t6 ^ t7 ^ t8
+	y2 := t1 ^ t2 ^ t4 ^ t5 ^ t7 ^ t8
+	y3 := t1 ^ t2 ^ t3 ^ t5 ^ t6 ^ t8
+	y4 := t2 ^ t3 ^ t4 ^ t5 ^ t6 ^ t7
+	y5 := t1 ^ t2 ^ t6 ^ t7 ^ t8
+	y6 := t2 ^ t3 ^ t5 ^ t7 ^ t8
+	y7 := t3 ^ t4 ^ t5 ^ t6 ^ t8
+	y8 := t1 ^ t4 ^ t5 ^ t6 ^ t7
+	return uint64(y1)<<56 | uint64(y2)<<48 | uint64(y3)<<40 | uint64(y4)<<32 |
+		uint64(y5)<<24 | uint64(y6)<<16 | uint64(y7)<<8 | uint64(y8)
+}
+
+// camelliaFL is the FL function inserted every 6 rounds.
+func camelliaFL(x, k uint64) uint64 {
+	x1, x2 := uint32(x>>32), uint32(x)
+	k1, k2 := uint32(k>>32), uint32(k)
+	x2 ^= bits.RotateLeft32(x1&k1, 1)
+	x1 ^= x2 | k2
+	return uint64(x1)<<32 | uint64(x2)
+}
+
+// camelliaFLInv is the inverse of camelliaFL.
+func camelliaFLInv(y, k uint64) uint64 {
+	y1, y2 := uint32(y>>32), uint32(y)
+	k1, k2 := uint32(k>>32), uint32(k)
+	y1 ^= y2 | k2
+	y2 ^= bits.RotateLeft32(y1&k1, 1)
+	return uint64(y1)<<32 | uint64(y2)
+}
+
+// camelliaSBOX1 is the S-box of Camellia, SBOX2, SBOX3 and SBOX4 are rotations of it.
+var camelliaSBOX1 = [256]byte{
+	0x70, 0x82, 0x2c, 0xec, 0xb3, 0x27, 0xc0, 0xe5, 0xe4, 0x85, 0x57, 0x35, 0xea, 0x0c, 0xae, 0x41,
+	0x23, 0xef, 0x6b, 0x93, 0x45, 0x19, 0xa5, 0x21, 0xed, 0x0e, 0x4f, 0x4e, 0x1d, 0x65, 0x92, 0xbd,
+	0x86, 0xb8, 0xaf, 0x8f, 0x7c, 0xeb, 0x1f, 0xce, 0x3e, 0x30, 0xdc, 0x5f, 0x5e, 0xc5, 0x0b, 0x1a,
+	0xa6, 0xe1, 0x39, 0xca, 0xd5, 0x47, 0x5d, 0x3d, 0xd9, 0x01, 0x5a, 0xd6, 0x51, 0x56, 0x6c, 0x4d,
+	0x8b, 0x0d, 0x9a, 0x66, 0xfb, 0xcc, 0xb0, 0x2d, 0x74, 0x12, 0x2b, 0x20, 0xf0, 0xb1, 0x84, 0x99,
+	0xdf, 0x4c, 0xcb, 0xc2, 0x34, 0x7e, 0x76, 0x05, 0x6d, 0xb7, 0xa9, 0x31, 0xd1, 0x17, 0x04, 0xd7,
+	0x14, 0x58, 0x3a, 0x61, 0xde, 0x1b, 0x11, 0x1c, 0x32, 0x0f, 0x9c, 0x16, 0x53, 0x18, 0xf2, 0x22,
+	0xfe, 0x44, 0xcf, 0xb2, 0xc3, 0xb5, 0x7a, 0x91, 0x24, 0x08, 0xe8, 0xa8, 0x60, 0xfc, 0x69, 0x50,
+	0xaa, 0xd0, 0xa0, 0x7d, 0xa1, 0x89, 0x62, 0x97, 0x54, 0x5b, 0x1e, 0x95, 0xe0, 0xff, 0x64, 0xd2,
+	0x10, 0xc4, 0x00, 0x48, 0xa3, 0xf7, 0x75, 0xdb, 0x8a, 0x03, 0xe6, 0xda, 0x09, 0x3f, 0xdd, 0x94,
+	0x87, 0x5c, 0x83, 0x02, 0xcd, 0x4a, 0x90, 0x33, 0x73, 0x67, 0xf6, 0xf3, 0x9d, 0x7f, 0xbf, 0xe2,
+	0x52, 0x9b, 0xd8, 0x26, 0xc8, 0x37, 0xc6, 0x3b, 0x81, 0x96, 0x6f, 0x4b, 0x13, 0xbe, 0x63, 0x2e,
+	0xe9, 0x79, 0xa7, 0x8c, 0x9f, 0x6e, 0xbc, 0x8e, 0x29, 0xf5, 0xf9, 0xb6, 0x2f, 0xfd, 0xb4, 0x59,
+	0x78, 0x98, 0x06, 0x6a, 0xe7, 0x46, 0x71, 0xba, 0xd4, 0x25, 0xab, 0x42, 0x88, 0xa2, 0x8d, 0xfa,
+	0x72, 0x07, 0xb9, 0x55, 0xf8, 0xee, 0xac, 0x0a, 0x36, 0x49, 0x2a, 0x68, 0x3c, 0x38, 0xf1, 0xa4,
+	0x40, 0x28, 0xd3, 0x7b, 0xbb, 0xc9, 0x43, 0xc1, 0x15, 0xe3, 0xad, 0xf4, 0x77, 0xc7, 0x80, 0x9e,
+}
@@ -0,0 +1,62 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// https://datatracker.ietf.org/doc/html/rfc3713#appendix-A
+func TestCamelliaVectors(t *testing.T) {
+	for _, v := range []struct{ key, plaintext, ciphertext string }{
+		{"0123456789abcdeffedcba9876543210", "0123456789abcdeffedcba9876543210", "67673138549669730857065648eabe43"},
+		{"0123456789abcdeffedcba98765432100011223344556677", "0123456789abcdeffedcba9876543210", "b4993401b3e996f84ee5cee7d79b09b9"},
+		{"0123456789abcdeffedcba987654321000112233445566778899aabbccddeeff", "0123456789abcdeffedcba9876543210", "9acc237dff16d76c20ef7c919e3a7509"},
+	} {
+		key, _ := hex.DecodeString(v.key)
+		plaintext, _ := hex.DecodeString(v.plaintext)
+		ciphertext, _ := hex.DecodeString(v.ciphertext)
+		block, err := newCamelliaCipher(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dst := make([]byte, camelliaBlockSize)
+		block.Encrypt(dst, plaintext)
+		if !bytes.Equal(dst, ciphertext) {
+			t.Fatalf("camellia-%d: encrypted %x, expected %x", len(key)*8, dst, ciphertext)
+		}
+		block.Decrypt(dst, dst)
+		if !bytes.Equal(dst, plaintext) {
+			t.Fatalf("camellia-%d: decrypted %x, expected %x", len(key)*8, dst, plaintext)
+		}
+	}
+
+	for _, size := range []int{0, 8, 15, 33} {
+		if _, err := NewCamelliaBlockCrypt(make([]byte, size)); err == nil {
+			t.Fatal("camellia accepted a key of", size, "bytes")
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cmd
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/xtaci/grasshopper"
+)
+
+var (
+	benchDuration time.Duration // time to measure a method with a packet size
+	benchSizes    []int         // packet sizes measured
+	benchOutput   string        // file to write the recommended config to
+	benchForce    bool          // overwrite the existing file of benchOutput
+)
+
+// methodSpeed is the speed of a crypto method at each packet size.
+type methodSpeed struct {
+	method string
+	aead   bool
+	speeds []grasshopper.CipherSpeed
+	total  float64 // ns to encrypt and decrypt a packet of each size
+}
+
+// benchCmd represents the bench-ciphers command
+var benchCmd = &cobra.Command{
+	Use:   "bench-ciphers",
+	Short: "Benchmark the crypto methods on this machine",
+	Long: `Benchmark encrypting and decrypting packets with every crypto method on this machine.
+
+The methods are ranked by the time to encrypt and decrypt a packet of each size, the
+fastest first. Each method is measured through the crypters of the outbound side of
+start, with the --mo mac on the ciphers without authentication, the --po padding and
+the --vo wire version, while header protection and mimicry are not measured. The
+fastest AEAD method, authenticating packets with a keyed tag, is recommended for --ci
+and --co, and written to the config snippet of --output, which is not overwritten
+unless --force is given. Both ends of a link must use the same method.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(benchSizes) == 0 {
+			log.Fatal("No packet sizes to measure")
+		}
+
+		log.Printf("Measuring with mac: %s, padding: %s, wire: v%d", config.MO, config.PO, config.VO)
+		var results []methodSpeed
+		for _, method := range grasshopper.Ciphers() {
+			if method == grasshopper.CipherNone {
+				continue
+			}
+			result, err := measureMethod(method)
+			if err != nil {
+				log.Fatalf("Failed to measure %v: %v", method, err)
+			}
+			results = append(results, result)
+		}
+		slices.SortStableFunc(results, func(a, b methodSpeed) int {
+			switch {
+			case a.total < b.total:
+				return -1
+			case a.total > b.total:
+				return 1
+			}
+			return 0
+		})
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprint(w, "RANK\tMETHOD\tAEAD\t")
+		for _, size := range benchSizes {
+			fmt.Fprintf(w, "%dB ns/pkt\t%dB MB/s\t", size, size)
+		}
+		fmt.Fprintln(w)
+		for i, result := range results {
+			fmt.Fprintf(w, "%d\t%s\t%v\t", i+1, result.method, result.aead)
+			for _, speed := range result.speeds {
+				fmt.Fprintf(w, "%.0f\t%.1f\t", speed.NsPerPacket(), speed.Throughput()/1e6)
+			}
+			fmt.Fprintln(w)
+		}
+		w.Flush()
+
+		i := slices.IndexFunc(results, func(result methodSpeed) bool { return result.aead })
+		if i < 0 {
+			i = 0
+		}
+		recommended := results[i].method
+		fmt.Println("Recommended method:", recommended)
+
+		if benchOutput != "" {
+			snippet := fmt.Sprintf("# recommended by \"grasshopper bench-ciphers\" on %v\nci = %q\nco = %q\n", time.Now().Format(time.DateOnly), recommended, recommended)
+			if err := writeSnippet(benchOutput, snippet, benchForce); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println("Config written to:", benchOutput)
+		}
+	},
+}
+
+// writeSnippet writes the config snippet to file, an existing file is refused unless force is set.
+func writeSnippet(file string, snippet string, force bool) error {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(file, flag, 0o644)
+	if os.IsExist(err) {
+		return fmt.Errorf("%s exists, remove it or overwrite it by --force", file)
+	} else if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(snippet); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// measureMethod measures the speed of the method with a random key at each packet size, through
+// the crypters start creates for the outbound side. The direction-separated subkeys cost the same
+// as a single key, and are left out so the packets round trip.
+func measureMethod(method string) (methodSpeed, error) {
+	keyLen, _ := grasshopper.CipherKeyLen(method)
+	key := make([]byte, max(keyLen, KEYLEN))
+	_, _ = io.ReadFull(rand.Reader, key)
+
+	// the mac only applies to the ciphers without authentication
+	cipher, err := grasshopper.NewCipher(method, key)
+	if err != nil {
+		return methodSpeed{}, err
+	}
+	result := methodSpeed{method: method}
+	_, result.aead = cipher.(grasshopper.AEADCrypt)
+	grasshopper.Destroy(cipher)
+
+	opts := outboundOptions()
+	opts.method, opts.directional = method, false
+	if result.aead {
+		opts.mac = "none"
+	}
+	crypter, err := newCrypter(key, opts)
+	if err != nil {
+		return methodSpeed{}, err
+	}
+	defer grasshopper.Destroy(crypter)
+
+	for _, size := range benchSizes {
+		speed, err := grasshopper.MeasureCipher(crypter, size, benchDuration)
+		if err != nil {
+			return methodSpeed{}, err
+		}
+		result.speeds = append(result.speeds, speed)
+		result.total += speed.NsPerPacket()
+	}
+	return result, nil
+}
+
+func init() {
+	rootCmd.AddCommand(benchCmd)
+	benchCmd.Flags().DurationVar(&benchDuration, "duration", 200*time.Millisecond, "Time to measure a method with a packet size")
+	benchCmd.Flags().IntSliceVar(&benchSizes, "sizes", []int{64, 512, 1400}, "Packet sizes in bytes to measure")
+	benchCmd.Flags().StringVarP(&benchOutput, "output", "o", "", "File to write a config snippet with the recommended ci and co to, which must not exist")
+	benchCmd.Flags().BoolVar(&benchForce, "force", false, "Overwrite the file of --output if it exists")
+}
@@ -26,14 +26,69 @@ import (
 	"time"
 )
 
+// ClientConfig defines the credential of a client on a multi-tenant listener
+type ClientConfig struct {
+	ID       int      `json:"id"`
+	Key      string   `json:"key"`
+	Method   string   `json:"method"`
+	MAC      string   `json:"mac"`
+	Padding  string   `json:"padding"`
+	NextHops []string `json:"nexthops"`
+}
+
 // Config for server
 type Config struct {
-	Listen   string        `json:"listen"`
-	SockBuf  int           `json:"sockbuf"`
-	NextHops []string      `json:"nexthops"`
-	KI       string        `json:"ki"`
-	KO       string        `json:"ko"`
-	CI       string        `json:"ci"`
-	CO       string        `json:"co"`
-	Timeout  time.Duration `json:"timeout"`
+	Listen      string         `json:"listen"`
+	SockBuf     int            `json:"sockbuf"`
+	NextHops    []string       `json:"nexthops"`
+	KI          string         `json:"ki"`
+	KO          string         `json:"ko"`
+	KIFile      string         `json:"ki_file" mapstructure:"ki_file"`
+	KOFile      string         `json:"ko_file" mapstructure:"ko_file"`
+	InsecureKey bool           `json:"insecure_default_key" mapstructure:"insecure_default_key"`
+	KIID        int            `json:"kiid"`
+	KOID        int            `json:"koid"`
+	KIS         []string       `json:"kis"`
+	KOS         []string       `json:"kos"`
+	Clients     []ClientConfig `json:"clients"`
+	CID         int            `json:"cid"`
+	KDF         string         `json:"kdf"`
+	Salt        string         `json:"salt"`
+	KDFIter     int            `json:"kdfiter"`
+	KDFMem      int            `json:"kdfmem"`
+	KDFThreads  int            `json:"kdfthreads"`
+	CI          string         `json:"ci"`
+	CO          string         `json:"co"`
+	MI          string         `json:"mi"`
+	MO          string         `json:"mo"`
+	MACSize     int            `json:"macsize"`
+	QPPPads     int            `json:"qpppads"`
+	PI          string         `json:"pi"`
+	PO          string         `json:"po"`
+	PadMTU      int            `json:"padmtu"`
+	VI          int            `json:"vi"`
+	VO          int            `json:"vo"`
+	HPI         bool           `json:"hpi"`
+	HPO         bool           `json:"hpo"`
+	HKI         string         `json:"hki"`
+	HKO         string         `json:"hko"`
+	HKIFile     string         `json:"hki_file" mapstructure:"hki_file"`
+	HKOFile     string         `json:"hko_file" mapstructure:"hko_file"`
+	DI          bool           `json:"di"`
+	DO          bool           `json:"do"`
+	FI          string         `json:"fi"`
+	FO          string         `json:"fo"`
+	RI          int            `json:"ri"`
+	RO          int            `json:"ro"`
+	Skew        time.Duration  `json:"skew"`
+	HI          bool           `json:"hi"`
+	HO          bool           `json:"ho"`
+	Rekey       time.Duration  `json:"rekey"`
+	PQ          bool           `json:"pq"`
+	Identity    string         `json:"identity"`
+	IDFile      string         `json:"identity_file" mapstructure:"identity_file"`
+	AI          []string       `json:"ai"`
+	AO          []string       `json:"ao"`
+	Timeout     time.Duration  `json:"timeout"`
+	Workers     int            `json:"workers"`
 }
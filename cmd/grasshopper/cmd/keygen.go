@@ -0,0 +1,73 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/xtaci/grasshopper"
+)
+
+var keygenOutput string // file to write the identity to
+
+// keygenCmd represents the keygen command
+var keygenCmd = &cobra.Command{
+	Use:   "keygen",
+	Short: "Generate an identity for the handshakes with static identities",
+	Long: `Generate an Ed25519 identity for the handshakes with static identities.
+
+The identity is printed, or written to the file of --output which must not exist, and its
+public key is printed to be authorized by the peers with --ai or --ao.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		identity, err := grasshopper.GenerateIdentity()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if keygenOutput == "" {
+			fmt.Println(identity.Encode())
+			fmt.Fprintln(os.Stderr, "Public key:", identity.PublicKey())
+			return
+		}
+
+		f, err := os.OpenFile(keygenOutput, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err := fmt.Fprintln(f, identity.Encode()); err != nil {
+			log.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Public key:", identity.PublicKey())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(keygenCmd)
+	keygenCmd.Flags().StringVarP(&keygenOutput, "output", "o", "", "File to write the identity to, readable by the owner only")
+}
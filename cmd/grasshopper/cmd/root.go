@@ -25,10 +25,12 @@ package cmd
 import (
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/xtaci/grasshopper"
 )
 
 var config = &Config{} // global configuration
@@ -69,15 +71,62 @@ func init() {
 	rootCmd.PersistentFlags().StringVarP(&config.Listen, "listen", "l", ":1234", "Listener address, eg: \"IP:1234\"")
 	rootCmd.PersistentFlags().IntVar(&config.SockBuf, "sockbuf", 1024*1024, "Socket buffer size for the listener")
 	rootCmd.PersistentFlags().StringSliceVarP(&config.NextHops, "nexthops", "n", []string{"127.0.0.1:3000"}, "Servers to randomly forward to")
-	rootCmd.PersistentFlags().StringVar(&config.KI, "ki", "it's a secret", "Secret key to encrypt and decrypt for the last hop(client-side)")
-	rootCmd.PersistentFlags().StringVar(&config.KO, "ko", "it's a secret", "Secret key to encrypt and decrypt for the next hops")
-	rootCmd.PersistentFlags().StringVar(&config.CI, "ci", "qpp", "Cryptography method for incoming data. Available options: aes, aes-128, aes-192, qpp, salsa20, blowfish, twofish, cast5, 3des, tea, xtea, sm4, none")
-	rootCmd.PersistentFlags().StringVar(&config.CO, "co", "qpp", "Cryptography method for outgoing data. Available options: aes, aes-128, aes-192, qpp, salsa20, blowfish, twofish, cast5, 3des, tea, xtea, sm4, none")
+	rootCmd.PersistentFlags().StringVar(&config.KI, "ki", "it's a secret", "Secret key to encrypt and decrypt for the last hop(client-side), as @file, env:NAME or cred:NAME on the command line")
+	rootCmd.PersistentFlags().StringVar(&config.KO, "ko", "it's a secret", "Secret key to encrypt and decrypt for the next hops, as @file, env:NAME or cred:NAME on the command line")
+	rootCmd.PersistentFlags().StringVar(&config.KIFile, "ki_file", "", "File to read ki from, which must not be readable by group or others")
+	rootCmd.PersistentFlags().StringVar(&config.KOFile, "ko_file", "", "File to read ko from, which must not be readable by group or others")
+	rootCmd.PersistentFlags().BoolVar(&config.InsecureKey, "insecure_default_key", false, "Allow the public default secret if ki or ko is not configured, for testing only")
+	rootCmd.PersistentFlags().IntVar(&config.KIID, "kiid", -1, "Key ID of ki, enables key IDs on the wire for key rotation, -1 to disable")
+	rootCmd.PersistentFlags().IntVar(&config.KOID, "koid", -1, "Key ID of ko, enables key IDs on the wire for key rotation, -1 to disable")
+	rootCmd.PersistentFlags().StringSliceVar(&config.KIS, "kis", nil, "Extra keys accepted for incoming data with key IDs, formatted as \"id:secret\", with secrets as @file, env:NAME or cred:NAME on the command line, reloaded on SIGHUP")
+	rootCmd.PersistentFlags().StringSliceVar(&config.KOS, "kos", nil, "Extra keys accepted for outgoing data with key IDs, formatted as \"id:secret\", with secrets as @file, env:NAME or cred:NAME on the command line, reloaded on SIGHUP")
+	rootCmd.PersistentFlags().StringVar(&config.KDF, "kdf", grasshopper.KDFPBKDF2SHA1, "Key derivation function for the secrets. Available options: "+strings.Join(grasshopper.KDFs(), ", "))
+	rootCmd.PersistentFlags().StringVar(&config.Salt, "salt", grasshopper.DefaultSalt, "Salt of the key derivation, a unique salt per deployment is recommended")
+	rootCmd.PersistentFlags().IntVar(&config.KDFIter, "kdfiter", 0, "Iterations of pbkdf2, time cost of argon2id, or N of scrypt, 0 for the default")
+	rootCmd.PersistentFlags().IntVar(&config.KDFMem, "kdfmem", 0, "Memory cost in KiB of argon2id, or r of scrypt, 0 for the default")
+	rootCmd.PersistentFlags().IntVar(&config.KDFThreads, "kdfthreads", 0, "Threads of argon2id, or p of scrypt, 0 for the default")
+	rootCmd.PersistentFlags().IntVar(&config.CID, "cid", -1, "Client ID sent to the next hops with per-client keys, -1 to disable")
+	rootCmd.PersistentFlags().StringVar(&config.CI, "ci", "qpp", "Cryptography method for incoming data, or methods separated by commas tried in order for migrations, each as method or method:secret, with secrets as @file, env:NAME or cred:NAME on the command line. Available options: "+strings.Join(grasshopper.Ciphers(), ", "))
+	rootCmd.PersistentFlags().StringVar(&config.CO, "co", "qpp", "Cryptography method for outgoing data. Available options: "+strings.Join(grasshopper.Ciphers(), ", "))
+	rootCmd.PersistentFlags().StringVar(&config.MI, "mi", "none", "Keyed MAC for incoming data on non-AEAD ciphers. Available options: hmac-sha256, blake2b, none")
+	rootCmd.PersistentFlags().StringVar(&config.MO, "mo", "none", "Keyed MAC for outgoing data on non-AEAD ciphers. Available options: hmac-sha256, blake2b, none")
+	rootCmd.PersistentFlags().IntVar(&config.MACSize, "macsize", 16, "MAC tag size in bytes, from 8 up to the digest size")
+	rootCmd.PersistentFlags().IntVar(&config.QPPPads, "qpppads", grasshopper.DefaultQPPPads, "Number of permutation pads of qpp, more pads for a larger key space at the cost of memory and setup time")
+	rootCmd.PersistentFlags().StringVar(&config.PI, "pi", "none", "Padding for incoming data. Available options: none, strip, buckets:128,256,..., random:N, mtu")
+	rootCmd.PersistentFlags().StringVar(&config.PO, "po", "none", "Padding for outgoing data. Available options: none, strip, buckets:128,256,..., random:N, mtu")
+	rootCmd.PersistentFlags().IntVar(&config.PadMTU, "padmtu", grasshopper.DefaultPaddingMTU, "Size limit of padded packets and handshake packets, including the key IDs, client IDs, session indexes and mimicry framing")
+	rootCmd.PersistentFlags().IntVar(&config.VI, "vi", grasshopper.WireV1, "Wire version of outgoing packets to the last hop, both v1 and v2 are accepted. Available options: 1, 2")
+	rootCmd.PersistentFlags().IntVar(&config.VO, "vo", grasshopper.WireV1, "Wire version of outgoing packets to the next hops, both v1 and v2 are accepted. Available options: 1, 2")
+	rootCmd.PersistentFlags().BoolVar(&config.HPI, "hpi", false, "Mask the headers of packets with the last hop by header protection, which must enable --hpo")
+	rootCmd.PersistentFlags().BoolVar(&config.HPO, "hpo", false, "Mask the headers of packets with the next hops by header protection, which must enable --hpi")
+	rootCmd.PersistentFlags().StringVar(&config.HKIFile, "hki_file", "", "File to read hki from, the header protection secret with the last hop, ki if unset")
+	rootCmd.PersistentFlags().StringVar(&config.HKOFile, "hko_file", "", "File to read hko from, the header protection secret with the next hops, ko if unset")
+	rootCmd.PersistentFlags().BoolVar(&config.DI, "di", false, "Separate the keys of the two directions with the last hop, so reflected packets are refused, which must enable --do")
+	rootCmd.PersistentFlags().BoolVar(&config.DO, "do", false, "Separate the keys of the two directions with the next hops, so reflected packets are refused, which must enable --di")
+	rootCmd.PersistentFlags().StringVar(&config.FI, "fi", grasshopper.MimicryNone, "Protocol mimicry framing the datagrams with the last hop. Available options: "+strings.Join(grasshopper.MimicryProfiles(), ", "))
+	rootCmd.PersistentFlags().StringVar(&config.FO, "fo", grasshopper.MimicryNone, "Protocol mimicry framing the datagrams with the next hops. Available options: "+strings.Join(grasshopper.MimicryProfiles(), ", "))
+	rootCmd.PersistentFlags().IntVar(&config.RI, "ri", 0, "Replay window in packets for incoming data, 0 to disable")
+	rootCmd.PersistentFlags().IntVar(&config.RO, "ro", 0, "Replay window in packets for outgoing data, 0 to disable")
+	rootCmd.PersistentFlags().DurationVar(&config.Skew, "skew", 30*time.Second, "Clock skew tolerance of the replay protection")
+	rootCmd.PersistentFlags().BoolVar(&config.HI, "hi", false, "Respond to forward secret handshakes from the last hop, which must enable --ho")
+	rootCmd.PersistentFlags().BoolVar(&config.HO, "ho", false, "Initiate forward secret handshakes with the next hops, which must enable --hi")
+	rootCmd.PersistentFlags().BoolVar(&config.PQ, "pq", false, "Use hybrid ML-KEM-768 + X25519 key agreement in the forward secret handshakes")
+	rootCmd.PersistentFlags().StringVar(&config.Identity, "identity", "", "Identity of this hop generated by \"grasshopper keygen\", for the handshakes with --ai or --ao, as @file, env:NAME or cred:NAME on the command line")
+	rootCmd.PersistentFlags().StringVar(&config.IDFile, "identity_file", "", "File to read the identity from, which must not be readable by group or others")
+	rootCmd.PersistentFlags().StringSliceVar(&config.AI, "ai", nil, "Public keys of the last hops authorized in the handshakes with --hi, the others are refused")
+	rootCmd.PersistentFlags().StringSliceVar(&config.AO, "ao", nil, "Public keys of the next hops authorized in the handshakes with --ho, formatted as \"key@host:port\", packets to other next hops are dropped")
+	rootCmd.PersistentFlags().DurationVar(&config.Rekey, "rekey", 2*time.Minute, "Rekey interval of the forward secret sessions")
 	rootCmd.PersistentFlags().DurationVar(&config.Timeout, "timeout", 60*time.Second, "Idle timeout duration for a UDP connection")
+	rootCmd.PersistentFlags().IntVar(&config.Workers, "workers", 0, "Crypto workers sharding the clients, up to the number of CPU cores, 0 or 1 to process packets on the reading goroutines")
 	rootCmd.PersistentFlags().StringVarP(&configFile, "config", "c", "", "config file name")
 
 	// override configuration from json file
 	cobra.OnInitialize(func() {
+		// refuse the secrets on the command line, before the config file overrides them
+		if err := checkInlineSecrets(); err != nil {
+			log.Fatal(err)
+		}
+
 		// json file not specified
 		if configFile == "" {
 			return
@@ -0,0 +1,174 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// secretEnvPrefix prefixes the environment variables of the secrets, eg: GRASSHOPPER_KI.
+const secretEnvPrefix = "GRASSHOPPER_"
+
+// loadSecret resolves the secret of the option name(ki, ko, hki, hko or identity) from the first of:
+//   - the option set by config file, or by flag as a reference, see resolveSecret,
+//   - the file of the option name_file,
+//   - the environment variable GRASSHOPPER_NAME,
+//   - the file name in $CREDENTIALS_DIRECTORY, from systemd LoadCredential=.
+//
+// The default of the flag, if any, is returned if none of them is set. It returns the secret and
+// where it's from, "flag" or "config" for the option, a path, a variable, or "default".
+func loadSecret(name string, value string, file string) (secret string, from string, err error) {
+	flag := rootCmd.PersistentFlags().Changed(name)
+	explicit := flag || viper.IsSet(name)
+	if file != "" {
+		if explicit {
+			return "", "", fmt.Errorf("%s and %s_file are exclusive", name, name)
+		}
+		secret, err = readSecretFile(file)
+		return secret, file, err
+	}
+	if viper.IsSet(name) {
+		return value, "config", nil
+	}
+	if flag {
+		secret, err = resolveSecret(value)
+		return secret, "flag", err
+	}
+
+	env := secretEnvPrefix + strings.ToUpper(name)
+	if secret, ok := os.LookupEnv(env); ok {
+		return secret, env, nil
+	}
+
+	if dir := os.Getenv("CREDENTIALS_DIRECTORY"); dir != "" {
+		file := filepath.Join(dir, name)
+		if _, err := os.Stat(file); err == nil {
+			secret, err = readSecretFile(file)
+			return secret, file, err
+		}
+	}
+	if flag := rootCmd.PersistentFlags().Lookup(name); flag != nil {
+		return flag.DefValue, "default", nil
+	}
+	return "", "default", nil
+}
+
+// resolveSecret resolves a secret of ki, ko, identity, ci, kis or kos, given as a reference to where it's kept:
+//   - "@path", the file path,
+//   - "env:NAME", the environment variable NAME,
+//   - "cred:NAME", the file NAME in $CREDENTIALS_DIRECTORY, from systemd LoadCredential=.
+//
+// Anything else is the secret itself.
+func resolveSecret(ref string) (string, error) {
+	if path, ok := strings.CutPrefix(ref, "@"); ok {
+		return readSecretFile(path)
+	}
+	if name, ok := strings.CutPrefix(ref, "env:"); ok {
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return secret, nil
+	}
+	if name, ok := strings.CutPrefix(ref, "cred:"); ok {
+		dir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if dir == "" {
+			return "", fmt.Errorf("credential %s without $CREDENTIALS_DIRECTORY", name)
+		}
+		if name == "" || filepath.Base(name) != name {
+			return "", fmt.Errorf("invalid credential name %q", name)
+		}
+		return readSecretFile(filepath.Join(dir, name))
+	}
+	return ref, nil
+}
+
+// isSecretRef reports whether s is a reference to a secret, see resolveSecret.
+func isSecretRef(s string) bool {
+	return strings.HasPrefix(s, "@") || strings.HasPrefix(s, "env:") || strings.HasPrefix(s, "cred:")
+}
+
+// checkInlineSecrets refuses the secrets inline in the flags, since the command line shows up in
+// ps, even if the config file sets the same options. It must run before the config file overrides
+// the flags. The secrets on the command line must be references, see resolveSecret, while the
+// config file may hold them inline. The entries of ci, kis and kos are "prefix:secret".
+func checkInlineSecrets() error {
+	flags := rootCmd.PersistentFlags()
+	for _, name := range []string{"ki", "ko", "identity"} {
+		secret := flags.Lookup(name).Value.String()
+		if flags.Changed(name) && secret != "" && !isSecretRef(secret) {
+			return fmt.Errorf("--%s puts the secret on the command line, which shows up in ps, pass it as @file, env:NAME or cred:NAME, by --%s_file, or in the config file", name, name)
+		}
+	}
+
+	for _, name := range []string{"ci", "kis", "kos"} {
+		if !flags.Changed(name) {
+			continue
+		}
+		entries := strings.Split(config.CI, ",")
+		if name != "ci" {
+			entries, _ = flags.GetStringSlice(name)
+		}
+		for _, entry := range entries {
+			prefix, secret, _ := strings.Cut(strings.TrimSpace(entry), ":")
+			if secret != "" && !isSecretRef(secret) {
+				return fmt.Errorf("--%s puts the secret of %q on the command line, which shows up in ps, pass it as @file, env:NAME or cred:NAME, or in the config file", name, prefix)
+			}
+		}
+	}
+	return nil
+}
+
+// checkDefaultSecret refuses the public default of the secret name unless insecure is set,
+// so a hop missing its key doesn't run with a key everyone knows.
+func checkDefaultSecret(name string, from string, insecure bool) error {
+	if from != "default" || insecure {
+		return nil
+	}
+	return fmt.Errorf("%s is not configured, set it by --%s_file, $%s%s, $CREDENTIALS_DIRECTORY or the config file, or allow the public default by --insecure_default_key",
+		name, name, secretEnvPrefix, strings.ToUpper(name))
+}
+
+// readSecretFile reads the secret from file, without the trailing line break.
+// Files readable by group or others are refused.
+func readSecretFile(file string) (string, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+	if perm := info.Mode().Perm(); runtime.GOOS != "windows" && perm&0o044 != 0 {
+		return "", fmt.Errorf("secret file %s is readable by group or others (mode %#o), chmod 600 it", file, perm)
+	}
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
@@ -23,25 +23,35 @@
 package cmd
 
 import (
-	"crypto/sha1"
+	"cmp"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"log"
+	"net"
+	"os"
+	"os/signal"
 	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 	"github.com/xtaci/grasshopper"
-	"golang.org/x/crypto/pbkdf2"
 )
 
 const (
-	// SALT is used for PBKDF2 key derivation.
-	SALT = "GRASSHOPPER"
+	// KEYLEN is the length of the derived keys.
+	KEYLEN = 32
 
-	// PBKDF2 iterations.
-	ITERATIONS = 4096
+	// methodUsageInterval is the interval of logging the usage of the inbound crypto methods.
+	methodUsageInterval = time.Minute
 
-	// PBKDF2 key length.
-	KEYLEN = 32
+	// statsInterval is the interval of logging the statistics of the listener.
+	statsInterval = time.Minute
 )
 
 var (
@@ -49,8 +59,8 @@ var (
 	// Injected by the build system.
 	Version = "undefined"
 
-	// allCryptoMethods lists all supported cryptographic methods.
-	allCryptoMethods = []string{"none", "qpp", "sm4", "tea", "aes", "aes-128", "aes-192", "blowfish", "twofish", "cast5", "3des", "xtea", "salsa20"}
+	// allMACMethods lists all supported keyed MACs for non-AEAD ciphers.
+	allMACMethods = []string{"none", grasshopper.MACHMACSHA256, grasshopper.MACBLAKE2b}
 )
 
 // startCmd represents the start command
@@ -64,28 +74,107 @@ var startCmd = &cobra.Command{
 		log.Println("Socket buffer:", config.SockBuf)
 		log.Println("Timeout:", config.Timeout)
 
-		// Validate cryptographic methods.
-		if !slices.Contains(allCryptoMethods, config.CI) {
-			log.Fatal("Invalid crypto method:", config.CI)
+		// Validate cryptographic methods, ci may list several methods accepted side by side.
+		methodsIn, err := parseMethods(config.CI)
+		if err != nil {
+			log.Fatal("Invalid crypto method: ", err)
 		}
+		config.CI = methodsIn[0].method
 
-		if !slices.Contains(allCryptoMethods, config.CO) {
+		if !slices.Contains(grasshopper.Ciphers(), config.CO) {
 			log.Fatal("Invalid crypto method:", config.CO)
 		}
 
-		// Derive cryptographic keys using PBKDF2.
-		log.Printf("Initiating Cryptography (In: %v)  <---> (Out: %v)", config.CI, config.CO)
-		passIn := pbkdf2.Key([]byte(config.KI), []byte(SALT), ITERATIONS, KEYLEN, sha1.New)
-		crypterIn, err := newCrypt(passIn, config.CI)
+		if !slices.Contains(allMACMethods, config.MI) {
+			log.Fatal("Invalid mac method:", config.MI)
+		}
+
+		if !slices.Contains(allMACMethods, config.MO) {
+			log.Fatal("Invalid mac method:", config.MO)
+		}
+
+		// Check the ciphers and their layers against known answers.
+		if err := grasshopper.SelfTest(); err != nil {
+			log.Fatalf("Cipher self-test failed, refusing to start: %v", err)
+		}
+
+		// Load the secrets.
+		var from string
+		if config.KI, from, err = loadSecret("ki", config.KI, config.KIFile); err != nil {
+			log.Fatalf("Failed to load ki: %v", err)
+		}
+		log.Println("Secret ki from:", from)
+		kiUnused := len(config.Clients) > 0 || !slices.ContainsFunc(methodsIn, func(m inboundMethod) bool {
+			return m.secret == "" && m.method != grasshopper.CipherNone
+		})
+		if err := checkDefaultSecret("ki", from, config.InsecureKey || kiUnused); err != nil {
+			log.Fatal(err)
+		}
+		if config.KO, from, err = loadSecret("ko", config.KO, config.KOFile); err != nil {
+			log.Fatalf("Failed to load ko: %v", err)
+		}
+		log.Println("Secret ko from:", from)
+		if err := checkDefaultSecret("ko", from, config.InsecureKey || config.CO == grasshopper.CipherNone); err != nil {
+			log.Fatal(err)
+		}
+
+		// Derive cryptographic keys.
+		log.Printf("Initiating Cryptography (In: %v)  <---> (Out: %v), kdf: %v", config.CI, config.CO, config.KDF)
+		if len(methodsIn) > 1 {
+			log.Println("Inbound methods:", methodsIn)
+		}
+		passIn, err := deriveKey(cmp.Or(methodsIn[0].secret, config.KI), config.CI)
+		if err != nil {
+			log.Fatalf("Failed to derive inbound key (%s): %v", config.KDF, err)
+		}
+		crypterIn, err := newSideCrypter(passIn, inboundOptions())
+		if err != nil {
+			log.Fatalf("Failed to initialize inbound crypto (%v): %v", inboundOptions(), err)
+		}
+		passOut, err := deriveKey(config.KO, config.CO)
 		if err != nil {
-			log.Fatalf("Failed to initialize inbound crypto (%s): %v", config.CI, err)
+			log.Fatalf("Failed to derive outbound key (%s): %v", config.KDF, err)
 		}
-		passOut := pbkdf2.Key([]byte(config.KO), []byte(SALT), ITERATIONS, KEYLEN, sha1.New)
-		crypterOut, err := newCrypt(passOut, config.CO)
+		crypterOut, err := newSideCrypter(passOut, outboundOptions())
 		if err != nil {
-			log.Fatalf("Failed to initialize outbound crypto (%s): %v", config.CO, err)
+			log.Fatalf("Failed to initialize outbound crypto (%v): %v", outboundOptions(), err)
+		}
+		if config.DI || config.DO {
+			log.Printf("Direction-separated keys (In: %v)  <---> (Out: %v)", config.DI, config.DO)
+		}
+
+		// Enable key IDs for key rotation.
+		var keyringIn, keyringOut *grasshopper.Keyring
+		if config.KIID >= 0 {
+			if methodsIn[0].secret != "" {
+				log.Fatal("Inbound key IDs take the secret of ki, not the one of --ci")
+			}
+			if keyringIn, err = newKeyring(config.KIID, crypterIn, config.KIS, inboundOptions()); err != nil {
+				log.Fatalf("Failed to initialize inbound keys: %v", err)
+			}
+			log.Printf("Inbound keys: %v, current: %v", keyringIn.IDs(), keyringIn.Current())
+			crypterIn = keyringIn
+		}
+		if config.KOID >= 0 {
+			if keyringOut, err = newKeyring(config.KOID, crypterOut, config.KOS, outboundOptions()); err != nil {
+				log.Fatalf("Failed to initialize outbound keys: %v", err)
+			}
+			log.Printf("Outbound keys: %v, current: %v", keyringOut.IDs(), keyringOut.Current())
+			crypterOut = keyringOut
+		}
+
+		// Send the client ID to the next hops.
+		if config.CID >= 0 {
+			if config.CID > 65535 {
+				log.Fatal("Invalid client id:", config.CID)
+			}
+			log.Println("Client ID:", config.CID)
+			crypterOut = grasshopper.NewClientCrypt(uint16(config.CID), crypterOut)
 		}
 		log.Println("Cryptography initialized")
+		if err := grasshopper.SecretLockError(); err != nil {
+			log.Println("Warning: keys not locked into memory:", err)
+		}
 
 		// Initialize and start the UDP listener.
 		listener, err := grasshopper.ListenWithOptions(config.Listen, config.NextHops, config.SockBuf, config.Timeout, crypterIn, crypterOut, nil, nil, log.Default())
@@ -93,48 +182,756 @@ var startCmd = &cobra.Command{
 			log.Fatal(err)
 		}
 
+		// Enable per-client keys.
+		var credentials *grasshopper.Credentials
+		if len(config.Clients) > 0 {
+			if config.HI || config.KIID >= 0 {
+				log.Fatal("Per-client keys can't be used with --hi or --kiid")
+			}
+			credentials = grasshopper.NewCredentials()
+			if err := loadCredentials(credentials, config.Clients); err != nil {
+				log.Fatalf("Failed to initialize client credentials: %v", err)
+			}
+			log.Println("Client credentials:", credentials.IDs())
+			listener.SetCredentials(credentials)
+		}
+
+		// Accept several crypto methods from the last hop for migrations.
+		if len(methodsIn) > 1 {
+			if config.HI || config.KIID >= 0 || len(config.Clients) > 0 {
+				log.Fatal("Multiple inbound crypto methods can't be used with --hi, --kiid or per-client keys")
+			}
+			methods, err := newMethods(crypterIn, methodsIn)
+			if err != nil {
+				log.Fatalf("Failed to initialize inbound crypto methods: %v", err)
+			}
+			listener.SetMethods(methods)
+			go logMethodUsage(methods)
+		}
+
+		// Mask the headers of the packets, after the IDs in front of them.
+		if config.HPI || config.HPO {
+			var headerIn, headerOut *grasshopper.HeaderProtection
+			if config.HPI {
+				required := len(config.Clients) > 0 || config.KIID >= 0 || len(methodsIn) > 1
+				if headerIn, err = newHeaderProtection("hki", config.HKI, config.HKIFile, cmp.Or(methodsIn[0].secret, config.KI), required); err != nil {
+					log.Fatalf("Failed to initialize inbound header protection: %v", err)
+				}
+			}
+			if config.HPO {
+				required := config.CID >= 0 || config.KOID >= 0
+				if headerOut, err = newHeaderProtection("hko", config.HKO, config.HKOFile, config.KO, required); err != nil {
+					log.Fatalf("Failed to initialize outbound header protection: %v", err)
+				}
+			}
+			log.Printf("Header protection (In: %v)  <---> (Out: %v)", config.HPI, config.HPO)
+			listener.SetHeaderProtection(headerIn, headerOut)
+		}
+
+		// The secrets are derived into keys already, the reloads read them again.
+		config.KI, config.KO, config.HKI, config.HKO = "", "", "", ""
+
+		if config.FI != grasshopper.MimicryNone || config.FO != grasshopper.MimicryNone {
+			mimicryIn, err := grasshopper.NewMimicry(config.FI)
+			if err != nil {
+				log.Fatalf("Invalid inbound mimicry: %v", err)
+			}
+			mimicryOut, err := grasshopper.NewMimicry(config.FO)
+			if err != nil {
+				log.Fatalf("Invalid outbound mimicry: %v", err)
+			}
+			log.Printf("Protocol mimicry (In: %v)  <---> (Out: %v)", config.FI, config.FO)
+			listener.SetMimicry(mimicryIn, mimicryOut)
+		}
+
+		if config.Workers > 1 {
+			log.Println("Crypto workers:", config.Workers)
+			listener.SetWorkers(config.Workers)
+		}
+
+		if config.RI > 0 || config.RO > 0 {
+			log.Printf("Replay protection (In: %v)  <---> (Out: %v), skew: %v", config.RI, config.RO, config.Skew)
+			if err := listener.SetReplayWindow(config.RI, config.RO, config.Skew); err != nil {
+				log.Fatalf("Invalid replay protection: %v", err)
+			}
+		}
+
+		if (len(config.AI) > 0 && !config.HI) || (len(config.AO) > 0 && !config.HO) {
+			log.Fatal("Static identities require the handshakes, --ai with --hi and --ao with --ho")
+		}
+
+		if config.HI || config.HO {
+			var handshakeIn, handshakeOut *grasshopper.HandshakeConfig
+			if config.HI {
+				if handshakeIn, err = newHandshake(passIn, inboundOptions()); err != nil {
+					log.Fatalf("Failed to initialize inbound handshake: %v", err)
+				}
+			}
+			if config.HO {
+				if handshakeOut, err = newHandshake(passOut, outboundOptions()); err != nil {
+					log.Fatalf("Failed to initialize outbound handshake: %v", err)
+				}
+			}
+			log.Printf("Forward secrecy (In: %v)  <---> (Out: %v), rekey: %v, post-quantum: %v", config.HI, config.HO, config.Rekey, config.PQ)
+
+			if len(config.AI) > 0 || len(config.AO) > 0 {
+				text, from, err := loadSecret("identity", config.Identity, config.IDFile)
+				if err != nil {
+					log.Fatalf("Failed to load identity: %v", err)
+				}
+				if text == "" {
+					log.Fatal("Static identities require an identity, generate one by \"grasshopper keygen\"")
+				}
+				identity, err := grasshopper.ParseIdentity(text)
+				if err != nil {
+					log.Fatalf("Failed to load identity: %v", err)
+				}
+				log.Println("Identity from:", from, "public key:", identity.PublicKey())
+
+				if len(config.AI) > 0 {
+					if handshakeIn.Peers, err = newPeers(config.AI, false); err != nil {
+						log.Fatalf("Invalid inbound peers: %v", err)
+					}
+					handshakeIn.Identity = identity
+				}
+				if len(config.AO) > 0 {
+					if handshakeOut.Peers, err = newPeers(config.AO, true); err != nil {
+						log.Fatalf("Invalid outbound peers: %v", err)
+					}
+					if err := checkNextHops(handshakeOut.Peers); err != nil {
+						log.Fatalf("Invalid outbound peers: %v", err)
+					}
+					handshakeOut.Identity = identity
+				}
+				log.Printf("Static identities (In: %v peers)  <---> (Out: %v peers)", len(config.AI), len(config.AO))
+			}
+			if err := listener.SetHandshake(handshakeIn, handshakeOut); err != nil {
+				log.Fatalf("Failed to initialize handshake: %v", err)
+			}
+			for _, handshake := range []*grasshopper.HandshakeConfig{handshakeIn, handshakeOut} {
+				if handshake != nil {
+					grasshopper.WipeSecret(handshake.PSK)
+				}
+			}
+		}
+		grasshopper.WipeSecret(passIn)
+		grasshopper.WipeSecret(passOut)
+
+		if configFile != "" && (keyringIn != nil || keyringOut != nil || credentials != nil) {
+			go reloadKeys(keyringIn, keyringOut, credentials)
+		}
+
 		log.Println("Ready")
+		go logStats(listener)
 		listener.Start()
 	},
 }
 
-// newCrypt creates a new cryptographic handler based on the provided method and key.
-// Parameters:
-// - pass: The cryptographic key.
-// - method: The cryptographic method to use.
-// Returns:
-// - A BlockCrypt instance implementing the selected cryptographic method.
-func newCrypt(pass []byte, method string) (grasshopper.BlockCrypt, error) {
-	switch method {
+// inboundMethod is a crypto method accepted from the last hop.
+type inboundMethod struct {
+	method string
+	secret string // the secret of the method, ki if empty
+}
+
+func (m inboundMethod) String() string {
+	if m.secret != "" {
+		return m.method + ":***"
+	}
+	return m.method
+}
+
+// parseMethods parses ci, the crypto methods separated by commas, each as "method" or
+// "method:secret", with the secret resolved by resolveSecret. Since "none" accepts any
+// packet, it can't be combined with other methods.
+func parseMethods(ci string) ([]inboundMethod, error) {
+	var methods []inboundMethod
+	for entry := range strings.SplitSeq(ci, ",") {
+		method, secret, _ := strings.Cut(strings.TrimSpace(entry), ":")
+		if !slices.Contains(grasshopper.Ciphers(), method) {
+			return nil, fmt.Errorf("%q", method)
+		}
+		secret, err := resolveSecret(secret)
+		if err != nil {
+			return nil, fmt.Errorf("secret of %q: %w", method, err)
+		}
+		if len(methods) > 0 && (method == grasshopper.CipherNone || methods[0].method == grasshopper.CipherNone) {
+			return nil, fmt.Errorf("%q can't be combined with other methods", grasshopper.CipherNone)
+		}
+		if slices.Contains(methods, inboundMethod{method, secret}) {
+			return nil, fmt.Errorf("duplicated method %q", method)
+		}
+		methods = append(methods, inboundMethod{method, secret})
+	}
+	return methods, nil
+}
+
+// newMethods creates the crypto methods accepted side by side, with crypter of the first method.
+// The other methods share the inbound options of the first one.
+func newMethods(crypter grasshopper.Crypter, methods []inboundMethod) (*grasshopper.Methods, error) {
+	result := grasshopper.NewMethods()
+	result.Add(methods[0].method, crypter)
+	for _, method := range methods[1:] {
+		pass, err := deriveKey(cmp.Or(method.secret, config.KI), method.method)
+		if err != nil {
+			result.Destroy()
+			return nil, err
+		}
+		opts := inboundOptions()
+		opts.method = method.method
+		crypter, err := newSideCrypter(pass, opts)
+		grasshopper.WipeSecret(pass)
+		if err != nil {
+			result.Destroy()
+			return nil, fmt.Errorf("%v: %w", method.method, err)
+		}
+		result.Add(method.method, crypter)
+	}
+	return result, nil
+}
+
+// logMethodUsage logs the usage of the inbound crypto methods periodically, so the old
+// methods can be removed once they are no longer used.
+func logMethodUsage(methods *grasshopper.Methods) {
+	for range time.Tick(methodUsageInterval) {
+		var usage []string
+		for _, u := range methods.Usage() {
+			usage = append(usage, fmt.Sprintf("%v: %d packets, %d clients", u.Name, u.Packets, u.Clients))
+		}
+		log.Println("Inbound methods usage:", strings.Join(usage, ", "))
+	}
+}
+
+// logStats logs the statistics of the listener periodically, so the drops of replayed, skewed
+// and queued packets show up.
+func logStats(listener *grasshopper.Listener) {
+	for range time.Tick(statsInterval) {
+		snmp := listener.Snmp()
+		var stats []string
+		for i, value := range snmp.ToSlice() {
+			stats = append(stats, snmp.Header()[i]+": "+value)
+		}
+		log.Println("Stats:", strings.Join(stats, ", "))
+	}
+}
+
+// cryptoOptions defines the crypters of a side of the listener.
+type cryptoOptions struct {
+	method      string
+	mac         string
+	padding     string
+	version     int
+	directional bool   // direction-separated subkeys
+	outbound    bool   // the side of next hops, sending upstream
+	mimicry     string // mimicry profile framing the datagrams
+	overhead    int    // size of the layers wrapping the padded packets, left out of padmtu
+}
+
+// inboundOptions returns the crypto options of the side of clients.
+func inboundOptions() cryptoOptions {
+	return cryptoOptions{method: config.CI, mac: config.MI, padding: config.PI, version: config.VI, directional: config.DI,
+		mimicry: config.FI, overhead: grasshopper.PaddingOverhead(config.KIID >= 0, len(config.Clients) > 0, false, config.FI)}
+}
+
+// outboundOptions returns the crypto options of the side of next hops.
+func outboundOptions() cryptoOptions {
+	return cryptoOptions{method: config.CO, mac: config.MO, padding: config.PO, version: config.VO, directional: config.DO, outbound: true,
+		mimicry: config.FO, overhead: grasshopper.PaddingOverhead(config.KOID >= 0, config.CID >= 0, false, config.FO)}
+}
+
+func (opts cryptoOptions) String() string {
+	return fmt.Sprintf("%s, mac: %s, padding: %s, wire: v%d, directional: %v", opts.method, opts.mac, opts.padding, opts.version, opts.directional)
+}
+
+// newSideCrypter creates the crypter of a side from pass. With direction-separated subkeys,
+// the packets sent and received are encrypted by the crypters of the subkeys of their
+// directions, so packets reflected back to their sender are refused.
+func newSideCrypter(pass []byte, opts cryptoOptions) (grasshopper.Crypter, error) {
+	if !opts.directional {
+		return newCrypter(pass, opts)
+	}
+	if opts.method == grasshopper.CipherNone {
+		return nil, fmt.Errorf("direction-separated subkeys require a crypto method")
+	}
+
+	send, recv := grasshopper.Downstream, grasshopper.Upstream
+	if opts.outbound {
+		send, recv = recv, send
+	}
+	var crypters [2]grasshopper.Crypter
+	for i, direction := range []string{send, recv} {
+		key, err := grasshopper.DeriveDirectionKey(pass, direction)
+		if err != nil {
+			return nil, err
+		}
+		crypters[i], err = newCrypter(key, opts)
+		grasshopper.WipeSecret(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return grasshopper.NewDirectionalCrypt(crypters[0], crypters[1])
+}
+
+// newCrypter creates the crypter of the crypto method from pass, wrapped by the mac, the wire version
+// and padding.
+func newCrypter(pass []byte, opts cryptoOptions) (grasshopper.Crypter, error) {
+	var crypter grasshopper.Crypter
+	var err error
+	if opts.method == "qpp" {
+		keyLen, _ := grasshopper.CipherKeyLen(opts.method)
+		crypter, err = grasshopper.NewQPPCryptWithPads(pass[:keyLen], config.QPPPads)
+	} else {
+		crypter, err = grasshopper.NewCipher(opts.method, pass)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if crypter, err = newMAC(crypter, pass, opts.mac, config.MACSize); err != nil {
+		return nil, err
+	}
+	if crypter != nil {
+		if crypter, err = grasshopper.NewVersionCrypt(crypter, opts.version); err != nil {
+			return nil, err
+		}
+	} else if opts.version != grasshopper.WireV1 {
+		return nil, fmt.Errorf("wire version %d requires a crypto method", opts.version)
+	}
+	return newPadding(crypter, opts)
+}
+
+// newHeaderProtection creates the header protection of a side from the secret name(hki or hko),
+// or from fallback, the secret of the side, if it's not set. The header key is expanded from the
+// secret by HKDF-SHA256, so it's independent from the cipher keys, and from the crypto methods.
+// A side with several keys must set its own secret, required reports so.
+func newHeaderProtection(name string, value string, file string, fallback string, required bool) (*grasshopper.HeaderProtection, error) {
+	secret, from, err := loadSecret(name, value, file)
+	if err != nil {
+		return nil, err
+	}
+	if from == "default" {
+		if required {
+			return nil, fmt.Errorf("%s must be set with per-client keys, client IDs, key IDs or several inbound methods", name)
+		}
+		secret, from = fallback, "the secret of the side"
+	}
+	log.Printf("Secret %s from: %s", name, from)
+
+	pass, err := deriveKey(secret, grasshopper.CipherNone)
+	if err != nil {
+		return nil, err
+	}
+	defer grasshopper.WipeSecret(pass)
+	key, err := hkdf.Key(sha256.New, pass, nil, "grasshopper header protection", KEYLEN)
+	if err != nil {
+		return nil, err
+	}
+	defer grasshopper.WipeSecret(key)
+	return grasshopper.NewHeaderProtection(key)
+}
+
+// newMAC wraps the crypter with encrypt-then-MAC integrity.
+// The MAC key is expanded from pass by HKDF-SHA256, so it's independent from the cipher key.
+func newMAC(crypter grasshopper.Crypter, pass []byte, mac string, tagSize int) (grasshopper.Crypter, error) {
+	if mac == "none" {
+		return crypter, nil
+	}
+	block, ok := crypter.(grasshopper.BlockCrypt)
+	if !ok {
+		return nil, fmt.Errorf("mac %s requires a crypto method without authentication", mac)
+	}
+
+	key, err := hkdf.Key(sha256.New, pass, nil, "grasshopper mac", KEYLEN)
+	if err != nil {
+		return nil, err
+	}
+	defer grasshopper.WipeSecret(key)
+	return grasshopper.NewMACCrypt(block, mac, key, tagSize)
+}
+
+// deriveKey derives a key from secret with the configured kdf, for the crypto method.
+// The key is KEYLEN bytes, or longer if the method requires. It's allocated by
+// grasshopper.NewSecret, and should be wiped by grasshopper.WipeSecret once used.
+func deriveKey(secret string, method string) ([]byte, error) {
+	keyLen, _ := grasshopper.CipherKeyLen(method)
+	key, err := grasshopper.DeriveKey(config.KDF, secret, &grasshopper.KDFParams{
+		Salt:        []byte(config.Salt),
+		Iterations:  config.KDFIter,
+		Memory:      config.KDFMem,
+		Parallelism: config.KDFThreads,
+	}, max(keyLen, KEYLEN))
+	if err != nil {
+		return nil, err
+	}
+	defer grasshopper.WipeSecret(key)
+
+	pass := grasshopper.NewSecret(len(key))
+	copy(pass, key)
+	return pass, nil
+}
+
+// newKeyring creates a keyring with crypter as the current key `id`, and the extra keys
+// formatted as "id:secret", using the same crypto options.
+func newKeyring(id int, crypter grasshopper.Crypter, extra []string, opts cryptoOptions) (*grasshopper.Keyring, error) {
+	if id < 0 || id > 255 {
+		return nil, fmt.Errorf("invalid key id %d", id)
+	}
+
+	secrets, err := parseKeys(extra)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := secrets[byte(id)]; ok {
+		return nil, fmt.Errorf("duplicated key id %d", id)
+	}
+	keys, err := newKeys(secrets, opts)
+	if err != nil {
+		return nil, err
+	}
+	keys[byte(id)] = crypter
+
+	keyring := grasshopper.NewKeyring(byte(id), crypter)
+	return keyring, loadKeys(keyring, byte(id), keys)
+}
+
+// parseKeys parses the keys formatted as "id:secret" into their secrets by id, with the
+// secrets resolved by resolveSecret.
+func parseKeys(keys []string) (map[byte]string, error) {
+	secrets := make(map[byte]string)
+	for i, key := range keys {
+		sid, secret, ok := strings.Cut(key, ":")
+		id, err := strconv.Atoi(sid)
+		if !ok || err != nil || id < 0 || id > 255 {
+			return nil, fmt.Errorf("invalid key #%d, expected \"id:secret\" with id in [0, 255]", i)
+		}
+		if _, ok := secrets[byte(id)]; ok {
+			return nil, fmt.Errorf("duplicated key id %d", id)
+		}
+		if secrets[byte(id)], err = resolveSecret(secret); err != nil {
+			return nil, fmt.Errorf("key %d: %w", id, err)
+		}
+	}
+	return secrets, nil
+}
+
+// newKeys creates the crypters of the secrets by key id, the crypters created are
+// destroyed on errors.
+func newKeys(secrets map[byte]string, opts cryptoOptions) (map[byte]grasshopper.Crypter, error) {
+	crypters := make(map[byte]grasshopper.Crypter)
+	done := false
+	defer func() {
+		if !done {
+			for _, crypter := range crypters {
+				grasshopper.Destroy(crypter)
+			}
+		}
+	}()
+
+	for id, secret := range secrets {
+		pass, err := deriveKey(secret, opts.method)
+		if err != nil {
+			return nil, err
+		}
+		crypter, err := newSideCrypter(pass, opts)
+		grasshopper.WipeSecret(pass)
+		if err != nil {
+			return nil, err
+		}
+		crypters[id] = crypter
+	}
+	done = true
+	return crypters, nil
+}
+
+// loadKeys makes the keyring hold exactly the keys, with the key `id` as the current key,
+// which is kept as is if it's missing from keys.
+func loadKeys(keyring *grasshopper.Keyring, id byte, keys map[byte]grasshopper.Crypter) error {
+	for kid, crypter := range keys {
+		keyring.Add(kid, crypter)
+	}
+	if err := keyring.Use(id); err != nil {
+		return err
+	}
+	for _, kid := range keyring.IDs() {
+		if _, ok := keys[kid]; !ok && kid != id {
+			_ = keyring.Remove(kid)
+		}
+	}
+	return nil
+}
+
+// clientDigests holds the digests of the client configs loaded into the credentials by id,
+// so a reload replaces only the credentials changed.
+var clientDigests = make(map[uint16][sha256.Size]byte)
+
+// loadCredentials makes credentials hold exactly the credentials of the clients, the
+// credentials not configured are revoked, and the ones unchanged are kept along with
+// the clients identified by them.
+func loadCredentials(credentials *grasshopper.Credentials, clients []ClientConfig) error {
+	ids := make(map[uint16]bool)
+	clients = slices.Clone(clients)
+	for i := range clients {
+		client := &clients[i]
+		if client.ID < 0 || client.ID > 65535 {
+			return fmt.Errorf("invalid client id %d", client.ID)
+		}
+		if ids[uint16(client.ID)] {
+			return fmt.Errorf("duplicated client id %d", client.ID)
+		}
+		ids[uint16(client.ID)] = true
+
+		if client.Method == "" || client.Method == grasshopper.CipherNone || !slices.Contains(grasshopper.Ciphers(), client.Method) {
+			return fmt.Errorf("invalid crypto method %q of client %d", client.Method, client.ID)
+		}
+		if client.MAC == "" {
+			client.MAC = "none"
+		}
+		if client.Padding == "" {
+			client.Padding = config.PI
+		}
+		if !slices.Contains(allMACMethods, client.MAC) {
+			return fmt.Errorf("invalid mac method %q of client %d", client.MAC, client.ID)
+		}
+	}
+
+	for _, client := range clients {
+		text, err := json.Marshal(client)
+		if err != nil {
+			return err
+		}
+		digest := sha256.Sum256(text)
+		clear(text)
+		if loaded, ok := clientDigests[uint16(client.ID)]; ok && loaded == digest && slices.Contains(credentials.IDs(), uint16(client.ID)) {
+			continue
+		}
+
+		pass, err := deriveKey(client.Key, client.Method)
+		if err != nil {
+			return err
+		}
+		opts := inboundOptions()
+		opts.method, opts.mac, opts.padding = client.Method, client.MAC, client.Padding
+		crypter, err := newSideCrypter(pass, opts)
+		grasshopper.WipeSecret(pass)
+		if err != nil {
+			return err
+		}
+		if err := credentials.Add(&grasshopper.Credential{ID: uint16(client.ID), Crypter: crypter, NextHops: client.NextHops}); err != nil {
+			grasshopper.Destroy(crypter)
+			return err
+		}
+		clientDigests[uint16(client.ID)] = digest
+	}
+
+	for _, id := range credentials.IDs() {
+		if !ids[id] {
+			_ = credentials.Revoke(id)
+			delete(clientDigests, id)
+		}
+	}
+	return nil
+}
+
+// reloadKeys reloads the keys and client credentials from the config file on SIGHUP,
+// the crypto options of the keys are kept as started.
+func reloadKeys(keyringIn, keyringOut *grasshopper.Keyring, credentials *grasshopper.Credentials) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		c := *config
+		c.KIS, c.KOS, c.Clients = nil, nil, nil // slices are decoded in place
+		if err := viper.ReadInConfig(); err != nil {
+			log.Println("Error reading config file:", err)
+			continue
+		}
+		if err := viper.Unmarshal(&c); err != nil {
+			log.Println("Error unmarshalling config file:", err)
+			continue
+		}
+
+		var err error
+		var fromKI, fromKO string
+		if c.KI, fromKI, err = loadSecret("ki", c.KI, c.KIFile); err != nil {
+			log.Println("Failed to reload ki:", err)
+			continue
+		}
+		if c.KO, fromKO, err = loadSecret("ko", c.KO, c.KOFile); err != nil {
+			log.Println("Failed to reload ko:", err)
+			continue
+		}
+
+		// The secrets from flags can't change, and are wiped at start, so their keys are kept.
+		reload := func(keyring *grasshopper.Keyring, name string, id int, secret, from string, extra []string, opts cryptoOptions) error {
+			if id < 0 || id > 255 {
+				return fmt.Errorf("invalid key id %d", id)
+			}
+			if err := checkDefaultSecret(name, from, c.InsecureKey); err != nil {
+				return err
+			}
+			secrets, err := parseKeys(extra)
+			if err != nil {
+				return err
+			}
+			if _, ok := secrets[byte(id)]; ok {
+				return fmt.Errorf("duplicated key id %d", id)
+			}
+			if from != "flag" {
+				secrets[byte(id)] = secret
+			}
+			keys, err := newKeys(secrets, opts)
+			if err != nil {
+				return err
+			}
+			return loadKeys(keyring, byte(id), keys)
+		}
+
+		if keyringIn != nil {
+			if err := reload(keyringIn, "ki", c.KIID, c.KI, fromKI, c.KIS, inboundOptions()); err != nil {
+				log.Println("Failed to reload inbound keys:", err)
+			} else {
+				log.Printf("Inbound keys reloaded: %v, current: %v", keyringIn.IDs(), keyringIn.Current())
+			}
+		}
+		if keyringOut != nil {
+			if err := reload(keyringOut, "ko", c.KOID, c.KO, fromKO, c.KOS, outboundOptions()); err != nil {
+				log.Println("Failed to reload outbound keys:", err)
+			} else {
+				log.Printf("Outbound keys reloaded: %v, current: %v", keyringOut.IDs(), keyringOut.Current())
+			}
+		}
+		if credentials != nil {
+			if err := loadCredentials(credentials, c.Clients); err != nil {
+				log.Println("Failed to reload client credentials:", err)
+			} else {
+				log.Println("Client credentials reloaded:", credentials.IDs())
+			}
+		}
+	}
+}
+
+// newHandshake creates the handshake config of a side, the sessions use the same
+// crypto options as the side, with keys negotiated by the handshake, which are
+// already separated by direction, and padded in the room left by the session index.
+// The PSK is expanded from pass by HKDF-SHA256.
+func newHandshake(pass []byte, opts cryptoOptions) (*grasshopper.HandshakeConfig, error) {
+	if opts.method == grasshopper.CipherNone {
+		return nil, fmt.Errorf("handshake requires a crypto method")
+	}
+
+	psk, err := hkdf.Key(sha256.New, pass, nil, "grasshopper psk", KEYLEN)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionOpts := opts
+	sessionOpts.overhead += grasshopper.PaddingOverhead(false, false, true, grasshopper.MimicryNone)
+	return &grasshopper.HandshakeConfig{
+		PSK: psk,
+		NewCrypt: func(key []byte) (grasshopper.Crypter, error) {
+			return newCrypter(key, sessionOpts)
+		},
+		RekeyInterval: config.Rekey,
+		PostQuantum:   config.PQ,
+		MTU:           config.PadMTU - grasshopper.PaddingOverhead(false, false, false, opts.mimicry),
+	}, nil
+}
+
+// newPeers parses the identities authorized in the handshakes, formatted as "key", or
+// "key@host:port" for the next hops, whose addresses are resolved as they are dialed.
+func newPeers(peers []string, nextHop bool) ([]grasshopper.Peer, error) {
+	var authorized []grasshopper.Peer
+	for i, p := range peers {
+		key, address, ok := strings.Cut(p, "@")
+		if ok != nextHop {
+			if nextHop {
+				return nil, fmt.Errorf("invalid peer #%d, expected \"key@host:port\"", i)
+			}
+			return nil, fmt.Errorf("invalid peer #%d, expected a public key", i)
+		}
+
+		pub, err := grasshopper.ParsePublicKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer #%d: %v", i, err)
+		}
+		peer := grasshopper.Peer{PublicKey: pub}
+		if nextHop {
+			addr, err := net.ResolveUDPAddr("udp", address)
+			if err != nil {
+				return nil, fmt.Errorf("invalid peer #%d: %v", i, err)
+			}
+			peer.Address = addr.String()
+		}
+		authorized = append(authorized, peer)
+	}
+	return authorized, nil
+}
+
+// checkNextHops makes sure the next hops, including the ones of the clients, have their identities
+// in peers, otherwise the packets to them would be dropped.
+func checkNextHops(peers []grasshopper.Peer) error {
+	nextHops := slices.Clone(config.NextHops)
+	for _, client := range config.Clients {
+		nextHops = append(nextHops, client.NextHops...)
+	}
+
+	for _, nextHop := range nextHops {
+		addr, err := net.ResolveUDPAddr("udp", nextHop)
+		if err != nil {
+			return err
+		}
+		if !slices.ContainsFunc(peers, func(peer grasshopper.Peer) bool { return peer.Address == addr.String() }) {
+			return fmt.Errorf("next hop %s has no identity", nextHop)
+		}
+	}
+	return nil
+}
+
+// newPadding wraps the crypter with the padding policy of opts, formatted as one of:
+//   - none: no padding framing
+//   - strip: strips the padding from the peer, but pads nothing
+//   - buckets:128,256,...: pads to the smallest bucket fitting
+//   - random:N: pads 0 to N random bytes
+//   - mtu: pads to the padding MTU
+//
+// The padded packets are limited to padmtu less the layers wrapping them.
+func newPadding(crypter grasshopper.Crypter, opts cryptoOptions) (grasshopper.Crypter, error) {
+	var policy grasshopper.PaddingPolicy
+	padding := opts.padding
+	name, arg, _ := strings.Cut(padding, ":")
+	switch name {
 	case "none":
-		return nil, nil
-	case "sm4":
-		return grasshopper.NewSM4BlockCrypt(pass[:16])
-	case "tea":
-		return grasshopper.NewTEABlockCrypt(pass[:16])
-	case "aes":
-		return grasshopper.NewAESBlockCrypt(pass)
-	case "aes-128":
-		return grasshopper.NewAESBlockCrypt(pass[:16])
-	case "aes-192":
-		return grasshopper.NewAESBlockCrypt(pass[:24])
-	case "blowfish":
-		return grasshopper.NewBlowfishBlockCrypt(pass)
-	case "twofish":
-		return grasshopper.NewTwofishBlockCrypt(pass)
-	case "cast5":
-		return grasshopper.NewCast5BlockCrypt(pass[:16])
-	case "3des":
-		return grasshopper.NewTripleDESBlockCrypt(pass[:24])
-	case "xtea":
-		return grasshopper.NewXTEABlockCrypt(pass[:16])
-	case "salsa20":
-		return grasshopper.NewSalsa20BlockCrypt(pass)
-	case "qpp":
-		return grasshopper.NewQPPCrypt(pass)
+		return crypter, nil
+	case "strip":
+	case "mtu":
+		policy = grasshopper.MTUPadding()
+	case "buckets":
+		var sizes []int
+		for _, s := range strings.Split(arg, ",") {
+			size, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				return nil, fmt.Errorf("invalid padding bucket %q", s)
+			}
+			sizes = append(sizes, size)
+		}
+		var err error
+		if policy, err = grasshopper.BucketPadding(sizes...); err != nil {
+			return nil, err
+		}
+	case "random":
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid random padding %q", arg)
+		}
+		if policy, err = grasshopper.RandomPadding(n); err != nil {
+			return nil, err
+		}
 	default:
-		return nil, fmt.Errorf("unsupported crypto method %q", method)
+		return nil, fmt.Errorf("unsupported padding %q", padding)
+	}
+	mtu := config.PadMTU - opts.overhead
+	if mtu <= 0 {
+		return nil, fmt.Errorf("padmtu %d leaves no room for the %d bytes of key IDs, client IDs, session indexes and mimicry", config.PadMTU, opts.overhead)
 	}
+	return grasshopper.NewPaddingCrypt(crypter, policy, mtu)
 }
 
 func init() {
@@ -0,0 +1,276 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// clientIDSize defines the size of the client ID prepended to the packets of a credential.
+	// | client id(2 bytes) | packet of the credential |
+	clientIDSize = 2
+)
+
+var (
+	errUnknownClient = errors.New("unknown client")
+	errNoCrypter     = errors.New("credential requires a crypter")
+)
+
+// Credential is the key of a client on a multi-tenant listener, see Listener.SetCredentials.
+type Credential struct {
+	// ID identifies the credential in the packet header, clients created by NewClientCrypt
+	// send it, while others are identified by trial decryption.
+	ID uint16
+
+	// Crypter encrypts and decrypts the packets of the client.
+	Crypter Crypter
+
+	// NextHops is the optional group of next hops for the client, the listener's next
+	// hops are used if empty.
+	NextHops []string
+
+	revoked atomic.Bool
+}
+
+// clientBinding records the credential a client has been identified with.
+type clientBinding struct {
+	credential *Credential
+	withID     bool // the client sends the client ID
+}
+
+// Credentials holds the credentials of the clients of a listener, credentials can be
+// added and revoked at runtime without affecting the others. The crypters of the
+// credentials revoked or replaced are destroyed, see Destroyer.
+type Credentials struct {
+	credentials map[uint16]*Credential
+	order       []*Credential            // trial decryption order
+	clients     map[string]clientBinding // client address -> credential in use
+	mu          sync.RWMutex
+}
+
+// NewCredentials creates an empty set of credentials.
+func NewCredentials() *Credentials {
+	c := new(Credentials)
+	c.credentials = make(map[uint16]*Credential)
+	c.clients = make(map[string]clientBinding)
+	return c
+}
+
+// Add adds a credential, a credential with the same ID is revoked and replaced.
+func (c *Credentials) Add(credential *Credential) error {
+	if credential.Crypter == nil {
+		return errors.WithStack(errNoCrypter)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.credentials[credential.ID]; ok {
+		c.revoke(old)
+		if old.Crypter != credential.Crypter {
+			Destroy(old.Crypter)
+		}
+	}
+	c.credentials[credential.ID] = credential
+	c.order = append(c.order, credential)
+	return nil
+}
+
+// Revoke revokes the credential `id`, packets from its clients are dropped from now on.
+func (c *Credentials) Revoke(id uint16) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	credential, ok := c.credentials[id]
+	if !ok {
+		return errors.WithStack(errUnknownClient)
+	}
+	c.revoke(credential)
+	Destroy(credential.Crypter)
+	return nil
+}
+
+// revoke removes the credential, c.mu must be held.
+func (c *Credentials) revoke(credential *Credential) {
+	credential.revoked.Store(true)
+	delete(c.credentials, credential.ID)
+	c.order = slices.DeleteFunc(c.order, func(e *Credential) bool { return e == credential })
+	for client, binding := range c.clients {
+		if binding.credential == credential {
+			delete(c.clients, client)
+		}
+	}
+}
+
+// Destroy zeroes the keys of the crypters of all the credentials, the credentials must
+// not be used afterwards.
+func (c *Credentials) Destroy() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, credential := range c.credentials {
+		Destroy(credential.Crypter)
+	}
+}
+
+// IDs returns the IDs of the credentials in ascending order.
+func (c *Credentials) IDs() []uint16 {
+	c.mu.RLock()
+	ids := make([]uint16, 0, len(c.credentials))
+	for id := range c.credentials {
+		ids = append(ids, id)
+	}
+	c.mu.RUnlock()
+	slices.Sort(ids)
+	return ids
+}
+
+// open decrypts a packet from client, identifying the credential by the client ID,
+// or by trial decryption if the client doesn't send it, the packets too short to be
+// decrypted identify nothing. The credential found is
+// remembered for the later packets and the replies. The lock is held while decrypting,
+// so the crypters are not destroyed meanwhile.
+func (c *Credentials) open(client string, packet []byte) ([]byte, error) {
+	c.mu.RLock()
+	binding, ok := c.clients[client]
+
+	// decrypt in place with the credential in use
+	if ok && !binding.credential.revoked.Load() {
+		if !binding.withID {
+			defer c.mu.RUnlock()
+			return decryptPacket(binding.credential.Crypter, packet)
+		}
+		if len(packet) >= clientIDSize && binary.LittleEndian.Uint16(packet) == binding.credential.ID {
+			defer c.mu.RUnlock()
+			return decryptPacket(binding.credential.Crypter, packet[clientIDSize:])
+		}
+	}
+
+	// identify the credential, decrypting copies of the packet
+	if len(packet) >= clientIDSize {
+		if credential, ok := c.credentials[binary.LittleEndian.Uint16(packet)]; ok {
+			if data, err := decryptPacket(credential.Crypter, bytes.Clone(packet[clientIDSize:])); err == nil && data != nil {
+				c.mu.RUnlock()
+				c.bind(client, clientBinding{credential, true})
+				return data, nil
+			}
+		}
+	}
+
+	for _, credential := range c.order {
+		if data, err := decryptPacket(credential.Crypter, bytes.Clone(packet)); err == nil && data != nil {
+			c.mu.RUnlock()
+			c.bind(client, clientBinding{credential, false})
+			return data, nil
+		}
+	}
+	c.mu.RUnlock()
+	return nil, errUnknownClient
+}
+
+// bind remembers the credential of client unless it has been revoked meanwhile.
+func (c *Credentials) bind(client string, binding clientBinding) {
+	c.mu.Lock()
+	if !binding.credential.revoked.Load() {
+		c.clients[client] = binding
+	}
+	c.mu.Unlock()
+}
+
+// seal encrypts data to client with its credential, it returns nil if the client
+// has not been identified.
+func (c *Credentials) seal(client string, data []byte) []byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	binding, ok := c.clients[client]
+	if !ok {
+		return nil
+	}
+
+	if !binding.withID {
+		return encryptPacket(binding.credential.Crypter, data)
+	}
+	return sealWithID(binding.credential.ID, binding.credential.Crypter, data)
+}
+
+// sealWithID encrypts data with crypter, prepending the client ID.
+func sealWithID(id uint16, crypter Crypter, data []byte) []byte {
+	sealed := encryptPacket(crypter, data)
+	packet := make([]byte, clientIDSize+len(sealed))
+	binary.LittleEndian.PutUint16(packet, id)
+	copy(packet[clientIDSize:], sealed)
+	return packet
+}
+
+// nextHops returns the next hop group of client, or nil if not specified.
+func (c *Credentials) nextHops(client string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if binding, ok := c.clients[client]; ok {
+		return binding.credential.NextHops
+	}
+	return nil
+}
+
+// remove forgets the credential of client.
+func (c *Credentials) remove(client string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	delete(c.clients, client)
+	c.mu.Unlock()
+}
+
+// clientCrypt sends the client ID of a credential to a multi-tenant listener.
+type clientCrypt struct {
+	id      uint16
+	crypter Crypter
+}
+
+// NewClientCrypt wraps crypter to prepend the client ID `id` to the packets, and
+// strip it from the replies, identifying the credential on the next hop without
+// trial decryption, see Listener.SetCredentials.
+func NewClientCrypt(id uint16, crypter Crypter) PacketCrypt {
+	return &clientCrypt{id: id, crypter: crypter}
+}
+
+// Destroy zeroes the keys of the crypter.
+func (c *clientCrypt) Destroy() { Destroy(c.crypter) }
+
+func (c *clientCrypt) isCrypter()                    {}
+func (c *clientCrypt) SealPacket(data []byte) []byte { return sealWithID(c.id, c.crypter, data) }
+
+func (c *clientCrypt) OpenPacket(packet []byte) ([]byte, error) {
+	if len(packet) < clientIDSize {
+		return nil, errShortPacket
+	}
+	if binary.LittleEndian.Uint16(packet) != c.id {
+		return nil, errUnknownClient
+	}
+	return decryptPacket(c.crypter, packet[clientIDSize:])
+}
@@ -0,0 +1,149 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCredentials(t *testing.T) {
+	keyA, keyB := make([]byte, 32), make([]byte, 32)
+	keyB[0] = 1
+	aesA, _ := NewAESBlockCrypt(keyA)
+	gcmB, _ := NewAESGCMCrypt(keyB)
+
+	credentials := NewCredentials()
+	if err := credentials.Add(&Credential{ID: 1, Crypter: aesA, NextHops: []string{"hop-a"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := credentials.Add(&Credential{ID: 2, Crypter: gcmB}); err != nil {
+		t.Fatal(err)
+	}
+	if err := credentials.Add(&Credential{ID: 3}); err == nil {
+		t.Fatal("added a credential without crypter")
+	}
+
+	// client a sends its client ID, client b is identified by trial decryption
+	clientA := NewClientCrypt(1, aesA)
+	data := []byte("hello")
+	for range 2 {
+		if out, err := credentials.open("a", encryptPacket(clientA, data)); err != nil || !bytes.Equal(out, data) {
+			t.Fatal("client a", err)
+		}
+		if out, err := credentials.open("b", encryptPacket(gcmB, data)); err != nil || !bytes.Equal(out, data) {
+			t.Fatal("client b", err)
+		}
+	}
+
+	// replies are encrypted with the credential of the client
+	if out, err := decryptPacket(clientA, credentials.seal("a", data)); err != nil || !bytes.Equal(out, data) {
+		t.Fatal("reply to client a", err)
+	}
+	if out, err := decryptPacket(gcmB, credentials.seal("b", data)); err != nil || !bytes.Equal(out, data) {
+		t.Fatal("reply to client b", err)
+	}
+	if credentials.seal("c", data) != nil {
+		t.Fatal("reply to an unknown client")
+	}
+	if hops := credentials.nextHops("a"); len(hops) != 1 || hops[0] != "hop-a" {
+		t.Fatal("unexpected next hops", hops)
+	}
+	if hops := credentials.nextHops("b"); hops != nil {
+		t.Fatal("unexpected next hops", hops)
+	}
+
+	// a client can't use the credential of another
+	if _, err := credentials.open("c", encryptPacket(NewClientCrypt(2, aesA), data)); err != errUnknownClient {
+		t.Fatal("expected errUnknownClient, got", err)
+	}
+
+	// revoking a doesn't affect b
+	if err := credentials.Revoke(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := credentials.open("a", encryptPacket(clientA, data)); err != errUnknownClient {
+		t.Fatal("expected errUnknownClient, got", err)
+	}
+	if credentials.seal("a", data) != nil {
+		t.Fatal("reply to a revoked client")
+	}
+	if out, err := credentials.open("b", encryptPacket(gcmB, data)); err != nil || !bytes.Equal(out, data) {
+		t.Fatal("client b after revocation", err)
+	}
+	if ids := credentials.IDs(); len(ids) != 1 || ids[0] != 2 {
+		t.Fatal("unexpected ids", ids)
+	}
+	if err := credentials.Revoke(1); err == nil {
+		t.Fatal("revoked twice")
+	}
+}
+
+func TestCredentialsShortPacket(t *testing.T) {
+	keyA, keyB := make([]byte, 32), make([]byte, 32)
+	keyB[0] = 1
+	aesA, _ := NewAESBlockCrypt(keyA)
+	aesB, _ := NewAESBlockCrypt(keyB)
+
+	credentials := NewCredentials()
+	credentials.Add(&Credential{ID: 1, Crypter: aesA})
+	credentials.Add(&Credential{ID: 2, Crypter: aesB})
+
+	// a runt packet doesn't bind the client to the first credential
+	if _, err := credentials.open("b", []byte{1, 0, 2}); err != errUnknownClient {
+		t.Fatal("expected errUnknownClient, got", err)
+	}
+	data := []byte("hello")
+	if out, err := credentials.open("b", encryptPacket(aesB, data)); err != nil || !bytes.Equal(out, data) {
+		t.Fatal("client b after a short packet", err)
+	}
+	if out, err := decryptPacket(aesB, credentials.seal("b", data)); err != nil || !bytes.Equal(out, data) {
+		t.Fatal("reply to client b", err)
+	}
+}
+
+func TestCredentialsDestroy(t *testing.T) {
+	crypterA, _ := NewSalsa20BlockCrypt(pass[:32])
+	crypterB, _ := NewSalsa20BlockCrypt(pass[:32])
+	credentials := NewCredentials()
+	credentials.Add(&Credential{ID: 1, Crypter: crypterA})
+	credentials.Add(&Credential{ID: 2, Crypter: crypterB})
+
+	// the same crypter of a replaced credential is kept
+	credentials.Add(&Credential{ID: 1, Crypter: crypterA})
+	if isZero(crypterA.(*salsa20BlockCrypt).key[:]) {
+		t.Fatal("crypter destroyed when replaced by itself")
+	}
+
+	if err := credentials.Revoke(2); err != nil {
+		t.Fatal(err)
+	}
+	if !isZero(crypterB.(*salsa20BlockCrypt).key[:]) {
+		t.Fatal("revoked crypter not destroyed")
+	}
+
+	credentials.Destroy()
+	if !isZero(crypterA.(*salsa20BlockCrypt).key[:]) {
+		t.Fatal("crypter not destroyed")
+	}
+}
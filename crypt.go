@@ -26,13 +26,21 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/des"
+	"crypto/rand"
 	"crypto/subtle"
+	"encoding/binary"
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
 
+	"github.com/pkg/errors"
 	"github.com/tjfoc/gmsm/sm4"
 	"github.com/xtaci/qpp"
 
 	"golang.org/x/crypto/blowfish"
 	"golang.org/x/crypto/cast5"
+	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/salsa20"
 	"golang.org/x/crypto/tea"
 	"golang.org/x/crypto/twofish"
@@ -46,12 +54,18 @@ var (
 	// actually initial vector is not used in this package, we prepend a random nonce to each outgoing packets.
 	// though IV is fixed, the first 8 bytes of the encrypted data is always random.
 	initialVector = []byte{157, 163, 65, 176, 44, 219, 57, 121, 143, 80, 0, 239, 152, 228, 240, 254}
+
+	// errKeySize is returned by the builtin block ciphers for keys of unsupported length
+	errKeySize = errors.New("invalid key size")
 )
 
 // BlockCrypt defines encryption/decryption methods for a given byte slice.
 // Notes on implementing: the data to be encrypted contains a builtin
-// nonce at the first 16 bytes
+// nonce at the first 16 bytes, and the methods may be called by several
+// goroutines at once.
 type BlockCrypt interface {
+	Crypter
+
 	// Encrypt encrypts the whole block in src into dst.
 	// Dst and src may point at the same memory.
 	Encrypt(dst, src []byte)
@@ -61,30 +75,198 @@ type BlockCrypt interface {
 	Decrypt(dst, src []byte)
 }
 
+// PacketCrypt defines a crypter framing whole packets by itself, like the AEADs, and the
+// crypters adding MACs, wire versions, key IDs, header protection or padding to another
+// crypter. The methods may be called by several goroutines at once.
+type PacketCrypt interface {
+	Crypter
+
+	// SealPacket encrypts data into a new packet.
+	SealPacket(data []byte) (packet []byte)
+
+	// OpenPacket decrypts the packet in place, and returns the data in it.
+	OpenPacket(packet []byte) (data []byte, err error)
+}
+
+// Crypter is the crypter of packets, either a BlockCrypt, whose packets are framed as
+// | nonce | checksum | data |, or a PacketCrypt. A nil Crypter leaves the packets
+// unencrypted. Crypter is sealed, the crypters are the ones of this package, the types
+// embedding them, and the ciphers adapted by CustomBlockCrypt and CustomPacketCrypt.
+type Crypter interface {
+	isCrypter()
+}
+
+// blockCipher and packetCipher are the methods of BlockCrypt and PacketCrypt, implemented
+// by the ciphers outside this package.
+type (
+	blockCipher interface {
+		Encrypt(dst, src []byte)
+		Decrypt(dst, src []byte)
+	}
+	packetCipher interface {
+		SealPacket(data []byte) (packet []byte)
+		OpenPacket(packet []byte) (data []byte, err error)
+	}
+)
+
+type customBlockCrypt struct{ blockCipher }
+
+// CustomBlockCrypt adapts a cipher implemented outside this package, with the methods of
+// BlockCrypt, to a BlockCrypt, e.g. for RegisterCipher. Destroy reaches the cipher if it's
+// a Destroyer.
+func CustomBlockCrypt(block interface {
+	Encrypt(dst, src []byte)
+	Decrypt(dst, src []byte)
+}) BlockCrypt {
+	return &customBlockCrypt{block}
+}
+
+func (c *customBlockCrypt) isCrypter() {}
+
+// Destroy zeroes the keys of the cipher if it's a Destroyer.
+func (c *customBlockCrypt) Destroy() {
+	if d, ok := c.blockCipher.(Destroyer); ok {
+		d.Destroy()
+	}
+}
+
+type customPacketCrypt struct{ packetCipher }
+
+// CustomPacketCrypt adapts a cipher implemented outside this package, with the methods of
+// PacketCrypt, to a PacketCrypt, e.g. for RegisterCipher. Destroy reaches the cipher if it's
+// a Destroyer.
+func CustomPacketCrypt(packet interface {
+	SealPacket(data []byte) (packet []byte)
+	OpenPacket(packet []byte) (data []byte, err error)
+}) PacketCrypt {
+	return &customPacketCrypt{packet}
+}
+
+func (c *customPacketCrypt) isCrypter() {}
+
+// Destroy zeroes the keys of the cipher if it's a Destroyer.
+func (c *customPacketCrypt) Destroy() {
+	if d, ok := c.packetCipher.(Destroyer); ok {
+		d.Destroy()
+	}
+}
+
+// AEADCrypt defines an authenticated cipher, packets of an AEADCrypt are framed
+// as | nonce | ciphertext | tag | instead of the nonce+checksum header, the tag
+// is keyed so that tampered packets can not be forged.
+type AEADCrypt interface {
+	PacketCrypt
+	cipher.AEAD
+
+	// FillNonce fills nonce with a fresh nonce of NonceSize() bytes.
+	FillNonce(nonce []byte)
+}
+
+type aeadCrypt struct {
+	cipher.AEAD
+	prefix  []byte        // random nonce prefix of this crypter
+	counter atomic.Uint64 // nonce counter following the prefix
+}
+
+// newAEADCrypt wraps an AEAD with nonces of | random prefix | counter |, the counter
+// never repeats in the lifetime of a crypter, and the random prefix along with a
+// random initial counter keeps crypters sharing a key apart.
+func newAEADCrypt(aead cipher.AEAD) *aeadCrypt {
+	c := new(aeadCrypt)
+	c.AEAD = aead
+	c.prefix = make([]byte, aead.NonceSize()-8)
+	_, _ = io.ReadFull(rand.Reader, c.prefix)
+
+	var counter [8]byte
+	_, _ = io.ReadFull(rand.Reader, counter[:])
+	c.counter.Store(binary.LittleEndian.Uint64(counter[:]))
+	return c
+}
+
+func (c *aeadCrypt) FillNonce(nonce []byte) {
+	n := copy(nonce, c.prefix)
+	binary.BigEndian.PutUint64(nonce[n:], c.counter.Add(1))
+}
+
+func (c *aeadCrypt) isCrypter()                    {}
+func (c *aeadCrypt) SealPacket(data []byte) []byte { return sealPacket(c, data, nil) }
+
+func (c *aeadCrypt) OpenPacket(packet []byte) ([]byte, error) { return openPacket(c, packet, nil) }
+
+// Destroy zeroes the key of the AEAD if it's a Destroyer.
+func (c *aeadCrypt) Destroy() {
+	if d, ok := c.AEAD.(Destroyer); ok {
+		d.Destroy()
+	}
+}
+
+// NewAESGCMCrypt https://en.wikipedia.org/wiki/Galois/Counter_Mode
+func NewAESGCMCrypt(key []byte) (AEADCrypt, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return newAEADCrypt(aead), nil
+}
+
 type salsa20BlockCrypt struct {
-	key [32]byte
+	key     *[32]byte // allocated by NewSecret
+	destroy sync.Once
 }
 
 // NewSalsa20BlockCrypt https://en.wikipedia.org/wiki/Salsa20
 func NewSalsa20BlockCrypt(key []byte) (BlockCrypt, error) {
 	c := new(salsa20BlockCrypt)
+	c.key = (*[32]byte)(NewSecret(32))
 	copy(c.key[:], key)
 	return c, nil
 }
 
+func (c *salsa20BlockCrypt) isCrypter() {}
+
 func (c *salsa20BlockCrypt) Encrypt(dst, src []byte) {
-	salsa20.XORKeyStream(dst[8:], src[8:], src[:8], &c.key)
+	salsa20.XORKeyStream(dst[8:], src[8:], src[:8], c.key)
 	copy(dst[:8], src[:8])
 }
 func (c *salsa20BlockCrypt) Decrypt(dst, src []byte) {
-	salsa20.XORKeyStream(dst[8:], src[8:], src[:8], &c.key)
+	salsa20.XORKeyStream(dst[8:], src[8:], src[:8], c.key)
 	copy(dst[:8], src[:8])
 }
+func (c *salsa20BlockCrypt) Destroy() { c.destroy.Do(func() { WipeSecret(c.key[:]) }) }
+
+// NewChaCha20Poly1305Crypt https://datatracker.ietf.org/doc/html/rfc8439
+func NewChaCha20Poly1305Crypt(key []byte) (AEADCrypt, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return newAEADCrypt(aead), nil
+}
+
+// NewXChaCha20Poly1305Crypt https://datatracker.ietf.org/doc/html/draft-irtf-cfrg-xchacha
+func NewXChaCha20Poly1305Crypt(key []byte) (AEADCrypt, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	return newAEADCrypt(aead), nil
+}
+
+// NewAscon128Crypt https://ascon.iaik.tugraz.at
+func NewAscon128Crypt(key []byte) (AEADCrypt, error) {
+	aead, err := newAscon128(key)
+	if err != nil {
+		return nil, err
+	}
+	return newAEADCrypt(aead), nil
+}
 
 type sm4BlockCrypt struct {
-	encbuf [sm4.BlockSize]byte // 64bit alignment enc/dec buffer
-	decbuf [2 * sm4.BlockSize]byte
-	block  cipher.Block
+	block cipher.Block
 }
 
 // NewSM4BlockCrypt https://github.com/tjfoc/gmsm/tree/master/sm4
@@ -98,13 +280,12 @@ func NewSM4BlockCrypt(key []byte) (BlockCrypt, error) {
 	return c, nil
 }
 
-func (c *sm4BlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src, c.encbuf[:]) }
-func (c *sm4BlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src, c.decbuf[:]) }
+func (c *sm4BlockCrypt) isCrypter()              {}
+func (c *sm4BlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src) }
+func (c *sm4BlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src) }
 
 type twofishBlockCrypt struct {
-	encbuf [twofish.BlockSize]byte
-	decbuf [2 * twofish.BlockSize]byte
-	block  cipher.Block
+	block cipher.Block
 }
 
 // NewTwofishBlockCrypt https://en.wikipedia.org/wiki/Twofish
@@ -118,13 +299,12 @@ func NewTwofishBlockCrypt(key []byte) (BlockCrypt, error) {
 	return c, nil
 }
 
-func (c *twofishBlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src, c.encbuf[:]) }
-func (c *twofishBlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src, c.decbuf[:]) }
+func (c *twofishBlockCrypt) isCrypter()              {}
+func (c *twofishBlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src) }
+func (c *twofishBlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src) }
 
 type tripleDESBlockCrypt struct {
-	encbuf [des.BlockSize]byte
-	decbuf [2 * des.BlockSize]byte
-	block  cipher.Block
+	block cipher.Block
 }
 
 // NewTripleDESBlockCrypt https://en.wikipedia.org/wiki/Triple_DES
@@ -138,13 +318,12 @@ func NewTripleDESBlockCrypt(key []byte) (BlockCrypt, error) {
 	return c, nil
 }
 
-func (c *tripleDESBlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src, c.encbuf[:]) }
-func (c *tripleDESBlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src, c.decbuf[:]) }
+func (c *tripleDESBlockCrypt) isCrypter()              {}
+func (c *tripleDESBlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src) }
+func (c *tripleDESBlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src) }
 
 type cast5BlockCrypt struct {
-	encbuf [cast5.BlockSize]byte
-	decbuf [2 * cast5.BlockSize]byte
-	block  cipher.Block
+	block cipher.Block
 }
 
 // NewCast5BlockCrypt https://en.wikipedia.org/wiki/CAST-128
@@ -158,13 +337,12 @@ func NewCast5BlockCrypt(key []byte) (BlockCrypt, error) {
 	return c, nil
 }
 
-func (c *cast5BlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src, c.encbuf[:]) }
-func (c *cast5BlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src, c.decbuf[:]) }
+func (c *cast5BlockCrypt) isCrypter()              {}
+func (c *cast5BlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src) }
+func (c *cast5BlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src) }
 
 type blowfishBlockCrypt struct {
-	encbuf [blowfish.BlockSize]byte
-	decbuf [2 * blowfish.BlockSize]byte
-	block  cipher.Block
+	block cipher.Block
 }
 
 // NewBlowfishBlockCrypt https://en.wikipedia.org/wiki/Blowfish_(cipher)
@@ -178,13 +356,12 @@ func NewBlowfishBlockCrypt(key []byte) (BlockCrypt, error) {
 	return c, nil
 }
 
-func (c *blowfishBlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src, c.encbuf[:]) }
-func (c *blowfishBlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src, c.decbuf[:]) }
+func (c *blowfishBlockCrypt) isCrypter()              {}
+func (c *blowfishBlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src) }
+func (c *blowfishBlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src) }
 
 type aesBlockCrypt struct {
-	encbuf [aes.BlockSize]byte
-	decbuf [2 * aes.BlockSize]byte
-	block  cipher.Block
+	block cipher.Block
 }
 
 // NewAESBlockCrypt https://en.wikipedia.org/wiki/Advanced_Encryption_Standard
@@ -198,13 +375,12 @@ func NewAESBlockCrypt(key []byte) (BlockCrypt, error) {
 	return c, nil
 }
 
-func (c *aesBlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src, c.encbuf[:]) }
-func (c *aesBlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src, c.decbuf[:]) }
+func (c *aesBlockCrypt) isCrypter()              {}
+func (c *aesBlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src) }
+func (c *aesBlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src) }
 
 type teaBlockCrypt struct {
-	encbuf [tea.BlockSize]byte
-	decbuf [2 * tea.BlockSize]byte
-	block  cipher.Block
+	block cipher.Block
 }
 
 // NewTEABlockCrypt https://en.wikipedia.org/wiki/Tiny_Encryption_Algorithm
@@ -218,13 +394,12 @@ func NewTEABlockCrypt(key []byte) (BlockCrypt, error) {
 	return c, nil
 }
 
-func (c *teaBlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src, c.encbuf[:]) }
-func (c *teaBlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src, c.decbuf[:]) }
+func (c *teaBlockCrypt) isCrypter()              {}
+func (c *teaBlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src) }
+func (c *teaBlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src) }
 
 type xteaBlockCrypt struct {
-	encbuf [xtea.BlockSize]byte
-	decbuf [2 * xtea.BlockSize]byte
-	block  cipher.Block
+	block cipher.Block
 }
 
 // NewXTEABlockCrypt https://en.wikipedia.org/wiki/XTEA
@@ -238,49 +413,125 @@ func NewXTEABlockCrypt(key []byte) (BlockCrypt, error) {
 	return c, nil
 }
 
-func (c *xteaBlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src, c.encbuf[:]) }
-func (c *xteaBlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src, c.decbuf[:]) }
+func (c *xteaBlockCrypt) isCrypter()              {}
+func (c *xteaBlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src) }
+func (c *xteaBlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src) }
+
+type camelliaBlockCrypt struct {
+	block cipher.Block
+}
+
+// NewCamelliaBlockCrypt https://en.wikipedia.org/wiki/Camellia_(cipher)
+func NewCamelliaBlockCrypt(key []byte) (BlockCrypt, error) {
+	c := new(camelliaBlockCrypt)
+	block, err := newCamelliaCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	c.block = block
+	return c, nil
+}
+
+func (c *camelliaBlockCrypt) isCrypter()              {}
+func (c *camelliaBlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src) }
+func (c *camelliaBlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src) }
+func (c *camelliaBlockCrypt) Destroy()                { c.block.(Destroyer).Destroy() }
+
+type ariaBlockCrypt struct {
+	block cipher.Block
+}
+
+// NewARIABlockCrypt https://en.wikipedia.org/wiki/ARIA_(cipher)
+func NewARIABlockCrypt(key []byte) (BlockCrypt, error) {
+	c := new(ariaBlockCrypt)
+	block, err := newARIACipher(key)
+	if err != nil {
+		return nil, err
+	}
+	c.block = block
+	return c, nil
+}
+
+func (c *ariaBlockCrypt) isCrypter()              {}
+func (c *ariaBlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src) }
+func (c *ariaBlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src) }
+func (c *ariaBlockCrypt) Destroy()                { c.block.(Destroyer).Destroy() }
+
+// DefaultQPPPads is the default number of permutation pads of QPP.
+const DefaultQPPPads = 251
+
+var errQPPPads = errors.New("invalid number of qpp pads")
 
 type qppCrypt struct {
-	key     []byte
+	key     []byte // allocated by NewSecret
 	quantum *qpp.QuantumPermutationPad
+	seeds   sync.Pool // *[]byte, the seed buffer | nonce(8) | key | of each goroutine
+	destroy sync.Once
 }
 
 // NewQPPCrypt https://link.springer.com/content/pdf/10.1140/epjqt/s40507-023-00164-3.pdf
 func NewQPPCrypt(key []byte) (BlockCrypt, error) {
-	const numPad = 251
+	return NewQPPCryptWithPads(key, DefaultQPPPads)
+}
+
+// NewQPPCryptWithPads creates a QPP crypter with the number of permutation pads, more pads
+// take more memory and setup time for a larger key space, both ends must use the same number.
+func NewQPPCryptWithPads(key []byte, pads int) (BlockCrypt, error) {
+	if pads < qpp.QPPMinimumPads(qpp.QUBITS) || pads > math.MaxUint16 {
+		return nil, errors.Wrapf(errQPPPads, "%d pads", pads)
+	}
+
 	c := new(qppCrypt)
-	c.key = make([]byte, len(key))
-	copy(c.key, key)
-	c.quantum = qpp.NewQPP(key, numPad)
+	c.key = cloneSecret(key)
+	c.quantum = qpp.NewQPP(key, uint16(pads))
+	c.seeds.New = func() any {
+		seed := make([]byte, 8+len(c.key))
+		return &seed
+	}
 	return c, nil
 }
 
+// prng creates the PRNG of a packet seeded with | nonce | key |, reusing the seed buffer,
+// the key is copied into the seed only while seeding, so the pooled buffers hold no key.
+func (c *qppCrypt) prng(nonce []byte) *qpp.Rand {
+	seed := c.seeds.Get().(*[]byte)
+	copy(*seed, nonce[:8])
+	copy((*seed)[8:], c.key)
+	prng := qpp.FastPRNG(*seed)
+	clear((*seed)[8:])
+	c.seeds.Put(seed)
+	return prng
+}
+
+func (c *qppCrypt) isCrypter() {}
+
 func (c *qppCrypt) Encrypt(dst, src []byte) {
 	copy(dst, src)
-	seed := make([]byte, 8+len(c.key))
-	copy(seed, dst[:8])
-	copy(seed[8:], c.key)
-	prng := qpp.FastPRNG(seed)
-	c.quantum.EncryptWithPRNG(dst[8:], prng)
+	c.quantum.EncryptWithPRNG(dst[8:], c.prng(dst))
 }
 
 func (c *qppCrypt) Decrypt(dst, src []byte) {
 	copy(dst, src)
-	seed := make([]byte, 8+len(c.key))
-	copy(seed, dst[:8])
-	copy(seed[8:], c.key)
-	prng := qpp.FastPRNG(seed)
-	c.quantum.DecryptWithPRNG(dst[8:], prng)
+	c.quantum.DecryptWithPRNG(dst[8:], c.prng(dst))
 }
 
+// Destroy zeroes the key, the permutation pads are opaque in qpp, so they are left to
+// the garbage collector.
+func (c *qppCrypt) Destroy() { c.destroy.Do(func() { WipeSecret(c.key) }) }
+
+// cfbBuffers holds the enc/dec buffers of the CFB mode, so that a crypter can be
+// used by several goroutines at once.
+var cfbBuffers = sync.Pool{New: func() any { return new([2 * 16]byte) }}
+
 // packet encryption with local CFB mode
-func encrypt(block cipher.Block, dst, src, buf []byte) {
+func encrypt(block cipher.Block, dst, src []byte) {
+	buf := cfbBuffers.Get().(*[2 * 16]byte)
+	defer cfbBuffers.Put(buf)
 	switch block.BlockSize() {
 	case 8:
-		encrypt8(block, dst, src, buf)
+		encrypt8(block, dst, src, buf[:])
 	case 16:
-		encrypt16(block, dst, src, buf)
+		encrypt16(block, dst, src, buf[:])
 	default:
 		panic("unsupported cipher block size")
 	}
@@ -446,12 +697,14 @@ func encrypt16(block cipher.Block, dst, src, buf []byte) {
 }
 
 // decryption
-func decrypt(block cipher.Block, dst, src, buf []byte) {
+func decrypt(block cipher.Block, dst, src []byte) {
+	buf := cfbBuffers.Get().(*[2 * 16]byte)
+	defer cfbBuffers.Put(buf)
 	switch block.BlockSize() {
 	case 8:
-		decrypt8(block, dst, src, buf)
+		decrypt8(block, dst, src, buf[:])
 	case 16:
-		decrypt16(block, dst, src, buf)
+		decrypt16(block, dst, src, buf[:])
 	default:
 		panic("unsupported cipher block size")
 	}
@@ -27,12 +27,15 @@ import (
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/sha1"
+	"encoding/hex"
 	"hash/crc32"
 	"io"
 	mrand "math/rand"
+	"strconv"
 	"testing"
 	"time"
 
+	"github.com/xtaci/qpp"
 	"golang.org/x/crypto/pbkdf2"
 )
 
@@ -107,6 +110,26 @@ func TestXTEA(t *testing.T) {
 	cryptTest(t, bc)
 }
 
+func TestCamellia(t *testing.T) {
+	for _, size := range []int{16, 24, 32} {
+		bc, err := NewCamelliaBlockCrypt(pass[:size])
+		if err != nil {
+			t.Fatal(err)
+		}
+		cryptTest(t, bc)
+	}
+}
+
+func TestARIA(t *testing.T) {
+	for _, size := range []int{16, 24, 32} {
+		bc, err := NewARIABlockCrypt(pass[:size])
+		if err != nil {
+			t.Fatal(err)
+		}
+		cryptTest(t, bc)
+	}
+}
+
 func TestSalsa20(t *testing.T) {
 	bc, err := NewSalsa20BlockCrypt(pass[:32])
 	if err != nil {
@@ -115,6 +138,81 @@ func TestSalsa20(t *testing.T) {
 	cryptTest(t, bc)
 }
 
+func TestChaCha20Poly1305(t *testing.T) {
+	bc, err := NewChaCha20Poly1305Crypt(pass[:32])
+	if err != nil {
+		t.Fatal(err)
+	}
+	aeadTest(t, bc)
+}
+
+func TestXChaCha20Poly1305(t *testing.T) {
+	bc, err := NewXChaCha20Poly1305Crypt(pass[:32])
+	if err != nil {
+		t.Fatal(err)
+	}
+	aeadTest(t, bc)
+}
+
+func TestAscon128(t *testing.T) {
+	bc, err := NewAscon128Crypt(pass[:16])
+	if err != nil {
+		t.Fatal(err)
+	}
+	aeadTest(t, bc)
+}
+
+const sunscreen = "Ladies and Gentlemen of the class of '99: If I could offer you only one tip for the future, sunscreen would be it."
+
+func TestChaCha20Poly1305Vector(t *testing.T) {
+	// https://datatracker.ietf.org/doc/html/rfc8439#section-2.8.2
+	aeadVectorTest(t, NewChaCha20Poly1305Crypt,
+		"808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f",
+		"070000004041424344454647",
+		"50515253c0c1c2c3c4c5c6c7",
+		"d31a8d34648e60db7b86afbc53ef7ec2a4aded51296e08fea9e2b5a736ee62d63dbea45e8ca9671282fafb69da92728b"+
+			"1a71de0a9e060b2905d6a5b67ecd3b3692ddbd7f2d778b8c9803aee328091b58fab324e4fad675945585808b4831d7bc"+
+			"3ff4def08e4b7a9de576d26586cec64b6116"+
+			"1ae10b594f09e26a7e902ecbd0600691")
+}
+
+func TestXChaCha20Poly1305Vector(t *testing.T) {
+	// https://datatracker.ietf.org/doc/html/draft-irtf-cfrg-xchacha-03#appendix-A.3.1
+	aeadVectorTest(t, NewXChaCha20Poly1305Crypt,
+		"808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f",
+		"404142434445464748494a4b4c4d4e4f5051525354555657",
+		"50515253c0c1c2c3c4c5c6c7",
+		"bd6d179d3e83d43b9576579493c0e939572a1700252bfaccbed2902c21396cbb731c7f1b0b4aa6440bf3a82f4eda7e39"+
+			"ae64c6708c54c216cb96b72e1213b4522f8c9ba40db5d945b11b69b982c1bb9e3f3fac2bc369488f76b2383565d3fff9"+
+			"21f9664c97637da9768812f615c68b13b52ec0875924c1c7987947deafd8780acf49")
+}
+
+func aeadVectorTest(t *testing.T, newCrypt func([]byte) (AEADCrypt, error), key, nonce, aad, out string) {
+	k, _ := hex.DecodeString(key)
+	n, _ := hex.DecodeString(nonce)
+	ad, _ := hex.DecodeString(aad)
+	expected, _ := hex.DecodeString(out)
+
+	bc, err := newCrypt(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead := bc.(AEADCrypt)
+
+	sealed := aead.Seal(nil, n, []byte(sunscreen), ad)
+	if !bytes.Equal(sealed, expected) {
+		t.Fatalf("seal: got %x, want %x", sealed, expected)
+	}
+
+	opened, err := aead.Open(nil, n, expected, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(opened) != sunscreen {
+		t.Fatalf("open: got %q", opened)
+	}
+}
+
 func TestQPP(t *testing.T) {
 	bc, err := NewQPPCrypt(pass[:32])
 	if err != nil {
@@ -123,6 +221,133 @@ func TestQPP(t *testing.T) {
 	cryptTest(t, bc)
 }
 
+func TestQPPCompatible(t *testing.T) {
+	for _, pads := range []int{7, DefaultQPPPads, 1024} {
+		bc, err := NewQPPCryptWithPads(pass[:32], pads)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cryptTest(t, bc)
+
+		// the PRNG must match qpp.FastPRNG of | nonce | key |
+		quantum := qpp.NewQPP(pass[:32], uint16(pads))
+		for range 10 {
+			data := make([]byte, mtuLimit)
+			io.ReadFull(rand.Reader, data)
+			enc := make([]byte, mtuLimit)
+			bc.Encrypt(enc, data)
+
+			expected := bytes.Clone(data)
+			quantum.EncryptWithPRNG(expected[8:], qpp.FastPRNG(append(bytes.Clone(data[:8]), pass[:32]...)))
+			if !bytes.Equal(enc, expected) {
+				t.Fatal("incompatible with qpp.FastPRNG", pads)
+			}
+		}
+	}
+
+	for _, pads := range []int{0, 6, 65536} {
+		if _, err := NewQPPCryptWithPads(pass[:32], pads); err == nil {
+			t.Fatal("invalid pads accepted", pads)
+		}
+	}
+}
+
+func TestQPPAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector drops the pooled seeds")
+	}
+	bc, _ := NewQPPCrypt(pass[:32])
+	data := make([]byte, mtuLimit)
+	allocs := testing.AllocsPerRun(100, func() {
+		bc.Encrypt(data, data)
+		bc.Decrypt(data, data)
+	})
+	// the seed buffers are reused, only the PRNG of each packet is allocated by qpp.FastPRNG
+	if allocs > 2 {
+		t.Fatal("qpp allocates per packet:", allocs)
+	}
+}
+
+func TestAESGCM(t *testing.T) {
+	bc, err := NewAESGCMCrypt(pass[:32])
+	if err != nil {
+		t.Fatal(err)
+	}
+	aeadTest(t, bc)
+}
+
+func TestAESGCM128(t *testing.T) {
+	bc, err := NewAESGCMCrypt(pass[:16])
+	if err != nil {
+		t.Fatal(err)
+	}
+	aeadTest(t, bc)
+}
+
+func TestMACHMACSHA256(t *testing.T) {
+	macTest(t, MACHMACSHA256, 16)
+}
+
+func TestMACBLAKE2b(t *testing.T) {
+	macTest(t, MACBLAKE2b, 32)
+}
+
+func TestCustomCrypt(t *testing.T) {
+	salsa20, _ := NewSalsa20BlockCrypt(pass[:32])
+	gcm, _ := NewAESGCMCrypt(pass[:32])
+	data := []byte("hello")
+	for _, crypter := range []Crypter{CustomBlockCrypt(rot13Crypt{}), CustomBlockCrypt(salsa20), CustomPacketCrypt(gcm)} {
+		if out, err := decryptPacket(crypter, encryptPacket(crypter, data)); err != nil || !bytes.Equal(out, data) {
+			t.Fatalf("%T round trip failed: %v", crypter, err)
+		}
+	}
+
+	// the cipher is destroyed along with its adapter
+	Destroy(CustomBlockCrypt(salsa20))
+	if *salsa20.(*salsa20BlockCrypt).key != [32]byte{} {
+		t.Fatal("key of the adapted cipher not zeroed")
+	}
+}
+
+// blockPacketCrypt is both a BlockCrypt and a PacketCrypt.
+type blockPacketCrypt struct {
+	BlockCrypt
+	PacketCrypt
+}
+
+func (blockPacketCrypt) isCrypter() {}
+
+func TestMACTagSize(t *testing.T) {
+	bc, _ := NewAESBlockCrypt(pass[:32])
+	for _, size := range []int{0, minTagSize - 1, 33} {
+		if _, err := NewMACCrypt(bc, MACHMACSHA256, key, size); err == nil {
+			t.Fatal("invalid tag size accepted:", size)
+		}
+	}
+
+	aead, _ := NewAESGCMCrypt(pass[:32])
+	both := blockPacketCrypt{bc, aead}
+	if _, err := NewMACCrypt(both, MACHMACSHA256, key, 16); err == nil {
+		t.Fatal("mac on packet crypter accepted")
+	}
+}
+
+func macTest(t *testing.T, mac string, tagSize int) {
+	macKey := pbkdf2.Key(key, []byte("testmac"), 4096, 32, sha1.New)
+	aesBlock, _ := NewAESBlockCrypt(pass[:32])
+	teaBlock, _ := NewTEABlockCrypt(pass[:16])
+	salsa20Block, _ := NewSalsa20BlockCrypt(pass[:32])
+	qppBlock, _ := NewQPPCrypt(pass[:32])
+
+	for _, block := range []BlockCrypt{aesBlock, teaBlock, salsa20Block, qppBlock} {
+		bc, err := NewMACCrypt(block, mac, macKey, tagSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aeadTest(t, bc)
+	}
+}
+
 func cryptTest(t *testing.T, bc BlockCrypt) {
 	for range 128 {
 		// get a random number between 16 and mtuLimit
@@ -141,6 +366,30 @@ func cryptTest(t *testing.T, bc BlockCrypt) {
 	}
 }
 
+func aeadTest(t *testing.T, bc Crypter) {
+	for range 128 {
+		size := mrand.Intn(mtuLimit-16) + 16
+
+		data := make([]byte, size)
+		io.ReadFull(rand.Reader, data)
+
+		packet := encryptPacket(bc, data)
+		dec, err := decryptPacket(bc, bytes.Clone(packet))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, dec) {
+			t.Fail()
+		}
+
+		// flipping any bit of the packet must be detected
+		packet[mrand.Intn(len(packet))] ^= 1 << mrand.Intn(8)
+		if _, err := decryptPacket(bc, packet); err != errAuthFailed {
+			t.Fatal("tampered packet accepted")
+		}
+	}
+}
+
 func BenchmarkSM4(b *testing.B) {
 	bc, err := NewSM4BlockCrypt(pass[:16])
 	if err != nil {
@@ -224,6 +473,54 @@ func BenchmarkXTEA(b *testing.B) {
 	benchCrypt(b, bc)
 }
 
+func BenchmarkCamellia128(b *testing.B) {
+	bc, err := NewCamelliaBlockCrypt(pass[:16])
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchCrypt(b, bc)
+}
+
+func BenchmarkCamellia192(b *testing.B) {
+	bc, err := NewCamelliaBlockCrypt(pass[:24])
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchCrypt(b, bc)
+}
+
+func BenchmarkCamellia256(b *testing.B) {
+	bc, err := NewCamelliaBlockCrypt(pass[:32])
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchCrypt(b, bc)
+}
+
+func BenchmarkARIA128(b *testing.B) {
+	bc, err := NewARIABlockCrypt(pass[:16])
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchCrypt(b, bc)
+}
+
+func BenchmarkARIA192(b *testing.B) {
+	bc, err := NewARIABlockCrypt(pass[:24])
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchCrypt(b, bc)
+}
+
+func BenchmarkARIA256(b *testing.B) {
+	bc, err := NewARIABlockCrypt(pass[:32])
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchCrypt(b, bc)
+}
+
 func BenchmarkSalsa20(b *testing.B) {
 	bc, err := NewSalsa20BlockCrypt(pass[:32])
 	if err != nil {
@@ -232,6 +529,30 @@ func BenchmarkSalsa20(b *testing.B) {
 	benchCrypt(b, bc)
 }
 
+func BenchmarkChaCha20Poly1305(b *testing.B) {
+	bc, err := NewChaCha20Poly1305Crypt(pass[:32])
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchAEAD(b, bc)
+}
+
+func BenchmarkXChaCha20Poly1305(b *testing.B) {
+	bc, err := NewXChaCha20Poly1305Crypt(pass[:32])
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchAEAD(b, bc)
+}
+
+func BenchmarkAscon128(b *testing.B) {
+	bc, err := NewAscon128Crypt(pass[:16])
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchAEAD(b, bc)
+}
+
 func BenchmarkQPP(b *testing.B) {
 	bc, err := NewQPPCrypt(pass[:32])
 	if err != nil {
@@ -240,6 +561,71 @@ func BenchmarkQPP(b *testing.B) {
 	benchCrypt(b, bc)
 }
 
+func BenchmarkQPPPads(b *testing.B) {
+	for _, pads := range []int{7, 61, DefaultQPPPads, 1021} {
+		b.Run(strconv.Itoa(pads), func(b *testing.B) {
+			bc, err := NewQPPCryptWithPads(pass[:32], pads)
+			if err != nil {
+				b.Fatal(err)
+			}
+			benchCrypt(b, bc)
+		})
+	}
+}
+
+func BenchmarkQPPParallel(b *testing.B) {
+	bc, err := NewQPPCrypt(pass[:32])
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(mtuLimit * 2)
+	b.RunParallel(func(pb *testing.PB) {
+		data := make([]byte, mtuLimit)
+		io.ReadFull(rand.Reader, data)
+		enc := make([]byte, mtuLimit)
+		dec := make([]byte, mtuLimit)
+		for pb.Next() {
+			bc.Encrypt(enc, data)
+			bc.Decrypt(dec, enc)
+		}
+	})
+}
+
+func BenchmarkAESGCM128(b *testing.B) {
+	bc, err := NewAESGCMCrypt(pass[:16])
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchAEAD(b, bc)
+}
+
+func BenchmarkAESGCM256(b *testing.B) {
+	bc, err := NewAESGCMCrypt(pass[:32])
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchAEAD(b, bc)
+}
+
+func BenchmarkAESHMACSHA256(b *testing.B) {
+	block, _ := NewAESBlockCrypt(pass[:32])
+	bc, err := NewMACCrypt(block, MACHMACSHA256, key, 16)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchAEAD(b, bc)
+}
+
+func BenchmarkAESBLAKE2b(b *testing.B) {
+	block, _ := NewAESBlockCrypt(pass[:32])
+	bc, err := NewMACCrypt(block, MACBLAKE2b, key, 16)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchAEAD(b, bc)
+}
+
 func benchCrypt(b *testing.B, bc BlockCrypt) {
 	data := make([]byte, mtuLimit)
 	io.ReadFull(rand.Reader, data)
@@ -255,6 +641,20 @@ func benchCrypt(b *testing.B, bc BlockCrypt) {
 	}
 }
 
+func benchAEAD(b *testing.B, bc Crypter) {
+	aead := bc.(AEADCrypt)
+	data := make([]byte, mtuLimit-aead.NonceSize()-aead.Overhead())
+	io.ReadFull(rand.Reader, data)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data) * 2))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		packet := sealPacket(aead, data, nil)
+		openPacket(aead, packet, nil)
+	}
+}
+
 func BenchmarkCRC32(b *testing.B) {
 	content := make([]byte, 1024)
 	b.SetBytes(int64(len(content)))
@@ -0,0 +1,88 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+
+	"github.com/pkg/errors"
+)
+
+// The directions of a link between two hops, naming the subkeys of the link key.
+const (
+	// Upstream is the direction from the clients towards the next hops.
+	Upstream = "upstream"
+
+	// Downstream is the direction from the next hops back to the clients.
+	Downstream = "downstream"
+)
+
+var errDirection = errors.New("invalid direction")
+
+// DeriveDirectionKey derives the subkey of the direction(Upstream or Downstream) from the
+// key of a link by HKDF-SHA256, the subkey has the same length as the key.
+func DeriveDirectionKey(key []byte, direction string) ([]byte, error) {
+	if direction != Upstream && direction != Downstream {
+		return nil, errors.Wrap(errDirection, direction)
+	}
+	subkey, err := hkdf.Key(sha256.New, key, nil, "grasshopper "+direction, len(key))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return subkey, nil
+}
+
+// directionalCrypt seals and opens the packets of a link with the crypters of
+// separate directions, so a packet reflected to its sender fails authentication.
+type directionalCrypt struct {
+	send Crypter
+	recv Crypter
+}
+
+// NewDirectionalCrypt combines the crypters of the two directions of a link, packets are
+// sealed by send and opened by recv. The crypters must use different keys, e.g. derived
+// by DeriveDirectionKey, and the peer swaps them: the side of the next hops sends Upstream
+// and receives Downstream, the side of the clients on the next hop does the opposite.
+func NewDirectionalCrypt(send, recv Crypter) (PacketCrypt, error) {
+	if send == nil || recv == nil {
+		return nil, errors.Wrap(errDirection, "directional crypters can't be nil")
+	}
+	return &directionalCrypt{send: send, recv: recv}, nil
+}
+
+// Destroy zeroes the keys of both directions.
+func (c *directionalCrypt) Destroy() {
+	Destroy(c.send)
+	Destroy(c.recv)
+}
+
+func (c *directionalCrypt) isCrypter() {}
+
+func (c *directionalCrypt) SealPacket(data []byte) []byte {
+	return encryptPacket(c.send, data)
+}
+
+func (c *directionalCrypt) OpenPacket(packet []byte) ([]byte, error) {
+	return decryptPacket(c.recv, packet)
+}
@@ -0,0 +1,97 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"bytes"
+	"testing"
+)
+
+// newLink creates the crypters of the side of next hops(out) and the side of clients on
+// the next hop(in), sharing the key of the link with direction-separated subkeys.
+func newLink(t *testing.T, method string, key []byte) (out, in Crypter) {
+	upstream, err := DeriveDirectionKey(key, Upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downstream, err := DeriveDirectionKey(key, Downstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up, err := NewCipher(method, upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	down, err := NewCipher(method, downstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out, err = NewDirectionalCrypt(up, down); err != nil {
+		t.Fatal(err)
+	}
+	if in, err = NewDirectionalCrypt(down, up); err != nil {
+		t.Fatal(err)
+	}
+	return out, in
+}
+
+func TestDirectional(t *testing.T) {
+	key := knownAnswerKey()
+	upstream, _ := DeriveDirectionKey(key, Upstream)
+	downstream, _ := DeriveDirectionKey(key, Downstream)
+	again, _ := DeriveDirectionKey(key, Upstream)
+	if len(upstream) != len(key) || bytes.Equal(upstream, downstream) || bytes.Equal(upstream, key) || !bytes.Equal(upstream, again) {
+		t.Fatal("direction subkeys not separated")
+	}
+	if _, err := DeriveDirectionKey(key, "sideways"); err == nil {
+		t.Fatal("invalid direction accepted")
+	}
+
+	for _, method := range []string{"qpp", "salsa20", "aes", "sm4", "aes-gcm", "xchacha20-poly1305", "ascon128"} {
+		keyLen, _ := CipherKeyLen(method)
+		out, in := newLink(t, method, key[:keyLen])
+		data := knownAnswerData()
+
+		// both directions
+		if got, err := decryptPacket(in, encryptPacket(out, data)); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%v: upstream round trip failed: %v", method, err)
+		}
+		if got, err := decryptPacket(out, encryptPacket(in, data)); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%v: downstream round trip failed: %v", method, err)
+		}
+
+		// reflected packets
+		if _, err := decryptPacket(out, encryptPacket(out, data)); err == nil {
+			t.Fatalf("%v: reflected upstream packet accepted", method)
+		}
+		if _, err := decryptPacket(in, encryptPacket(in, data)); err == nil {
+			t.Fatalf("%v: reflected downstream packet accepted", method)
+		}
+	}
+
+	crypter, _ := NewAESGCMCrypt(key)
+	if _, err := NewDirectionalCrypt(crypter, nil); err == nil {
+		t.Fatal("nil crypter accepted")
+	}
+}
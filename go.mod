@@ -13,6 +13,7 @@ require (
 	github.com/xtaci/gaio v1.2.34
 	github.com/xtaci/qpp v1.1.21
 	golang.org/x/crypto v0.46.0
+	golang.org/x/sys v0.40.0
 )
 
 require (
@@ -33,7 +34,6 @@ require (
 	go.uber.org/atomic v1.9.0 // indirect
 	go.uber.org/multierr v1.9.0 // indirect
 	golang.org/x/exp v0.0.0-20230905200255-921286631fa9 // indirect
-	golang.org/x/sys v0.40.0 // indirect
 	golang.org/x/text v0.32.0 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
@@ -32,6 +32,7 @@ import (
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -55,11 +56,16 @@ const (
 
 	// mtuLimit specifies the maximum transmission unit (MTU) size for a packet.
 	mtuLimit = 1500
+
+	// workerQueueSize defines the number of packets queued for each worker.
+	workerQueueSize = 1024
 )
 
 var (
-	errNoNextHop = errors.New("no next hop provided")
-	errChecksum  = errors.New("checksum mismatch")
+	errNoNextHop   = errors.New("no next hop provided")
+	errChecksum    = errors.New("checksum mismatch")
+	errAuthFailed  = errors.New("message authentication failed")
+	errShortPacket = errors.New("packet too short")
 )
 
 type (
@@ -69,17 +75,51 @@ type (
 	// OnNextHopInCallback is a callback function that processes incoming packets from the next hop.
 	OnNextHopInCallback func(hop net.Addr, client net.Addr, in []byte) (out []byte)
 
+	// incoming is a packet received by the listener, from the client `ctx` if conn is nil,
+	// or via conn from the next hop on behalf of the client otherwise.
+	incoming struct {
+		conn   net.Conn
+		ctx    net.Addr
+		packet []byte
+	}
+
 	// Listener represents a UDP server that listens for incoming connections and relays them to the next hop.
 	Listener struct {
 		startOnce  sync.Once   // Ensures the listener is started only once.
 		logger     *log.Logger // logger
-		crypterIn  BlockCrypt  // crypter for incoming packets
-		crypterOut BlockCrypt  // crypter for outgoing packets
+		crypterIn  Crypter     // crypter for incoming packets
+		crypterOut Crypter     // crypter for outgoing packets
+
+		// replay protection, nil if disabled
+		replayIn  *replayGuard // replay guard for packets with clients
+		replayOut *replayGuard // replay guard for packets with next hops
+
+		// per-client credentials on the side with clients, nil if disabled
+		credentials *Credentials
+
+		// crypto methods accepted side by side from clients, nil if disabled
+		methods *Methods
+
+		// forward secret handshakes, nil if disabled
+		handshakeIn  *handshaker // responder to the previous hops
+		handshakeOut *handshaker // initiator to the next hops
+
+		// protocol mimicry of the datagrams, nil if disabled
+		mimicryIn  *Mimicry // mimicry of the datagrams with clients
+		mimicryOut *Mimicry // mimicry of the datagrams with next hops
+
+		// header protection of the packets, nil if disabled
+		protectionIn  *HeaderProtection // header protection of the packets with clients
+		protectionOut *HeaderProtection // header protection of the packets with next hops
+
+		// crypto workers sharded by client address, nil to process packets on the reading goroutines
+		workers []chan incoming
 
 		// callbacks for bidirectional communication
 		onClientIn  OnClientInCallback  // callback on incoming packets from clients
 		onNextHopIn OnNextHopInCallback // callback on incoming packets from next hops
 
+		snmp    *Snmp         // statistics of the listener, counted in DefaultSnmp too
 		conn    *net.UDPConn  // the socket to listen on
 		timeout time.Duration // session timeout
 		sockbuf int           // socket buffer size for the `conn`
@@ -114,7 +154,7 @@ func ListenWithOptions(laddr string,
 	nexthops []string,
 	sockbuf int,
 	timeout time.Duration,
-	crypterIn BlockCrypt, crypterOut BlockCrypt,
+	crypterIn Crypter, crypterOut Crypter,
 	onClientIn OnClientInCallback,
 	onNextHopIn OnNextHopInCallback,
 	logger *log.Logger) (*Listener, error) {
@@ -149,6 +189,7 @@ func ListenWithOptions(laddr string,
 
 	l := new(Listener)
 	l.logger = logger
+	l.snmp = newSnmp()
 	l.incomingConnections = make(map[string]net.Conn)
 	l.conn = conn
 	l.nextHops = nexthops
@@ -162,31 +203,224 @@ func ListenWithOptions(laddr string,
 	return l, nil
 }
 
+// SetReplayWindow enables replay protection on packets with clients(in) and next hops(out).
+// Each packet is stamped with the random ID of the sending listener, a counter and the sending
+// time, then the receiving side tracks the last `window` counters of each sender, dropping the
+// packets seen before or sent out of the `skew` tolerance. A zero window disables the guard on
+// that side, both sides of a link must agree. The skew must be at least a second, since the
+// timestamps are in seconds. It should be called before Start.
+//
+// The stamps are only as strong as the crypters authenticating them: with an AEAD, a MAC or the
+// handshake sessions, a replay is dropped whatever its source address, while with no crypter or
+// the unkeyed checksum of the classic ciphers, the stamps may be forged. The windows live in
+// memory, so the packets sent within the skew before a restart of the receiver can be replayed
+// once after it.
+func (l *Listener) SetReplayWindow(in, out int, skew time.Duration) error {
+	if (in > 0 || out > 0) && skew < minReplaySkew {
+		return errors.Wrapf(errSkew, "skew %v, minimum %v", skew, minReplaySkew)
+	}
+
+	l.replayIn, l.replayOut = nil, nil
+	if in > 0 {
+		l.replayIn = newReplayGuard(in, skew, l.snmp)
+	}
+	if out > 0 {
+		l.replayOut = newReplayGuard(out, skew, l.snmp)
+	}
+	return nil
+}
+
+// Snmp returns a snapshot of the statistics of the listener, while DefaultSnmp adds up the
+// statistics of all the listeners in the process.
+func (l *Listener) Snmp() *Snmp {
+	return l.snmp.Copy()
+}
+
+// SetCredentials enables per-client keys on the side with clients, replacing crypterIn.
+// Each client is identified by the client ID in its packets, see NewClientCrypt, or by trial
+// decryption with the credentials in the order added. The replies are encrypted with the
+// credential of the client, and the new connections go to the next hop group of the credential.
+// It's exclusive with the handshake on the same side, and should be called before Start.
+func (l *Listener) SetCredentials(credentials *Credentials) {
+	l.credentials = credentials
+}
+
+// SetMethods accepts several crypto methods side by side on the side with clients, replacing
+// crypterIn. Each client is identified by trial decryption with the methods in the order added,
+// and the replies are encrypted with the method of the client. It's exclusive with the credentials
+// and the handshake on the same side, and should be called before Start. Close destroys the
+// crypters of the methods instead of crypterIn, add crypterIn as a method to keep accepting it.
+func (l *Listener) SetMethods(methods *Methods) {
+	l.methods = methods
+}
+
+// SetHandshake enables the forward secret handshake on the side with clients(in) and the side
+// with next hops(out), a nil config disables it on that side. The listener responds to handshakes
+// from the previous hop, and initiates handshakes with next hops, then traffic is encrypted by
+// session crypters created from the negotiated keys, while crypterIn and crypterOut only encrypt
+// the handshake messages. With static identities, the listener accepts traffic only from the
+// authorized peers, and forwards only to the next hops proving their identities, see
+// HandshakeConfig.Identity. Both ends of a link must agree. It should be called before Start,
+// and returns an error if the handshake packets would exceed HandshakeConfig.MTU.
+func (l *Listener) SetHandshake(in, out *HandshakeConfig) error {
+	if in != nil {
+		if err := checkHandshakeMTU(in, l.crypterIn); err != nil {
+			return err
+		}
+	}
+	if out != nil {
+		if err := checkHandshakeMTU(out, l.crypterOut); err != nil {
+			return err
+		}
+	}
+
+	l.handshakeIn, l.handshakeOut = nil, nil
+	if in != nil {
+		l.handshakeIn = newHandshaker(in, l.crypterIn, false)
+	}
+	if out != nil {
+		l.handshakeOut = newHandshaker(out, l.crypterOut, true)
+	}
+	return nil
+}
+
+// SetMimicry frames the datagrams with clients(in) and next hops(out) like the datagrams of another
+// protocol, a nil mimicry disables it on that side. The framing is stripped from the received datagrams
+// before decryption, and the datagrams not framed by the profile are dropped, so both ends of a link
+// must agree. It should be called before Start.
+func (l *Listener) SetMimicry(in, out *Mimicry) {
+	l.mimicryIn, l.mimicryOut = in, out
+}
+
+// SetHeaderProtection masks the headers of the packets with clients(in) and next hops(out), a nil
+// header protection disables it on that side. The headers are masked after the crypters, the
+// credentials, the methods and the handshake sessions add their IDs, and before the mimicry frames
+// the datagrams, so both ends of a link must agree. It should be called before Start.
+func (l *Listener) SetHeaderProtection(in, out *HeaderProtection) {
+	l.protectionIn, l.protectionOut = in, out
+}
+
+// SetWorkers spreads the decryption, callbacks and encryption of packets across n workers,
+// so the crypto scales with CPU cores. Clients are sharded across the workers by address, the
+// packets of a client are processed by the same worker in both directions, keeping them in
+// order. Packets are dropped if the queue of a worker is full. With n <= 1, packets are processed
+// on the goroutines reading them from clients and next hops. It should be called before Start.
+func (l *Listener) SetWorkers(n int) {
+	l.workers = nil
+	if n > 1 {
+		l.workers = make([]chan incoming, n)
+		for i := range l.workers {
+			l.workers[i] = make(chan incoming, workerQueueSize)
+		}
+	}
+}
+
 // Start begins the listener loop, handling incoming packets and forwarding them.
 // It blocks until the listener is closed or encounters an error.
 func (l *Listener) Start() {
 	l.startOnce.Do(func() {
+		for _, queue := range l.workers {
+			go l.worker(queue)
+		}
 		go l.switcher()
+		if l.handshakeIn != nil || l.handshakeOut != nil {
+			go l.handshakeLoop()
+		}
 
 		for {
 			buf := make([]byte, mtuLimit)
 			if n, from, err := l.conn.ReadFrom(buf); err == nil {
-				l.clientIn(buf[:n], from)
+				atomic.AddUint64(&DefaultSnmp.InPkts, 1)
+				atomic.AddUint64(&l.snmp.InPkts, 1)
+				l.dispatch(incoming{ctx: from, packet: buf[:n]})
 			} else {
-				l.logger.Fatal("Start:", err)
+				select {
+				case <-l.die:
+				default:
+					l.logger.Fatal("Start:", err)
+				}
 				return
 			}
 		}
 	})
 }
+
+// dispatch processes the packet on the worker of its client, or on the calling
+// goroutine without workers.
+func (l *Listener) dispatch(in incoming) {
+	if len(l.workers) == 0 {
+		l.process(in)
+		return
+	}
+
+	select {
+	case l.workers[shard(in.ctx)%uint32(len(l.workers))] <- in:
+	default:
+		atomic.AddUint64(&DefaultSnmp.QueueDrops, 1)
+		atomic.AddUint64(&l.snmp.QueueDrops, 1)
+	}
+}
+
+// shard hashes the address of a client with FNV-1a to pick its worker.
+func shard(addr net.Addr) uint32 {
+	h := uint32(2166136261)
+	hash := func(b []byte) {
+		for _, c := range b {
+			h = (h ^ uint32(c)) * 16777619
+		}
+	}
+
+	if udpaddr, ok := addr.(*net.UDPAddr); ok {
+		hash(udpaddr.IP)
+		hash([]byte{byte(udpaddr.Port >> 8), byte(udpaddr.Port)})
+	} else {
+		hash([]byte(addr.String()))
+	}
+	return h
+}
+
+// worker processes the packets in queue until the listener is closed.
+func (l *Listener) worker(queue chan incoming) {
+	for {
+		select {
+		case in := <-queue:
+			l.process(in)
+		case <-l.die:
+			return
+		}
+	}
+}
+
+// process handles a packet from a client or a next hop.
+func (l *Listener) process(in incoming) {
+	if in.conn == nil {
+		l.clientIn(in.packet, in.ctx)
+	} else {
+		l.nextHopIn(in.conn, in.ctx, in.packet)
+	}
+}
+
 func (l *Listener) clientIn(data []byte, raddr net.Addr) {
 	// decrypt the packet if crypterIn is set
-	data, err := decryptPacket(l.crypterIn, data)
+	data, err := l.openIn(raddr, data)
 	if err != nil {
+		atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+		atomic.AddUint64(&l.snmp.InErrs, 1)
 		l.logger.Println("[clientIn]decryptPacket:", err)
 		return
 	}
 
+	// consumed by the handshake
+	if data == nil {
+		return
+	}
+
+	// drop replayed packets, the drops are counted in the statistics
+	data, err = l.replayIn.open(data)
+	if err != nil {
+		return
+	}
+
 	// onClientIn callback
 	if l.onClientIn != nil {
 		data = l.onClientIn(raddr, data)
@@ -197,21 +431,22 @@ func (l *Listener) clientIn(data []byte, raddr net.Addr) {
 		return
 	}
 
-	// encrypt or re-encrypt the packet if crypterOut is set(with new nonce)
-	data = encryptPacket(l.crypterOut, data)
-
 	// load the connection from the incoming connections
 	l.incomingConnectionsLock.Lock()
 	conn, ok := l.incomingConnections[raddr.String()]
 	l.incomingConnectionsLock.Unlock()
 
 	ctx := raddr
-	if ok { // existing connection
-		l.watcher.WriteTimeout(ctx, conn, data, time.Now().Add(l.timeout))
-	} else { // new connection
-		// pick random next hop
-		nextHop := l.nextHops[mrand.Intn(len(l.nextHops))]
-		conn, err := net.Dial("udp", nextHop)
+	if !ok { // new connection
+		// pick random next hop, from the next hop group of the client if specified
+		nextHops := l.nextHops
+		if l.credentials != nil {
+			if group := l.credentials.nextHops(raddr.String()); len(group) > 0 {
+				nextHops = group
+			}
+		}
+		nextHop := nextHops[mrand.Intn(len(nextHops))]
+		conn, err = net.Dial("udp", nextHop)
 		if err != nil {
 			l.logger.Println("[clientIn]net.Dial:", err)
 			return
@@ -225,8 +460,10 @@ func (l *Listener) clientIn(data []byte, raddr net.Addr) {
 		// watch the connection
 		// the context is the address of incoming packet
 		l.watcher.ReadTimeout(ctx, conn, make([]byte, mtuLimit), time.Now().Add(l.timeout))
-		l.watcher.WriteTimeout(ctx, conn, data, time.Now().Add(l.timeout))
 	}
+
+	// encrypt or re-encrypt the packet if crypterOut is set(with new nonce)
+	l.sendOut(conn, ctx, l.replayOut.seal(data))
 }
 
 // switcher handles bidirectional communication between the client and the next hop.
@@ -258,32 +495,158 @@ func (l *Listener) switcher() {
 				}
 
 				// received data from the proxy connection.
-				dataFromProxy := res.Buffer[:res.Size]
+				atomic.AddUint64(&DefaultSnmp.InPkts, 1)
+				atomic.AddUint64(&l.snmp.InPkts, 1)
 
-				// decrypt data from the proxy connection if crypterOut is set.
-				dataFromProxy, err := decryptPacket(l.crypterOut, dataFromProxy)
-				if err != nil {
-					l.logger.Println("[switcher]decryptPacket:", err)
-					continue RESULTS_LOOP
-				}
+				// fire next read-request to the proxy connection.
+				l.watcher.ReadTimeout(res.Context, res.Conn, make([]byte, mtuLimit), time.Now().Add(l.timeout))
 
-				// onNextHopIn callback post processing
-				if l.onNextHopIn != nil {
-					dataFromProxy = l.onNextHopIn(res.Conn.RemoteAddr(), res.Context.(net.Addr), dataFromProxy)
-				}
+				l.dispatch(incoming{conn: res.Conn, ctx: res.Context.(net.Addr), packet: res.Buffer[:res.Size]})
+			}
+		}
+	}
+}
 
-				// forward the data to the client if not nil.
-				if dataFromProxy != nil {
-					// re-encrypt data if crypterIn is set.
-					dataFromProxy = encryptPacket(l.crypterIn, dataFromProxy)
+// nextHopIn handles a packet from the next hop behind conn, on behalf of the client ctx.
+func (l *Listener) nextHopIn(conn net.Conn, ctx net.Addr, data []byte) {
+	// decrypt data from the proxy connection if crypterOut is set.
+	data, err := l.openOut(conn, data)
+	if err != nil {
+		atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+		atomic.AddUint64(&l.snmp.InErrs, 1)
+		l.logger.Println("[switcher]decryptPacket:", err)
+		return
+	}
 
-					// forward the data to client via the listener.
-					l.conn.WriteTo(dataFromProxy, res.Context.(net.Addr))
-				}
+	// consumed by the handshake
+	if data == nil {
+		return
+	}
 
-				// fire next read-request to the proxy connection.
-				l.watcher.ReadTimeout(res.Context, res.Conn, make([]byte, mtuLimit), time.Now().Add(l.timeout))
+	// drop replayed packets, the drops are counted in the statistics
+	data, err = l.replayOut.open(data)
+	if err != nil {
+		return
+	}
+
+	// onNextHopIn callback post processing
+	if l.onNextHopIn != nil {
+		data = l.onNextHopIn(conn.RemoteAddr(), ctx, data)
+	}
+
+	// forward the data to the client if not nil.
+	if data != nil {
+		// re-encrypt data if crypterIn is set.
+		l.sendIn(ctx, l.replayIn.seal(data))
+	}
+}
+
+// openIn decrypts a packet from the client, it returns nil data if the packet
+// is consumed by the handshake.
+func (l *Listener) openIn(raddr net.Addr, packet []byte) ([]byte, error) {
+	packet, err := l.mimicryIn.unwrap(packet)
+	if err != nil {
+		return nil, err
+	}
+	packet = l.protectionIn.mask(packet)
+
+	if l.credentials != nil {
+		return l.credentials.open(raddr.String(), packet)
+	}
+
+	if l.methods != nil {
+		return l.methods.open(raddr.String(), packet)
+	}
+
+	if l.handshakeIn == nil {
+		return decryptPacket(l.crypterIn, packet)
+	}
+
+	data, out, err := l.handshakeIn.open(raddr, packet)
+	l.write(out)
+	return data, err
+}
+
+// sendIn encrypts data and sends it to the client via the listener.
+func (l *Listener) sendIn(raddr net.Addr, data []byte) {
+	var packet []byte
+	if l.credentials != nil {
+		if packet = l.credentials.seal(raddr.String(), data); packet == nil {
+			l.logger.Println("[sendIn]unknown client:", raddr)
+			return
+		}
+	} else if l.methods != nil {
+		if packet = l.methods.seal(raddr.String(), data); packet == nil {
+			l.logger.Println("[sendIn]unknown client:", raddr)
+			return
+		}
+	} else if l.handshakeIn == nil {
+		packet = encryptPacket(l.crypterIn, data)
+	} else if packet = l.handshakeIn.seal(raddr, data); packet == nil {
+		l.logger.Println("[sendIn]no session:", raddr)
+		return
+	}
+
+	l.write([]outgoing{{ctx: raddr, packet: packet}})
+}
+
+// openOut decrypts a packet from the next hop behind conn, it returns nil data
+// if the packet is consumed by the handshake.
+func (l *Listener) openOut(conn net.Conn, packet []byte) ([]byte, error) {
+	packet, err := l.mimicryOut.unwrap(packet)
+	if err != nil {
+		return nil, err
+	}
+	packet = l.protectionOut.mask(packet)
+
+	if l.handshakeOut == nil {
+		return decryptPacket(l.crypterOut, packet)
+	}
+
+	data, out, err := l.handshakeOut.open(conn.RemoteAddr(), packet)
+	l.write(out)
+	return data, err
+}
+
+// sendOut encrypts data and sends it to the next hop behind conn, on behalf of the client ctx.
+func (l *Listener) sendOut(conn net.Conn, ctx net.Addr, data []byte) {
+	if l.handshakeOut == nil {
+		l.write([]outgoing{{conn: conn, ctx: ctx, packet: encryptPacket(l.crypterOut, data)}})
+		return
+	}
+	l.write(l.handshakeOut.sealTo(conn, ctx, data))
+}
+
+// write sends the outgoing packets, masked by the header protection and framed by the mimicry
+// of their sides.
+func (l *Listener) write(out []outgoing) {
+	for _, o := range out {
+		if o.conn == nil {
+			l.conn.WriteTo(l.mimicryIn.wrap(o.ctx.String(), l.protectionIn.mask(o.packet)), o.ctx)
+		} else {
+			l.watcher.WriteTimeout(o.ctx, o.conn, l.mimicryOut.wrap(o.ctx.String(), l.protectionOut.mask(o.packet)), time.Now().Add(l.timeout))
+		}
+		atomic.AddUint64(&DefaultSnmp.OutPkts, 1)
+		atomic.AddUint64(&l.snmp.OutPkts, 1)
+	}
+}
+
+// handshakeLoop retransmits the handshakes and expires the sessions periodically.
+func (l *Listener) handshakeLoop() {
+	ticker := time.NewTicker(handshakeRetry / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if l.handshakeIn != nil {
+				l.write(l.handshakeIn.tick(now))
 			}
+			if l.handshakeOut != nil {
+				l.write(l.handshakeOut.tick(now))
+			}
+		case <-l.die:
+			return
 		}
 	}
 }
@@ -300,30 +663,59 @@ func (l *Listener) removeClient(raddr net.Addr) {
 	l.incomingConnectionsLock.Lock()
 	delete(l.incomingConnections, raddr.String())
 	l.incomingConnectionsLock.Unlock()
+
+	l.credentials.remove(raddr.String())
+	l.methods.remove(raddr.String())
+	if l.handshakeIn != nil {
+		l.handshakeIn.remove(raddr)
+	}
 }
 
-// Close terminates the listener, releasing resources.
+// Close terminates the listener, releasing resources. The key material held by the crypters,
+// the credentials, the methods and the handshake sessions is zeroed, except for the states
+// of the ciphers out of reach, see Destroyer.
 func (l *Listener) Close() error {
 	l.dieOnce.Do(func() {
 		close(l.die)
 		l.conn.Close()
 		l.watcher.Close()
+
+		// the methods replace crypterIn and own it as their first method
+		if l.methods != nil {
+			l.methods.Destroy()
+		} else {
+			Destroy(l.crypterIn)
+		}
+		Destroy(l.crypterOut)
+		if l.credentials != nil {
+			l.credentials.Destroy()
+		}
+		if l.handshakeIn != nil {
+			l.handshakeIn.destroy()
+		}
+		if l.handshakeOut != nil {
+			l.handshakeOut.destroy()
+		}
 	})
 	return nil
 }
 
 // decryptPacket decrypts the packet using the provided crypter.
 // It returns the decrypted data or an error if the checksum does not match.
-func decryptPacket(crypter BlockCrypt, packet []byte) (data []byte, err error) {
-	if crypter != nil && len(packet) >= headerSize {
-		crypter.Decrypt(packet, packet)
-		// use the first 8 bytes of md5 digest as the checksum
-		checksum := md5.Sum(packet[headerSize:])
-		if !bytes.Equal(checksum[:checksumSize], packet[checksumOffset:checksumOffset+checksumSize]) {
-			return nil, errChecksum
+func decryptPacket(crypter Crypter, packet []byte) (data []byte, err error) {
+	if pc, ok := crypter.(PacketCrypt); ok {
+		return pc.OpenPacket(packet)
+	}
+
+	if block, ok := crypter.(BlockCrypt); ok {
+		if len(packet) >= headerSize {
+			block.Decrypt(packet, packet)
+			if !verifyChecksum(packet, nil) {
+				return nil, errChecksum
+			}
+			data = packet[headerSize:]
 		}
-		data = packet[headerSize:]
-	} else if crypter == nil {
+	} else {
 		data = packet
 	}
 
@@ -332,19 +724,87 @@ func decryptPacket(crypter BlockCrypt, packet []byte) (data []byte, err error) {
 
 // encryptPacket encrypts the packet using the provided crypter.
 // It returns the encrypted data or the original data if no crypter is provided.
-func encryptPacket(crypter BlockCrypt, data []byte) (packet []byte) {
-	if crypter != nil {
+func encryptPacket(crypter Crypter, data []byte) (packet []byte) {
+	if pc, ok := crypter.(PacketCrypt); ok {
+		return pc.SealPacket(data)
+	}
+
+	if block, ok := crypter.(BlockCrypt); ok {
 		packet = make([]byte, len(data)+headerSize)
 		copy(packet[headerSize:], data)
-		// fill the nonce(8 bytes)
-		_, _ = io.ReadFull(rand.Reader, packet[nonceOffset:nonceOffset+nonceSize])
-		// fill in half MD5(8 bytes)
-		checksum := md5.Sum(packet[headerSize:])
-		copy(packet[checksumOffset:], checksum[:checksumSize])
-		// encrypt the packet
-		crypter.Encrypt(packet, packet)
+		sealChecksum(block, packet, nil)
 	} else {
 		packet = data
 	}
 	return
 }
+
+// nonceSource is implemented by the crypters drawing their nonces from a source other
+// than crypto/rand, e.g. the fixed nonces of the known answer tests.
+type nonceSource interface {
+	nonceReader() io.Reader
+}
+
+// nonceReader returns the source of the nonces of crypter, crypto/rand by default.
+func nonceReader(crypter BlockCrypt) io.Reader {
+	if s, ok := crypter.(nonceSource); ok {
+		return s.nonceReader()
+	}
+	return rand.Reader
+}
+
+// sealChecksum fills the nonce and the checksum of | nonce | checksum | data | in packet,
+// and encrypts the packet in place.
+func sealChecksum(crypter BlockCrypt, packet []byte, domain []byte) {
+	// fill the nonce(8 bytes)
+	_, _ = io.ReadFull(nonceReader(crypter), packet[nonceOffset:nonceOffset+nonceSize])
+	// fill in half MD5(8 bytes)
+	sum := checksum(packet[headerSize:], domain)
+	copy(packet[checksumOffset:], sum[:checksumSize])
+	// encrypt the packet
+	crypter.Encrypt(packet, packet)
+}
+
+// verifyChecksum reports whether the checksum of a decrypted | nonce | checksum | data | matches.
+func verifyChecksum(packet []byte, domain []byte) bool {
+	sum := checksum(packet[headerSize:], domain)
+	return bytes.Equal(sum[:checksumSize], packet[checksumOffset:checksumOffset+checksumSize])
+}
+
+// checksum returns the md5 digest of domain and data, the first 8 bytes of which are the checksum.
+// The domain separates the checksums of the wire versions.
+func checksum(data []byte, domain []byte) [md5.Size]byte {
+	if domain == nil {
+		return md5.Sum(data)
+	}
+	h := md5.New()
+	h.Write(domain)
+	h.Write(data)
+	var sum [md5.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// openPacket authenticates and decrypts the packet | nonce | ciphertext | tag | of an AEAD.
+// The additional data ad is authenticated but not sent.
+func openPacket(aead AEADCrypt, packet []byte, ad []byte) (data []byte, err error) {
+	nonceSize := aead.NonceSize()
+	if len(packet) < nonceSize+aead.Overhead() {
+		return nil, errShortPacket
+	}
+
+	data, err = aead.Open(packet[nonceSize:nonceSize], packet[:nonceSize], packet[nonceSize:], ad)
+	if err != nil {
+		return nil, errAuthFailed
+	}
+	return data, nil
+}
+
+// sealPacket encrypts and authenticates the data into | nonce | ciphertext | tag | with an AEAD.
+// The additional data ad is authenticated but not sent.
+func sealPacket(aead AEADCrypt, data []byte, ad []byte) (packet []byte) {
+	nonceSize := aead.NonceSize()
+	packet = make([]byte, nonceSize, nonceSize+len(data)+aead.Overhead())
+	aead.FillNonce(packet)
+	return aead.Seal(packet, packet[:nonceSize], data, ad)
+}
@@ -23,11 +23,15 @@
 package grasshopper
 
 import (
+	"bytes"
 	"crypto/sha1"
-	"fmt"
+	"encoding/binary"
+	"errors"
 	"log"
 	"math/rand"
 	"net"
+	"slices"
+	"sync"
 	"testing"
 	"time"
 
@@ -42,6 +46,7 @@ func newEchoServer(t *testing.T) *net.UDPConn {
 		t.Fatalf("Error starting server: %v\n", err)
 		return nil
 	}
+	t.Cleanup(func() { conn.Close() })
 
 	t.Logf("UDP Echo Server is running on %v...", conn.LocalAddr())
 
@@ -50,6 +55,9 @@ func newEchoServer(t *testing.T) *net.UDPConn {
 	go func() {
 		for {
 			n, clientAddr, err := conn.(*net.UDPConn).ReadFromUDP(buffer)
+			if errors.Is(err, net.ErrClosed) {
+				return // closed at the end of the test
+			}
 			if err != nil {
 				t.Logf("Error reading data: %v\n", err)
 				return
@@ -66,101 +74,614 @@ func newEchoServer(t *testing.T) *net.UDPConn {
 	return conn.(*net.UDPConn)
 }
 
-func newHopper(listen string, nexthop []string, ki string, ko string, ci string, co string) *Listener {
-	passIn := pbkdf2.Key([]byte(ki), []byte(SALT), 128, 32, sha1.New)
-	passOut := pbkdf2.Key([]byte(ko), []byte(SALT), 128, 32, sha1.New)
-
-	// init crypter
-	crypterIn := newCrypt(passIn, ci)
-	crypterOut := newCrypt(passOut, co)
+// testKey derives the key of a passphrase.
+func testKey(passphrase string) []byte {
+	return pbkdf2.Key([]byte(passphrase), []byte(SALT), 128, 32, sha1.New)
+}
 
-	// init listener
-	listener, err := ListenWithOptions(listen, nexthop, 1024*1024, 15*time.Second, crypterIn, crypterOut, nil, nil, log.Default())
+// newCrypt creates the crypter of a registered method with key, nil for none.
+func newCrypt(t *testing.T, key []byte, method string) Crypter {
+	t.Helper()
+	if method == "none" {
+		return nil
+	}
+	crypter, err := NewCipher(method, key)
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(method, err)
 	}
+	return crypter
+}
 
+// chainHop configures a hop of a test chain.
+type chainHop struct {
+	in, out    Crypter
+	onClientIn OnClientInCallback
+	setup      func(l *Listener) error // configures the listener before it starts, may be nil
+}
+
+// listenHop starts the listener of the hop forwarding to the next hops, and closes it at the
+// end of the test.
+func listenHop(t *testing.T, nextHops []string, hop chainHop) *Listener {
+	t.Helper()
+	listener, err := ListenWithOptions("localhost:0", nextHops, 1024*1024, 15*time.Second, hop.in, hop.out, hop.onClientIn, nil, log.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hop.setup != nil {
+		if err := hop.setup(listener); err != nil {
+			listener.Close()
+			t.Fatal(err)
+		}
+	}
+	startHopper(t, listener)
 	return listener
 }
 
-func TestHopperNone(t *testing.T) {
-	conn := newEchoServer(t)
+// startHopper starts the listener, and closes it at the end of the test.
+func startHopper(t *testing.T, listener *Listener) {
+	go listener.Start()
+	t.Cleanup(func() { listener.Close() })
+}
 
-	ki, ko, ci, co := "", "", "none", "none"
-	hop1 := newHopper("localhost:0", []string{conn.LocalAddr().String()}, ki, ko, ci, co)
-	t.Log("Hop1:", hop1.conn.LocalAddr().String(), "->", conn.LocalAddr().String(), "ki:", ki, "ko:", ko, "ci:", ci, "co:", co)
-	go hop1.Start()
+// dialHop connects a client to the listener, closed at the end of the test.
+func dialHop(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
 
-	ki, ko, ci, co = "", "", "none", "none"
-	hop2 := newHopper("localhost:0", []string{hop1.conn.LocalAddr().String()}, ki, ko, ci, co)
-	t.Log("Hop2:", hop2.conn.LocalAddr().String(), "->", hop1.conn.LocalAddr().String(), "ki:", ki, "ko:", ko, "ci:", ci, "co:", co)
-	go hop2.Start()
+// newChain starts the chain client -> hop2 -> hop1 -> echo server, and returns both hops
+// along with the client.
+func newChain(t *testing.T, hop1, hop2 chainHop) (*Listener, *Listener, net.Conn) {
+	t.Helper()
+	echo := newEchoServer(t)
+	l1 := listenHop(t, []string{echo.LocalAddr().String()}, hop1)
+	l2 := listenHop(t, []string{l1.conn.LocalAddr().String()}, hop2)
+	t.Log("Chain:", l2.conn.LocalAddr(), "->", l1.conn.LocalAddr(), "->", echo.LocalAddr())
+	return l1, l2, dialHop(t, l2.conn.LocalAddr().String())
+}
+
+// tap relays the datagrams of a client to the target, and records them as they are on the wire.
+type tap struct {
+	conn      *net.UDPConn
+	mu        sync.Mutex
+	datagrams [][]byte
+}
 
-	clientConn, err := net.Dial("udp", hop2.conn.LocalAddr().String())
+// newTap starts a tap to the target, closed at the end of the test.
+func newTap(t *testing.T, target string) *tap {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
 	if err != nil {
-		t.Fatalf("Failed to connect to server: %v", err)
+		t.Fatal(err)
 	}
-	defer clientConn.Close()
+	upstream, err := net.Dial("udp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		upstream.Close()
+	})
+
+	tp := &tap{conn: conn}
+	client := make(chan net.Addr, 1)
+	go func() {
+		buf := make([]byte, mtuLimit)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			tp.mu.Lock()
+			tp.datagrams = append(tp.datagrams, bytes.Clone(buf[:n]))
+			tp.mu.Unlock()
+			select {
+			case client <- addr:
+			default:
+			}
+			upstream.Write(buf[:n])
+		}
+	}()
+	go func() {
+		buf := make([]byte, mtuLimit)
+		var addr net.Addr
+		for {
+			n, err := upstream.Read(buf)
+			if err != nil {
+				return
+			}
+			if addr == nil {
+				addr = <-client
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return tp
+}
 
-	testEcho(t, clientConn)
+// recorded returns the datagrams recorded so far.
+func (tp *tap) recorded() [][]byte {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	return slices.Clone(tp.datagrams)
+}
+
+// roundTrip sends msg and waits for its echo, skipping the echoes of earlier packets.
+func roundTrip(conn net.Conn, msg []byte) error {
+	buf := make([]byte, mtuLimit)
+	for range 3 {
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			if bytes.Equal(buf[:n], msg) {
+				return nil
+			}
+		}
+	}
+	return errors.New("no echo of " + string(msg))
+}
+
+// eventually waits until cond holds, failing the test after a few seconds.
+func eventually(t *testing.T, cond func() bool, msg string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHopperNone(t *testing.T) {
+	_, _, client := newChain(t, chainHop{}, chainHop{})
+	testEcho(t, client)
+}
+
+func TestListenCrypter(t *testing.T) {
+	aes, _ := NewAESBlockCrypt(pass[:32])
+	gcm, _ := NewAESGCMCrypt(pass[:32])
+
+	// a nil crypter leaves the packets unencrypted
+	if packet := encryptPacket(nil, []byte("hello")); string(packet) != "hello" {
+		t.Fatal("nil crypter encrypted a packet", packet)
+	}
+	if data, err := decryptPacket(nil, []byte("hello")); err != nil || string(data) != "hello" {
+		t.Fatal("nil crypter decrypted a packet", data, err)
+	}
+
+	listener, err := ListenWithOptions("localhost:0", []string{"localhost:1"}, 1024, time.Second, aes, gcm, nil, nil, log.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
 }
 
 func TestHopperAES(t *testing.T) {
-	conn := newEchoServer(t)
+	key := testKey("123456")
+	_, _, client := newChain(t, chainHop{in: newCrypt(t, key, "aes")}, chainHop{out: newCrypt(t, key, "aes")})
+	testEcho(t, client)
+}
 
-	ki, ko, ci, co := "123456", "", "aes", "none"
-	hop1 := newHopper("localhost:0", []string{conn.LocalAddr().String()}, ki, ko, ci, co)
-	t.Log("Hop1:", hop1.conn.LocalAddr().String(), "->", conn.LocalAddr().String(), "ki:", ki, "ko:", ko, "ci:", ci, "co:", co)
-	go hop1.Start()
+func TestHopperAESGCM(t *testing.T) {
+	key := testKey("123456")
+	_, _, client := newChain(t, chainHop{in: newCrypt(t, key, "aes-gcm")}, chainHop{out: newCrypt(t, key, "aes-gcm")})
+	testEcho(t, client)
+}
+
+func TestHopperReplay(t *testing.T) {
+	key := testKey("123456")
+	hop1, hop2, client := newChain(t,
+		chainHop{in: newCrypt(t, key, "aes-gcm"), setup: func(l *Listener) error { return l.SetReplayWindow(1024, 0, time.Minute) }},
+		chainHop{out: newCrypt(t, key, "aes-gcm"), setup: func(l *Listener) error { return l.SetReplayWindow(0, 1024, time.Minute) }})
+	testEcho(t, client)
+
+	// a packet replayed from another address is dropped
+	packet := encryptPacket(hop2.crypterOut, newReplayGuard(1024, time.Minute, newSnmp()).seal([]byte("hello")))
+	replays := DefaultSnmp.Copy().ReplayDrops
+	for i := range 2 {
+		conn := dialHop(t, hop1.conn.LocalAddr().String())
+		if _, err := conn.Write(packet); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := conn.Read(make([]byte, mtuLimit))
+		if replayed := i == 1; replayed != (err != nil) {
+			t.Fatal("replayed:", replayed, "reply error:", err)
+		}
+	}
+	if DefaultSnmp.Copy().ReplayDrops != replays+1 || hop1.Snmp().ReplayDrops != 1 || hop2.Snmp().ReplayDrops != 0 {
+		t.Fatal("replay not counted by its listener")
+	}
+
+	// a skew tolerance below the resolution of the timestamps is refused
+	for _, skew := range []time.Duration{0, 500 * time.Millisecond} {
+		if err := hop1.SetReplayWindow(1024, 0, skew); err == nil {
+			t.Fatal("skew accepted:", skew)
+		}
+	}
+}
+
+// handshake returns the setup of the handshake with the configs.
+func handshake(in, out *HandshakeConfig) func(l *Listener) error {
+	return func(l *Listener) error { return l.SetHandshake(in, out) }
+}
+
+func newSessionCrypt(key []byte) (Crypter, error) { return NewAESGCMCrypt(key) }
 
-	ki, ko, ci, co = "", "123456", "none", "aes"
-	hop2 := newHopper("localhost:0", []string{hop1.conn.LocalAddr().String()}, ki, ko, ci, co)
-	t.Log("Hop2:", hop2.conn.LocalAddr().String(), "->", hop1.conn.LocalAddr().String(), "ki:", ki, "ko:", ko, "ci:", ci, "co:", co)
-	go hop2.Start()
+func TestHopperHandshake(t *testing.T) {
+	key := testKey("123456")
+	_, _, client := newChain(t,
+		chainHop{in: newCrypt(t, key, "aes-gcm"), setup: handshake(&HandshakeConfig{PSK: []byte("psk"), NewCrypt: newSessionCrypt}, nil)},
+		chainHop{out: newCrypt(t, key, "aes-gcm"), setup: handshake(nil, &HandshakeConfig{PSK: []byte("psk"), NewCrypt: newSessionCrypt})})
+	testEcho(t, client)
+}
 
-	clientConn, err := net.Dial("udp", hop2.conn.LocalAddr().String())
+func TestHopperIdentity(t *testing.T) {
+	key := testKey("123456")
+	id1, err := GenerateIdentity()
 	if err != nil {
-		t.Fatalf("Failed to connect to server: %v", err)
+		t.Fatal(err)
+	}
+	id2, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// hop2 pins the identity of hop1 by its address
+	echo := newEchoServer(t)
+	hop1 := listenHop(t, []string{echo.LocalAddr().String()}, chainHop{
+		in:    newCrypt(t, key, "aes-gcm"),
+		setup: handshake(&HandshakeConfig{PSK: []byte("psk"), NewCrypt: newSessionCrypt, Identity: id1, Peers: []Peer{{PublicKey: id2.PublicKey()}}}, nil),
+	})
+	hop1Addr := hop1.conn.LocalAddr().String()
+	hop2 := listenHop(t, []string{hop1Addr}, chainHop{
+		out:   newCrypt(t, key, "aes-gcm"),
+		setup: handshake(nil, &HandshakeConfig{PSK: []byte("psk"), NewCrypt: newSessionCrypt, Identity: id2, Peers: []Peer{{PublicKey: id1.PublicKey(), Address: hop1Addr}}}),
+	})
+	testEcho(t, dialHop(t, hop2.conn.LocalAddr().String()))
+}
+
+func TestHopperDirectional(t *testing.T) {
+	out, in := newLink(t, "aes-gcm", testKey("123456"))
+	_, _, client := newChain(t, chainHop{in: in}, chainHop{out: out})
+	testEcho(t, client)
+}
+
+func TestHopperKeyRotation(t *testing.T) {
+	key1, key2 := testKey("123456"), testKey("654321")
+	keysIn := NewKeyring(1, newCrypt(t, key1, "aes"))
+	keysOut := NewKeyring(1, newCrypt(t, key1, "aes"))
+	hop1, _, client := newChain(t, chainHop{in: keysIn}, chainHop{out: keysOut})
+	testEcho(t, client)
+
+	// roll to key 2 hop by hop
+	keysIn.Add(2, newCrypt(t, key2, "aes-gcm"))
+	keysOut.Add(2, newCrypt(t, key2, "aes-gcm"))
+	if err := keysOut.Use(2); err != nil {
+		t.Fatal(err)
+	}
+	testEcho(t, client)
+
+	if err := keysIn.Use(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := keysIn.Remove(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := keysOut.Remove(1); err != nil {
+		t.Fatal(err)
+	}
+	testEcho(t, client)
+
+	// the packets of the removed key are rejected
+	errs := hop1.Snmp().InErrs
+	old := dialHop(t, hop1.conn.LocalAddr().String())
+	if _, err := old.Write(encryptPacket(NewKeyring(1, newCrypt(t, key1, "aes")), []byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool { return hop1.Snmp().InErrs == errs+1 }, "packet of a removed key not rejected")
+}
+
+func TestHopperCredentials(t *testing.T) {
+	echo := newEchoServer(t)
+	keyA, keyB := testKey("team-a"), testKey("team-b")
+
+	// the default next hop discards the packets, clients reach the echo server by their next hop group
+	credentials := NewCredentials()
+	for _, credential := range []*Credential{
+		{ID: 1, Crypter: newCrypt(t, keyA, "aes"), NextHops: []string{echo.LocalAddr().String()}},
+		{ID: 2, Crypter: newCrypt(t, keyB, "aes-gcm"), NextHops: []string{echo.LocalAddr().String()}},
+	} {
+		if err := credentials.Add(credential); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hop1 := listenHop(t, []string{"127.0.0.1:9"}, chainHop{setup: func(l *Listener) error {
+		l.SetCredentials(credentials)
+		return nil
+	}})
+
+	// team a sends its client ID, team b is identified by trial decryption
+	var clients []net.Conn
+	for _, crypter := range []Crypter{NewClientCrypt(1, newCrypt(t, keyA, "aes")), newCrypt(t, keyB, "aes-gcm")} {
+		hop2 := listenHop(t, []string{hop1.conn.LocalAddr().String()}, chainHop{out: crypter})
+		client := dialHop(t, hop2.conn.LocalAddr().String())
+		testEcho(t, client)
+		clients = append(clients, client)
+	}
+
+	// the packets of revoked team a are dropped
+	if err := credentials.Revoke(1); err != nil {
+		t.Fatal(err)
+	}
+	errs := hop1.Snmp().InErrs
+	if _, err := clients[0].Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool { return hop1.Snmp().InErrs == errs+1 }, "packet of a revoked client not dropped")
+	testEcho(t, clients[1])
+}
+
+func TestHopperMethods(t *testing.T) {
+	echo := newEchoServer(t)
+	key := testKey("migration")
+
+	// hop1 accepts both aes-gcm and aes during a migration
+	methods := NewMethods()
+	methods.Add("aes-gcm", newCrypt(t, key, "aes-gcm"))
+	methods.Add("aes", newCrypt(t, key, "aes"))
+	hop1 := listenHop(t, []string{echo.LocalAddr().String()}, chainHop{setup: func(l *Listener) error {
+		l.SetMethods(methods)
+		return nil
+	}})
+
+	for _, method := range []string{"aes", "aes-gcm"} {
+		hop2 := listenHop(t, []string{hop1.conn.LocalAddr().String()}, chainHop{out: newCrypt(t, key, method)})
+		testEcho(t, dialHop(t, hop2.conn.LocalAddr().String()))
+	}
+
+	for _, usage := range methods.Usage() {
+		if usage.Packets == 0 || usage.Clients != 1 {
+			t.Fatal("unexpected usage", usage)
+		}
+	}
+}
+
+func TestHopperPadding(t *testing.T) {
+	key := testKey("123456")
+	buckets, err := BucketPadding(256, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crypterIn, err := NewPaddingCrypt(newCrypt(t, key, "aes-gcm"), MTUPadding(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crypterOut, err := NewPaddingCrypt(newCrypt(t, key, "aes-gcm"), buckets, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tap the datagrams from hop2 to hop1
+	echo := newEchoServer(t)
+	hop1 := listenHop(t, []string{echo.LocalAddr().String()}, chainHop{in: crypterIn})
+	tp := newTap(t, hop1.conn.LocalAddr().String())
+	hop2 := listenHop(t, []string{tp.conn.LocalAddr().String()}, chainHop{out: crypterOut})
+	client := dialHop(t, hop2.conn.LocalAddr().String())
+	if err := roundTrip(client, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	testEcho(t, client)
+
+	// the datagrams up to the largest bucket land in the buckets
+	sizes := make(map[int]int)
+	for _, datagram := range tp.recorded() {
+		if n := len(datagram); n <= 1024 {
+			sizes[n]++
+		}
+	}
+	if sizes[256] == 0 || len(sizes) > 2 || len(sizes) == 2 && sizes[1024] == 0 {
+		t.Fatal("datagram sizes off the buckets", sizes)
+	}
+}
+
+func TestHopperWireVersion(t *testing.T) {
+	key := testKey("123456")
+	crypterIn, err := NewVersionCrypt(newCrypt(t, key, "aes"), WireV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crypterOut, err := NewVersionCrypt(newCrypt(t, key, "aes"), WireV2)
+	if err != nil {
+		t.Fatal(err)
 	}
-	defer clientConn.Close()
 
-	testEcho(t, clientConn)
+	// hop1 emits v1 and accepts the v2 packets of hop2
+	_, _, client := newChain(t, chainHop{in: crypterIn}, chainHop{out: crypterOut})
+	testEcho(t, client)
+}
+
+func TestHopperMimicry(t *testing.T) {
+	key := testKey("123456")
+	for _, profile := range MimicryProfiles() {
+		t.Run(profile, func(t *testing.T) {
+			in, err := NewMimicry(profile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := NewMimicry(profile)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// hop2 frames the datagrams to hop1 by the profile, hop1 strips them
+			echo := newEchoServer(t)
+			hop1 := listenHop(t, []string{echo.LocalAddr().String()}, chainHop{in: newCrypt(t, key, "aes"), setup: func(l *Listener) error {
+				l.SetMimicry(in, nil)
+				return nil
+			}})
+			tp := newTap(t, hop1.conn.LocalAddr().String())
+			hop2 := listenHop(t, []string{tp.conn.LocalAddr().String()}, chainHop{out: newCrypt(t, key, "aes"), setup: func(l *Listener) error {
+				l.SetMimicry(nil, out)
+				return nil
+			}})
+			testEcho(t, dialHop(t, hop2.conn.LocalAddr().String()))
+
+			// the framing of the profile is on the wire, around the encrypted packets
+			receiver := newCrypt(t, key, "aes")
+			for _, datagram := range tp.recorded() {
+				if profile != MimicryNone && !hasMimicryHeader(profile, datagram) {
+					t.Fatalf("datagram not framed: %x", datagram[:min(len(datagram), 32)])
+				}
+				packet, err := in.unwrap(datagram)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := decryptPacket(receiver, packet); err != nil {
+					t.Fatal("framed packet not decrypted:", err)
+				}
+			}
+		})
+	}
+}
+
+// hasMimicryHeader reports whether the datagram starts with the fixed bytes of the profile.
+func hasMimicryHeader(profile string, datagram []byte) bool {
+	switch profile {
+	case MimicryQUIC:
+		return datagram[0]&0xc0 == 0x40
+	case MimicryQUICLong:
+		return datagram[0]&0xf0 == 0xe0 && binary.BigEndian.Uint32(datagram[1:]) == quicVersion1 && datagram[5] == quicCIDSize
+	case MimicryDTLS:
+		return datagram[0] == dtlsApplicationData && binary.BigEndian.Uint16(datagram[1:]) == dtlsVersion12
+	case MimicryWireGuard:
+		return bytes.Equal(datagram[:4], []byte{wireGuardTransportData, 0, 0, 0})
+	}
+	return false
+}
+
+func TestHopperHeaderProtection(t *testing.T) {
+	key := testKey("123456")
+	hp, err := NewHeaderProtection(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := NewMimicry(MimicryQUIC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := NewMimicry(MimicryQUIC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the receiver indexes of the sessions are masked inside the mimicry
+	_, _, client := newChain(t,
+		chainHop{in: newCrypt(t, key, "aes-gcm"), setup: func(l *Listener) error {
+			l.SetHeaderProtection(hp, nil)
+			l.SetMimicry(in, nil)
+			return l.SetHandshake(&HandshakeConfig{PSK: []byte("psk"), NewCrypt: newSessionCrypt}, nil)
+		}},
+		chainHop{out: newCrypt(t, key, "aes-gcm"), setup: func(l *Listener) error {
+			l.SetHeaderProtection(nil, hp)
+			l.SetMimicry(nil, out)
+			return l.SetHandshake(nil, &HandshakeConfig{PSK: []byte("psk"), NewCrypt: newSessionCrypt})
+		}})
+	testEcho(t, client)
+}
+
+func TestHopperWorkers(t *testing.T) {
+	// record the order of the packets of each client after decryption, sequence
+	// packets are | 0 | seq(4) |, apart from the letters of the echo test
+	var mu sync.Mutex
+	seqs := make(map[string][]uint32)
+	onClientIn := func(client net.Addr, in []byte) []byte {
+		if len(in) == 5 && in[0] == 0 {
+			mu.Lock()
+			seqs[client.String()] = append(seqs[client.String()], binary.BigEndian.Uint32(in[1:]))
+			mu.Unlock()
+		}
+		return in
+	}
+	workers := func(l *Listener) error {
+		l.SetWorkers(4)
+		return nil
+	}
+
+	key := testKey("123456")
+	_, hop2, _ := newChain(t,
+		chainHop{in: newCrypt(t, key, "aes"), onClientIn: onClientIn, setup: workers},
+		chainHop{out: newCrypt(t, key, "aes"), setup: workers})
+
+	// the echo of the last packet of a client follows all its packets through hop1
+	var wg sync.WaitGroup
+	for range 8 {
+		client := dialHop(t, hop2.conn.LocalAddr().String())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			testEcho(t, client)
+			for i := range 200 {
+				if _, err := client.Write(binary.BigEndian.AppendUint32([]byte{0}, uint32(i))); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			if err := roundTrip(client, []byte("done")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seqs) != 8 {
+		t.Fatal("clients seen:", len(seqs))
+	}
+	for client, seq := range seqs {
+		for i := 1; i < len(seq); i++ {
+			if seq[i] <= seq[i-1] {
+				t.Fatalf("packets of %v reordered: %v after %v", client, seq[i], seq[i-1])
+			}
+		}
+	}
 }
 
 func TestMultiHoppers(t *testing.T) {
 	var nextHops []string
-	conn := newEchoServer(t)
+	echo := newEchoServer(t)
+	key := testKey("123456")
 
 	// create 10 LEVEL-2 hops
-	ki, ko, ci, co := "123456", "", "aes", "none"
 	for range 10 {
-		hop1 := newHopper("localhost:0", []string{conn.LocalAddr().String()}, ki, ko, ci, co)
-		t.Log("Hop1:", hop1.conn.LocalAddr().String(), "->", conn.LocalAddr().String(), "ki:", ki, "ko:", ko, "ci:", ci, "co:", co)
+		hop1 := listenHop(t, []string{echo.LocalAddr().String()}, chainHop{in: newCrypt(t, key, "aes")})
 		nextHops = append(nextHops, hop1.conn.LocalAddr().String())
-		go hop1.Start()
 	}
-	fmt.Println("NextHops:", nextHops)
-	<-time.After(2 * time.Second)
-
-	ki, ko, ci, co = "", "123456", "none", "aes"
-	hop2 := newHopper("localhost:0", nextHops, ki, ko, ci, co)
-	t.Log("Hop2:", hop2.conn.LocalAddr().String(), "->", nextHops, "ki:", ki, "ko:", ko, "ci:", ci, "co:", co)
-	go hop2.Start()
+	t.Log("NextHops:", nextHops)
 
+	hop2 := listenHop(t, nextHops, chainHop{out: newCrypt(t, key, "aes")})
 	for range 10 {
-		<-time.After(time.Millisecond * 100)
-		clientConn, err := net.Dial("udp", hop2.conn.LocalAddr().String())
-		if err != nil {
-			t.Fatalf("Failed to connect to server: %v", err)
-		}
-		defer clientConn.Close()
-
-		testEcho(t, clientConn)
+		testEcho(t, dialHop(t, hop2.conn.LocalAddr().String()))
 	}
 }
 
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
+// payloadLimit leaves room in mtuLimit for the per-packet overhead of any crypter.
+const payloadLimit = mtuLimit - 64
+
 func randStringBytesRmndr(n int) string {
 	b := make([]byte, n)
 	for i := range b {
@@ -175,7 +696,7 @@ func testEcho(t *testing.T, clientConn net.Conn) {
 	failed := 0
 	timeout := 0
 	for i := range total {
-		msg := randStringBytesRmndr(rand.Intn(mtuLimit - headerSize))
+		msg := randStringBytesRmndr(rand.Intn(payloadLimit))
 		_, err := clientConn.Write([]byte(msg))
 		if err != nil {
 			t.Errorf("Failed to send message %d: %v", i, err)
@@ -212,14 +733,20 @@ func testEcho(t *testing.T, clientConn net.Conn) {
 	t.Logf("Echo test: %d sucess, %d failed, %d timeout", sucess, failed, timeout)
 }
 
-func newCrypt(pass []byte, method string) BlockCrypt {
-	var block BlockCrypt
-	switch method {
-	case "aes":
-		block, _ = NewAESBlockCrypt(pass)
-	case "blowfish":
-		block, _ = NewBlowfishBlockCrypt(pass)
+func TestHopperClose(t *testing.T) {
+	crypterIn, _ := NewSalsa20BlockCrypt(pass[:32])
+	crypterOut, _ := NewSalsa20BlockCrypt(pass[:32])
+	listener, err := ListenWithOptions("localhost:0", []string{"127.0.0.1:9"}, 1024*1024, 15*time.Second, crypterIn, crypterOut, nil, nil, log.Default())
+	if err != nil {
+		t.Fatal(err)
 	}
+	if err := listener.SetHandshake(&HandshakeConfig{PSK: pass[:32], NewCrypt: FactoryOf(NewSalsa20BlockCrypt)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	psk := listener.handshakeIn.config.PSK
 
-	return block
+	listener.Close()
+	if !isZero(crypterIn.(*salsa20BlockCrypt).key[:]) || !isZero(crypterOut.(*salsa20BlockCrypt).key[:]) || !isZero(psk) {
+		t.Fatal("keys not zeroed on close")
+	}
 }
@@ -0,0 +1,151 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"math/big"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PublicKeySize defines the size of the public key of an identity.
+const PublicKeySize = ed25519.PublicKeySize
+
+var (
+	errIdentity  = errors.New("invalid identity")
+	errPublicKey = errors.New("invalid public key")
+
+	// curve25519P is the field prime 2^255-19 shared by Ed25519 and X25519.
+	curve25519P = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+)
+
+// Identity is the static keypair of a hop, authenticating it to its peers in the
+// handshakes, see HandshakeConfig.Identity.
+//
+// Identities are Ed25519 keys, and the handshakes use their X25519 forms by the
+// birational map of RFC 7748, so a hop has a single key to generate and publish.
+type Identity struct {
+	key    ed25519.PrivateKey
+	static *ecdh.PrivateKey
+}
+
+// PublicKey is the public key of an identity, formatted in base64 as text.
+type PublicKey [PublicKeySize]byte
+
+// GenerateIdentity generates a random identity.
+func GenerateIdentity() (*Identity, error) {
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return NewIdentity(seed)
+}
+
+// NewIdentity creates the identity of the 32-byte Ed25519 private key seed.
+func NewIdentity(seed []byte) (*Identity, error) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.Wrapf(errIdentity, "%d bytes", len(seed))
+	}
+
+	// the X25519 scalar of an Ed25519 key is the first half of the hashed seed, as in RFC 8032
+	h := sha512.Sum512(seed)
+	static, err := ecdh.X25519().NewPrivateKey(h[:32])
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &Identity{key: ed25519.NewKeyFromSeed(seed), static: static}, nil
+}
+
+// ParseIdentity parses the identity formatted by Identity.Encode.
+func ParseIdentity(text string) (*Identity, error) {
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+	if err != nil {
+		return nil, errors.Wrap(errIdentity, "malformed base64")
+	}
+	return NewIdentity(seed)
+}
+
+// Encode formats the private key seed of the identity in base64, it must be kept secret.
+func (id *Identity) Encode() string {
+	return base64.StdEncoding.EncodeToString(id.key.Seed())
+}
+
+// PublicKey returns the public key of the identity, to be authorized by the peers.
+func (id *Identity) PublicKey() PublicKey {
+	return PublicKey(id.key.Public().(ed25519.PublicKey))
+}
+
+// ParsePublicKey parses a public key formatted by PublicKey.String.
+func ParsePublicKey(text string) (PublicKey, error) {
+	var pub PublicKey
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+	if err != nil {
+		return pub, errors.Wrap(errPublicKey, "malformed base64")
+	}
+	if len(b) != PublicKeySize {
+		return pub, errors.Wrapf(errPublicKey, "%d bytes", len(b))
+	}
+	copy(pub[:], b)
+	if _, err := pub.x25519(); err != nil {
+		return pub, err
+	}
+	return pub, nil
+}
+
+// String formats the public key in base64.
+func (pub PublicKey) String() string {
+	return base64.StdEncoding.EncodeToString(pub[:])
+}
+
+// x25519 converts the Ed25519 public key to the X25519 public key of the same identity,
+// the Montgomery u = (1+y)/(1-y) of the Edwards y.
+func (pub PublicKey) x25519() (*ecdh.PublicKey, error) {
+	le := pub
+	le[31] &= 0x7f // the sign of x
+	slices.Reverse(le[:])
+	y := new(big.Int).SetBytes(le[:])
+	if y.Cmp(curve25519P) >= 0 {
+		return nil, errors.Wrap(errPublicKey, "not canonical")
+	}
+
+	den := new(big.Int).Sub(big.NewInt(1), y)
+	den.Mod(den, curve25519P)
+	if den.Sign() == 0 {
+		return nil, errors.Wrap(errPublicKey, "identity point")
+	}
+	u := new(big.Int).Add(big.NewInt(1), y)
+	u.Mul(u, den.ModInverse(den, curve25519P))
+	u.Mod(u, curve25519P)
+
+	var b [32]byte
+	u.FillBytes(b[:])
+	slices.Reverse(b[:])
+	return ecdh.X25519().NewPublicKey(b[:])
+}
@@ -0,0 +1,101 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+)
+
+func TestIdentity(t *testing.T) {
+	// RFC 8032 test 1, the X25519 public key is the base point multiplied by the clamped
+	// first half of the hashed seed, computed by openssl.
+	seed, _ := hex.DecodeString("9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60")
+	id, err := NewIdentity(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := id.PublicKey()
+	if got := hex.EncodeToString(pub[:]); got != "d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a" {
+		t.Fatalf("public key %v", got)
+	}
+	x, err := pub.x25519()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(x.Bytes()); got != "d85e07ec22b0ad881537c2f44d662d1a143cf830c57aca4305d85c7a90f6b62e" {
+		t.Fatalf("x25519 public key %v", got)
+	}
+	if !x.Equal(id.static.PublicKey()) {
+		t.Fatal("x25519 public key mismatch")
+	}
+
+	// text formats
+	for range 16 {
+		id, err := GenerateIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := ParseIdentity(id.Encode() + "\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.PublicKey() != id.PublicKey() {
+			t.Fatal("identity mismatch")
+		}
+		pub, err := ParsePublicKey(id.PublicKey().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pub != id.PublicKey() {
+			t.Fatal("public key mismatch")
+		}
+		x, _ := pub.x25519()
+		if !bytes.Equal(x.Bytes(), id.static.PublicKey().Bytes()) {
+			t.Fatal("x25519 public key mismatch")
+		}
+	}
+
+	if _, err := NewIdentity(seed[:31]); err == nil {
+		t.Fatal("short seed accepted")
+	}
+	if _, err := ParseIdentity("not base64"); err == nil {
+		t.Fatal("malformed identity accepted")
+	}
+
+	invalid := map[string][]byte{
+		"short":         make([]byte, 31),
+		"not canonical": append(bytes.Repeat([]byte{0xff}, 31), 0x7f), // y = 2^255-1
+		"identity":      append([]byte{1}, make([]byte, 31)...),       // y = 1
+	}
+	for name, b := range invalid {
+		if _, err := ParsePublicKey(base64.StdEncoding.EncodeToString(b)); err == nil {
+			t.Fatalf("%v public key accepted", name)
+		}
+	}
+	if _, err := ParsePublicKey("not base64"); err == nil {
+		t.Fatal("malformed public key accepted")
+	}
+}
@@ -0,0 +1,262 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"bytes"
+	"encoding/hex"
+
+	"github.com/pkg/errors"
+)
+
+var errSelfTest = errors.New("cipher self-test failed")
+
+// knownAnswer is the packet of knownAnswerData sealed by encryptPacket, with the
+// key knownAnswerKey and a fixed nonce.
+type knownAnswer struct {
+	method string // registered cipher
+	mac    string // mac wrapping the cipher, empty for none
+	packet string // hex encoded packet
+}
+
+// knownAnswers of the builtin ciphers and macs, a change of them breaks the interoperability
+// between hops of different versions.
+var knownAnswers = []knownAnswer{
+	{"qpp", "", "a0a1a2a3a4a5a6a710ec8f40d277b9e76f448033be5ba8a318a878465fa413e745eb79a9a8aaef9e42c7d50d8c17fd0afc1307f1882cb7ad45f153e8ab99a60255d3977561ba090ba50a11c1b98f877e33273e73f965e3225b32f4483ccf6ed73ec65c14fc0cb89d463679b4127cbfecc061cf62"},
+	{"sm4", "", "a17a177a1ad5def83248d1a69ef23f6e2964ab539ac58d5e6af41c579a835b78402fb4fb77e0fe82e81fa60a937d00a7eace5762d314e1dda33dcbcbd29e9d419044636fa58995600ff0a0c6350df82351c7eb897707a68f4667fe8085033078166ed58e1b5101128e12d56898e4e5fd304b0750"},
+	{"tea", "", "186fb5e88b12ef91169e4ba75eadd48ebdf143d14f5aadc8b291253f04a9d5046626d7b2e0ccc5094caa8bd9b8fc14766a4d1b09f48d6c798dd91a63d364c3b253649bc4e1279f7a795fed9e57290f7751ac9cc9efbea5cf049244b613b7464e02649a276deec3636f938497adc164412d4f9aca"},
+	{"aes", "", "333d433b4a2982bf9f6a38bb81014c33da20fa2383793b2fc150a630687321e546f7f44586ac959a96c51e536d14c8c266db0b915d6232cce43cfa0a42bd2955345388028fa98415bb2d11645ad53b6cf61633a3e3b061224b846bd0742faa012f6fe44e2792ce401601104809e670dccf051586"},
+	{"aes-128", "", "0a9d1d3496030ee3a75e5c0a2b62cb6049f32c453858b8d6b184934de7d35e1e139b241c0e1886645ce4d47aeae4d7513138497db14612481f475633add3221ad13927e317e403e2f434a539e37a002f44a2bf3c6c237a3c1c79e8b6857cb3bbdff3c9f14632358265448701f63378d53865012b"},
+	{"aes-192", "", "cc4e84131ceb2eb8356f92a42857f455e31081552ca53fd10e66c57f035589e2ea96e89467a702d57df5acd0373257a7096be3f235dc4967450e1a595a483e348aee10ca525416324a83d3dc0fdd7ba4d5b4be256dbe511dc890bbfb3abb057ddba363c50065a353122683e0ff3f4d3b3ecb8e53"},
+	{"aes-gcm", "", "a0a1a2a3abaaa9a8a7a6a5a53f21f8cdd2dc0181ca5dbcc86cbdaef9f7055064e38ff09be893f2d79a582c27019caff5cd2f20022863d4daf05fc74d972a86875869c0d822741540cc3f715c705189ef87c778d9896b646d8b412471e86b67848018c5e8cd264d0ba8ec5eaddade2a5fe7bbf94bcd8448ad90fb844aeff4921b"},
+	{"aes-128-gcm", "", "a0a1a2a3abaaa9a8a7a6a5a54f1271b80a0688d7d7240498afb6ee998853ee359dc656aaa443e0cbf77ccfc8cf51fa3ed5fc60ba05c8bd13cc322f7cb592ff6a4f4ffc3d47f8e4864cce4c2a5ec729768b765938e738a395b3b3d361d26e0b37b28530af0974e2d66d72c521d12a6b9f2f1f9f7209d632db250cffa054830d9a"},
+	{"blowfish", "", "060dfa53cdb6b9c84732bfa29b39968ce7590bb0d249331084aa3a1c6a5b6afd60cd7876a68b5d0c3f3623cbbd18faf723f452451f908886157b97ec31e317566b2e2c409a978345d53d900f563407f8e99a7f72aee7e8f264c4f71e88b8acdf3ee131b10372ad11cd7c36142ffa92c8f5519d41"},
+	{"twofish", "", "414270279f9df285b2c055acc07f20f17c69ba9224016b785a6a59aea71c01042f64a236cd7ceb03b72f9af98a3fe3fe34e6c3a44b8e68a11c9badfda02d4623bd141cb73064d36e7cc97c4a1c796b6739fb902f811863eb213775a09305bc59115d059db84524887d8fb0b25eafed330550afbb"},
+	{"cast5", "", "20111b96344922700a055a10386eddd1d7c741e3c46bd55d433b88d8a13a958dedabe3fe8a302c50ae6efd512899d238933d7b81d88e21a7a078b477399be4b229535ab6b180bdaa5a8906e52cc7c21b091dd8eab7f652bd1ce9ab7d08380d1f93f5dd74413b1cdabda87f6d8e473e5552440464"},
+	{"3des", "", "dfabefde036a842f28c805cb56b80bd973b063d8656bc8abd7c0a7ff350aef7d203699725240f333cccedd1e63f5dde79e22dd1c32a2fb9d0e2f4dfaac7f0e79682972de805b26c80f76f96c7930c77f8438098902299e6d5746a1b1462437066be500a26e68fcf9fa1d78c950b48b0e798537d6"},
+	{"xtea", "", "3beb5670520a0dceb5ae565b6e3beea5c5f4b8fdbbb8f7e1cb4721026f8d17883e7f180a71d8661b4bec508985228d8e7936c2568b5a3e06b0042ba7cd9ccc19757644367ea66ea4b125620e1a7562df5c6f838b7efc21ce9fa222ad71c182e7e66c0f0f628fc0e6cf2f8b75e14c8f256e6e605c"},
+	{"camellia", "", "3500817f1de871aef14d4be29a63da683bf3b1ca13f1988f873ad66cdb77c71b0306231aa6be5ad9ea456b6d57614f32414663ef2c691cc44548e3cddade477a807bfd1937f682f256af3430f12311861888f72abc090fd0ae5339157a2332b39980065b85edac798bc8016f9e5543ec16d01955"},
+	{"camellia-128", "", "08ccccbab274e6ce19609f619976e86a2caa32b15fc10412727e5610ebc722604529536b10f132230ddecd58660dc758a52aba3803bfeb5cbb7e42b3c44e64938bd82e860c1d477c9fdbbd9656b7b3d0e27ce2e3309ccc538cdde881465eff7a6c52c1994da73ee46eaa20ad43a1cb9dfc8f9b38"},
+	{"camellia-192", "", "49079b8bb94065424e90041af6bd5fa15b229cc1e1be173b44ccbd0aa99d8d00053dba1096a587bfe24cc05552e76dbae43bde923469c22b7cad3a56f276270f54466c640c288266983dafb98f85652810f8648b4c2e01978cc7f5bf1545285843c3c65eb15ce688071c51375baf27587edbda53"},
+	{"aria", "", "3344a7f2087e5d87549a6061606180af94abf332ea51f1b1c48133bc37522bf34818593c4740db79de75a9c9d517855727c52e79a983791e3f85c16107ed5ea08843d04b3a37302ab09d6aedc7d3759a692b2289dcccf38f3adb7b51cd560323b0600a9b1993c7cc3094dd7ac681d3badb15d9d1"},
+	{"aria-128", "", "52ecd8638aa3d6276edabf2caaf148d7afbfc54cae41b388884a1843978384d8d84586851ac87d75a6e2ae63cfd72d7d5f2c2ec3d4edafcfb71b19c24a74e9ca94f53b12dd837d02e7da94721b0cf8e2d373927c5d71563010d0fcde74fe54748ad90446e87998fdefb8b8be24aafd61e8a05a19"},
+	{"aria-192", "", "b7daf1b3a05df010c4db6b0a8b276b8e2e1ab70f6701e55896927ee16d1d86631f88a86cdcf87f5732ef7157674f4929bf4fcd71574630b2eb643f00658645dd5611f61462e1e1eb04e29dd24c1bcc0b4c2f5cb2156c137b390de9ce872b3cf2be6bf0e0eb86d8a4ca2bb7b76493515edd372061"},
+	{"salsa20", "", "a0a1a2a3a4a5a6a76f0fbce4772835b896760812dbfe5df6cf36221f13bc695e646dfdf1ee0a60fac9adfe9ae41d24662b3a50217542ae351f13fe1829893c9f7475d4466c315b6d66a0732d67c580ae79003d77f102ff8ff1cac67216024c0338be42f819ffb1a5d0e03dc6e35594326c73b726"},
+	{"chacha20-poly1305", "", "a0a1a2a3abaaa9a8a7a6a5a526bca9e7847151af2ddfeb7018d3455121ceb057b47d242fda8c9a9dfee06b3c2235c7375525820ca02cce28cbcb33763238d0b2173434292d8fae64e24a441e0fcb800a2ca456443348077a527ea3e9265a111ffa4256379ebb40e9ca121b944842974339a4294438f8b3ec6e29ed603588d7bd"},
+	{"xchacha20-poly1305", "", "a0a1a2a3a4a5a6a7a8a9aaabacadaeafb7b6b5b4b3b2b1b1fce5f5663d568d7db786e2c8fec28776ac279828fc5126f2de1715c63fc410aed98d8998e54e15c2f3261663e086f4762bc164276af24c08601bdd48bbc666a5d8ae473790dd46a1f59bc1099af642cf51c5e80653b927b20a5c5c577e91e411740b32fe01792121575c9ffb2cd0fcb07a8b45dc"},
+	{"ascon128", "", "a0a1a2a3a4a5a6a7afaeadacabaaa9a9b2002de5311d9013e38397d232905b1e70752cd019e8f700ab849fd8e55cf11676f17f57beb8d3e4283c041cfe7b56e581675374d5ad79a073f39e9e7a1f0c87f9bbce3b75059750110bc277b978791338b79189a2599b5efe1efe499361b19596a76a0ab8639b6ef9dcdb4d1fb0915ff6ef1a9c"},
+	{"aes", MACHMACSHA256, "333d433b4a2982bfe5a5e7a201a085ff0a914a1355b94071d69044061995b52b03c2e5d105aa08f7476477918aabc86f6dccb40bd7e1df0fcb7965a8bc9c3072e1b98ab110458d847375ec9de97666033f484870307323601efe56fd55338b5e291b8619be85e71d0082065ff62f595361044905a08c93ad031770f0"},
+	{"aes", MACBLAKE2b, "333d433b4a2982bfe5a5e7a201a085ff0a914a1355b94071d69044061995b52b03c2e5d105aa08f7476477918aabc86f6dccb40bd7e1df0fcb7965a8bc9c3072e1b98ab110458d847375ec9de97666033f484870307323601efe56fd55338b5e291b8619be85e71d0082065fcc0a88d53f22354b7533f6fe36eb1eac"},
+}
+
+// layerAnswer is the packet of knownAnswerData sealed by the layers around a builtin cipher,
+// with the key knownAnswerKey and fixed nonces.
+type layerAnswer struct {
+	name   string
+	cipher func(key []byte) (Crypter, error)      // the cipher under the layers
+	wrap   func(crypter Crypter) (Crypter, error) // wraps the cipher with the layers
+	packet string                                 // hex encoded packet
+}
+
+// layerAnswers of the wire versions, the padding, the key IDs, the client IDs, the header
+// protection and the QPP pads, a change of them breaks the interoperability as well.
+var layerAnswers = []layerAnswer{
+	{"aes+wire-v2", knownCipher("aes"), wireV2Layer, "333d433b4a2982bf0f7f54b2406a3cc0a624c63dc6b2ce521cb3ed87fa70a0b8608e7f2ec180e59d7ffa8075e94d89e4821ccfd788c8966bc060215b2a6a2e184cf3151a8b6d113d14e18c86450d3a099a8e9aa776dbb3362902b5e3a601808929d49e6a166f94f12fc546d72d6da90d9515e473e939"},
+	{"aes-gcm+wire-v2", knownCipher("aes-gcm"), wireV2Layer, "b4a0a1a2a3abaaa9a8a7a6a5a53d22facfd4da0383c453beca6abbacfbe91b5266e589f299e69df0d59c5e2e253fa2adf7cb292200266dd6d8f659c54f893484855e6fc2da2c7a1742ca39735e0e2f8bed81c17adb8765666f8d472673f6756586861ec7eac3284f09aeea5cafe4e0285dbf6fbef9113c5cf67caaf5ec2cec1ec88c43"},
+	{"aes+hmac-sha256+wire-v2", knownCipher("aes"), func(crypter Crypter) (Crypter, error) {
+		mac, err := NewMACCrypt(crypter.(BlockCrypt), MACHMACSHA256, knownAnswerKey(), 16)
+		if err != nil {
+			return nil, err
+		}
+		return wireV2Layer(mac)
+	}, "b6333d433b4a2982bfe7a6e5a007a687fdc4a832c1475ee6bd472017f5498deb88f90ade387a9e80a930b7902bba4c12bc04fa5122475e3bf358e8f57f3dc92f1431b79e19d93ffe082b847efeba45a3a19d22a5ea921e2cc7e7e536e7bd57e59a6f9b4ee173ce2fb7cae027c75559c2608e8c211fd598682bd92d5e9e03ca"},
+	{"aes+padding", knownCipher("aes"), func(crypter Crypter) (Crypter, error) {
+		policy, err := BucketPadding(128, 256)
+		if err != nil {
+			return nil, err
+		}
+		return NewPaddingCrypt(crypter, policy, DefaultPaddingMTU)
+	}, "3b354b3342218ab71097cf30ff502face62b20aee839bc89f0c6e833d63a7eaecef9288f14df1d402301f6f6a81a95fd929f6ffd086abfd419d207b113741790e78ecf6143d1cd1f17db8bcf4c6de68a30506ea8ebc46ef3398c61d5d0476eafd288486ebdf922d17fb145fa4a99c3f5e0055ce01737da575867a424a6414a22"},
+	{"aes+key-id", knownCipher("aes"), func(crypter Crypter) (Crypter, error) {
+		return NewKeyring(0x07, crypter), nil
+	}, "07333d433b4a2982bf9f6a38bb81014c33da20fa2383793b2fc150a630687321e546f7f44586ac959a96c51e536d14c8c266db0b915d6232cce43cfa0a42bd2955345388028fa98415bb2d11645ad53b6cf61633a3e3b061224b846bd0742faa012f6fe44e2792ce401601104809e670dccf051586"},
+	{"aes+client-id", knownCipher("aes"), func(crypter Crypter) (Crypter, error) {
+		return NewClientCrypt(0x1234, crypter), nil
+	}, "3412333d433b4a2982bf9f6a38bb81014c33da20fa2383793b2fc150a630687321e546f7f44586ac959a96c51e536d14c8c266db0b915d6232cce43cfa0a42bd2955345388028fa98415bb2d11645ad53b6cf61633a3e3b061224b846bd0742faa012f6fe44e2792ce401601104809e670dccf051586"},
+	{"salsa20+header-protection", knownCipher("salsa20"), func(crypter Crypter) (Crypter, error) {
+		hp, err := NewHeaderProtection(knownAnswerKey()[:16])
+		if err != nil {
+			return nil, err
+		}
+		return &protectedCrypt{crypter, hp}, nil
+	}, "6a83d27d16d2cbb94e5d7cfedf4922582cee89688e50e39606540b7b36f7185b646dfdf1ee0a60fac9adfe9ae41d24662b3a50217542ae351f13fe1829893c9f7475d4466c315b6d66a0732d67c580ae79003d77f102ff8ff1cac67216024c0338be42f819ffb1a5d0e03dc6e35594326c73b726"},
+	{"qpp-64-pads", func(key []byte) (Crypter, error) {
+		return NewQPPCryptWithPads(key, 64)
+	}, nil, "a0a1a2a3a4a5a6a7bc99eca9503d6c49caec0a7da0301b974d59428bb0020898a0b70ab0e446c6de60efeb624f9603a7be32b102336d13d1599e6d19bcc739aa5e2b77da464aaf437643db6c8cee9df1b5896a20d794906f42ddf39d4c8c6ae243f4442e1c040dd00ef90295baae25c155083bf9"},
+}
+
+// knownCipher returns the constructor of the registered cipher.
+func knownCipher(method string) func(key []byte) (Crypter, error) {
+	return func(key []byte) (Crypter, error) { return NewCipher(method, key) }
+}
+
+// wireV2Layer emits the packets of the crypter in wire v2.
+func wireV2Layer(crypter Crypter) (Crypter, error) {
+	return NewVersionCrypt(crypter, WireV2)
+}
+
+// protectedCrypt masks the packets of the crypter by the header protection, as the hops do
+// on the sockets.
+type protectedCrypt struct {
+	crypter    Crypter
+	protection *HeaderProtection
+}
+
+// Destroy zeroes the keys of the crypter.
+func (c *protectedCrypt) Destroy() { Destroy(c.crypter) }
+
+func (c *protectedCrypt) isCrypter() {}
+
+func (c *protectedCrypt) SealPacket(data []byte) []byte {
+	return c.protection.mask(encryptPacket(c.crypter, data))
+}
+
+func (c *protectedCrypt) OpenPacket(packet []byte) ([]byte, error) {
+	return decryptPacket(c.crypter, c.protection.mask(packet))
+}
+
+// knownAnswerKey returns the key 00 01 02 .. 1f of the known answers.
+func knownAnswerKey() []byte {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	return key
+}
+
+// knownAnswerData returns the data 00 01 02 .. 63 of the known answers, its packets
+// end with partial blocks of all the ciphers.
+func knownAnswerData() []byte {
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	return data
+}
+
+func (ka *knownAnswer) String() string {
+	if ka.mac == "" {
+		return ka.method
+	}
+	return ka.method + "+" + ka.mac
+}
+
+// crypter creates the crypter of the known answer.
+func (ka *knownAnswer) crypter() (Crypter, error) {
+	crypter, err := NewCipher(ka.method, knownAnswerKey())
+	if err != nil || ka.mac == "" {
+		return crypter, err
+	}
+	block, ok := crypter.(BlockCrypt)
+	if !ok {
+		return nil, errors.Wrap(errMACCrypter, ka.method)
+	}
+	return NewMACCrypt(block, ka.mac, knownAnswerKey(), 16)
+}
+
+// SelfTest checks the builtin ciphers, macs and layers against known answers, then seals and
+// opens a packet with each of them. A failure means an implementation changed or misbehaves,
+// and the hop won't interoperate with others.
+func SelfTest() error {
+	for _, ka := range knownAnswers {
+		if err := ka.check(); err != nil {
+			return err
+		}
+	}
+	for _, la := range layerAnswers {
+		if err := la.check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check opens the known answer packet, then seals and opens the data.
+func (ka *knownAnswer) check() error {
+	crypter, err := ka.crypter()
+	if err != nil {
+		return errors.Wrapf(errSelfTest, "%v: %v", ka, err)
+	}
+	defer Destroy(crypter)
+
+	packet, err := hex.DecodeString(ka.packet)
+	if err != nil {
+		return errors.Wrapf(errSelfTest, "%v: %v", ka, err)
+	}
+	if data, err := decryptPacket(crypter, packet); err != nil || !bytes.Equal(data, knownAnswerData()) {
+		return errors.Wrapf(errSelfTest, "%v: known answer mismatch", ka)
+	}
+
+	packet = encryptPacket(crypter, knownAnswerData())
+	if data, err := decryptPacket(crypter, packet); err != nil || !bytes.Equal(data, knownAnswerData()) {
+		return errors.Wrapf(errSelfTest, "%v: round trip failed", ka)
+	}
+	return nil
+}
+
+// crypter creates the crypter of the layer answer.
+func (la *layerAnswer) crypter() (Crypter, error) {
+	crypter, err := la.cipher(knownAnswerKey())
+	if err != nil || la.wrap == nil {
+		return crypter, err
+	}
+	wrapped, err := la.wrap(crypter)
+	if err != nil {
+		Destroy(crypter)
+		return nil, err
+	}
+	return wrapped, nil
+}
+
+// check opens the layer answer packet, then seals and opens the data.
+func (la *layerAnswer) check() error {
+	crypter, err := la.crypter()
+	if err != nil {
+		return errors.Wrapf(errSelfTest, "%v: %v", la.name, err)
+	}
+	defer Destroy(crypter)
+
+	packet, err := hex.DecodeString(la.packet)
+	if err != nil {
+		return errors.Wrapf(errSelfTest, "%v: %v", la.name, err)
+	}
+	if data, err := decryptPacket(crypter, packet); err != nil || !bytes.Equal(data, knownAnswerData()) {
+		return errors.Wrapf(errSelfTest, "%v: known answer mismatch", la.name)
+	}
+
+	packet = encryptPacket(crypter, knownAnswerData())
+	if data, err := decryptPacket(crypter, packet); err != nil || !bytes.Equal(data, knownAnswerData()) {
+		return errors.Wrapf(errSelfTest, "%v: round trip failed", la.name)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"testing"
+)
+
+// fixedNonces reads the bytes a0 a1 a2 .. as the random source of nonces.
+type fixedNonces struct{ next byte }
+
+func (r *fixedNonces) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0xa0 + r.next
+		r.next++
+	}
+	return len(b), nil
+}
+
+// fixedNonceBlock is a BlockCrypt drawing its nonces from fixedNonces.
+type fixedNonceBlock struct {
+	BlockCrypt
+	nonces *fixedNonces
+}
+
+func (c fixedNonceBlock) nonceReader() io.Reader { return c.nonces }
+
+// Destroy zeroes the keys of the crypter.
+func (c fixedNonceBlock) Destroy() { Destroy(c.BlockCrypt) }
+
+// fixNonces makes the crypter draw its nonces from fixedNonces.
+func fixNonces(t *testing.T, name string, crypter Crypter) Crypter {
+	nonces := new(fixedNonces)
+	switch c := crypter.(type) {
+	case *aeadCrypt:
+		// redraw the nonce prefix and the initial counter
+		var counter [8]byte
+		_, _ = io.ReadFull(nonces, c.prefix)
+		_, _ = io.ReadFull(nonces, counter[:])
+		c.counter.Store(binary.LittleEndian.Uint64(counter[:]))
+		return c
+	case BlockCrypt:
+		return fixedNonceBlock{c, nonces}
+	}
+	t.Fatalf("%v: unexpected crypter %T", name, crypter)
+	return nil
+}
+
+// fixedNonceCrypter creates the crypter of the known answer with fixed nonces, the
+// crypter returned by ka.crypter() is kept for Destroy.
+func fixedNonceCrypter(t *testing.T, ka *knownAnswer) (fixed, crypter Crypter) {
+	crypter, err := NewCipher(ka.method, knownAnswerKey())
+	if err != nil {
+		t.Fatal(ka, err)
+	}
+
+	fixed = fixNonces(t, ka.String(), crypter)
+	if ka.mac != "" {
+		if fixed, err = NewMACCrypt(fixed.(BlockCrypt), ka.mac, knownAnswerKey(), 16); err != nil {
+			t.Fatal(ka, err)
+		}
+		crypter = fixed
+	}
+	return fixed, crypter
+}
+
+// sealKnownAnswer creates the crypter and seals knownAnswerData with fixed nonces.
+func sealKnownAnswer(t *testing.T, ka *knownAnswer) string {
+	fixed, crypter := fixedNonceCrypter(t, ka)
+	defer Destroy(crypter)
+	return hex.EncodeToString(encryptPacket(fixed, knownAnswerData()))
+}
+
+func TestKnownAnswers(t *testing.T) {
+	for _, ka := range knownAnswers {
+		if packet := sealKnownAnswer(t, &ka); packet != ka.packet {
+			t.Fatalf("%v: sealed %v, expected %v", &ka, packet, ka.packet)
+		}
+		if err := ka.check(); err != nil {
+			t.Fatal(err)
+		}
+
+		// a flipped bit fails the checksum or the tag
+		packet, _ := hex.DecodeString(ka.packet)
+		packet[len(packet)/2] ^= 1
+		corrupted := knownAnswer{ka.method, ka.mac, hex.EncodeToString(packet)}
+		if err := corrupted.check(); err == nil {
+			t.Fatalf("%v: corrupted known answer passed", &ka)
+		}
+	}
+
+	if err := SelfTest(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestKnownAnswerOpenSSL cross-checks the local CFB mode of the known answers,
+// which are the packet | a0..a7 | md5(data)[:8] | data | encrypted by e.g.:
+//
+//	openssl enc -aes-256-cfb -nopad -K 000102..1f -iv 9da341b02cdb39798f5000ef98e4f0fe
+func TestKnownAnswerOpenSSL(t *testing.T) {
+	openssl := map[string]string{
+		"aes":      "333d433b4a2982bf9f6a38bb81014c33da20fa2383793b2fc150a630687321e5",
+		"camellia": "3500817f1de871aef14d4be29a63da683bf3b1ca13f1988f873ad66cdb77c71b",
+		"aria":     "3344a7f2087e5d87549a6061606180af94abf332ea51f1b1c48133bc37522bf3",
+	}
+	for _, ka := range knownAnswers {
+		if prefix, ok := openssl[ka.method]; ok && ka.mac == "" {
+			if ka.packet[:len(prefix)] != prefix {
+				t.Fatalf("%v known answer differs from openssl", ka.method)
+			}
+			delete(openssl, ka.method)
+		}
+	}
+	if len(openssl) > 0 {
+		t.Fatal("missing known answers", openssl)
+	}
+}
+
+func TestLayerAnswers(t *testing.T) {
+	for _, la := range layerAnswers {
+		cipher, err := la.cipher(knownAnswerKey())
+		if err != nil {
+			t.Fatal(la.name, err)
+		}
+		crypter := fixNonces(t, la.name, cipher)
+		if la.wrap != nil {
+			if crypter, err = la.wrap(crypter); err != nil {
+				t.Fatal(la.name, err)
+			}
+		}
+		packet := hex.EncodeToString(encryptPacket(crypter, knownAnswerData()))
+		Destroy(crypter)
+		if packet != la.packet {
+			t.Fatalf("%v: sealed %v, expected %v", la.name, packet, la.packet)
+		}
+		if err := la.check(); err != nil {
+			t.Fatal(err)
+		}
+
+		// a flipped bit fails the checksum or the tag
+		raw, _ := hex.DecodeString(la.packet)
+		raw[len(raw)/2] ^= 1
+		corrupted := layerAnswer{la.name, la.cipher, la.wrap, hex.EncodeToString(raw)}
+		if err := corrupted.check(); err == nil {
+			t.Fatalf("%v: corrupted known answer passed", la.name)
+		}
+	}
+}
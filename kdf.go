@@ -0,0 +1,145 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"crypto/hkdf"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// KDFPBKDF2SHA1 derives keys by PBKDF2-SHA1, the default for compatibility.
+	KDFPBKDF2SHA1 = "pbkdf2-sha1"
+	// KDFPBKDF2SHA256 derives keys by PBKDF2-SHA256.
+	KDFPBKDF2SHA256 = "pbkdf2-sha256"
+	// KDFArgon2id derives keys by Argon2id, recommended for passphrases.
+	KDFArgon2id = "argon2id"
+	// KDFScrypt derives keys by scrypt.
+	KDFScrypt = "scrypt"
+	// KDFHKDFSHA256 expands keys by HKDF-SHA256, only for secrets of full entropy.
+	KDFHKDFSHA256 = "hkdf-sha256"
+	// KDFRawHex decodes the secret as a hex encoded key of the exact key length.
+	KDFRawHex = "raw-hex"
+
+	// DefaultSalt is the salt used if not specified, shared by all deployments using it.
+	DefaultSalt = "GRASSHOPPER"
+
+	// default costs, compatible with the keys derived by earlier versions for PBKDF2
+	defaultPBKDF2Iterations  = 4096
+	defaultArgon2Iterations  = 3
+	defaultArgon2Memory      = 64 * 1024 // KiB
+	defaultArgon2Parallelism = 4
+	defaultScryptN           = 1 << 15
+	defaultScryptR           = 8
+	defaultScryptP           = 1
+)
+
+var (
+	errKDFMethod = errors.New("unsupported kdf method")
+	errRawKey    = errors.New("invalid raw key")
+)
+
+// KDFParams defines the salt and cost parameters of DeriveKey, zero fields take the defaults.
+type KDFParams struct {
+	// Salt defaults to DefaultSalt, a unique salt per deployment is recommended.
+	Salt []byte
+
+	// Iterations is the iteration count of PBKDF2(default 4096), the time cost of
+	// Argon2id(default 3), or the CPU/memory cost N of scrypt(default 32768, a power of 2).
+	Iterations int
+
+	// Memory is the memory cost of Argon2id in KiB(default 65536), or the block size r
+	// of scrypt(default 8).
+	Memory int
+
+	// Parallelism is the number of threads of Argon2id(default 4), or the
+	// parallelization p of scrypt(default 1).
+	Parallelism int
+}
+
+// KDFs returns the supported key derivation functions.
+func KDFs() []string {
+	return []string{KDFPBKDF2SHA1, KDFPBKDF2SHA256, KDFArgon2id, KDFScrypt, KDFHKDFSHA256, KDFRawHex}
+}
+
+// DeriveKey derives a key of keyLen bytes from secret with the kdf, params may be nil
+// to take the defaults. The CLI derives the keys of ki, ko and the clients by it.
+func DeriveKey(kdf string, secret string, params *KDFParams, keyLen int) ([]byte, error) {
+	var p KDFParams
+	if params != nil {
+		p = *params
+	}
+	salt := p.Salt
+	if len(salt) == 0 {
+		salt = []byte(DefaultSalt)
+	}
+
+	switch kdf {
+	case KDFPBKDF2SHA1, KDFPBKDF2SHA256:
+		h := sha1.New
+		if kdf == KDFPBKDF2SHA256 {
+			h = sha256.New
+		}
+		return pbkdf2.Key([]byte(secret), salt, orDefault(p.Iterations, defaultPBKDF2Iterations), keyLen, h), nil
+	case KDFArgon2id:
+		parallelism := orDefault(p.Parallelism, defaultArgon2Parallelism)
+		if parallelism > 255 {
+			return nil, errors.Errorf("invalid argon2id parallelism %d", parallelism)
+		}
+		return argon2.IDKey([]byte(secret), salt,
+			uint32(orDefault(p.Iterations, defaultArgon2Iterations)),
+			uint32(orDefault(p.Memory, defaultArgon2Memory)),
+			uint8(parallelism), uint32(keyLen)), nil
+	case KDFScrypt:
+		key, err := scrypt.Key([]byte(secret), salt,
+			orDefault(p.Iterations, defaultScryptN),
+			orDefault(p.Memory, defaultScryptR),
+			orDefault(p.Parallelism, defaultScryptP), keyLen)
+		return key, errors.WithStack(err)
+	case KDFHKDFSHA256:
+		key, err := hkdf.Key(sha256.New, []byte(secret), salt, "grasshopper", keyLen)
+		return key, errors.WithStack(err)
+	case KDFRawHex:
+		key, err := hex.DecodeString(secret)
+		if err != nil || len(key) != keyLen {
+			return nil, errors.Wrapf(errRawKey, "expected %d hex encoded bytes", keyLen)
+		}
+		return key, nil
+	default:
+		return nil, errors.Wrap(errKDFMethod, kdf)
+	}
+}
+
+func orDefault(v, def int) int {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
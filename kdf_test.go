@@ -0,0 +1,112 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func TestDeriveKeyCompatible(t *testing.T) {
+	// the keys derived by earlier versions
+	want := pbkdf2.Key([]byte("it's a secret"), []byte("GRASSHOPPER"), 4096, 32, sha1.New)
+	key, err := DeriveKey(KDFPBKDF2SHA1, "it's a secret", nil, 32)
+	if err != nil || !bytes.Equal(key, want) {
+		t.Fatal("default pbkdf2-sha1 mismatch", err)
+	}
+}
+
+func TestDeriveKeyVectors(t *testing.T) {
+	vectors := []struct {
+		kdf    string
+		secret string
+		params *KDFParams
+		keyLen int
+		want   string
+	}{
+		// RFC 6070
+		{KDFPBKDF2SHA1, "password", &KDFParams{Salt: []byte("salt"), Iterations: 4096}, 20, "4b007901b765489abead49d926f721d065a429c1"},
+		// RFC 7914 section 11
+		{KDFPBKDF2SHA256, "passwd", &KDFParams{Salt: []byte("salt"), Iterations: 1}, 64, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		// RFC 7914 section 12
+		{KDFScrypt, "password", &KDFParams{Salt: []byte("NaCl"), Iterations: 1024, Memory: 8, Parallelism: 16}, 64, "fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b3731622eaf30d92e22a3886ff109279d9830dac727afb94a83ee6d8360cbdfa2cc0640"},
+		{KDFRawHex, "000102030405060708090a0b0c0d0e0f", nil, 16, "000102030405060708090a0b0c0d0e0f"},
+	}
+
+	for _, v := range vectors {
+		key, err := DeriveKey(v.kdf, v.secret, v.params, v.keyLen)
+		if err != nil {
+			t.Fatal(v.kdf, err)
+		}
+		if hex.EncodeToString(key) != v.want {
+			t.Fatalf("%s: got %x, want %s", v.kdf, key, v.want)
+		}
+	}
+}
+
+func TestDeriveKeySalt(t *testing.T) {
+	// cheap costs for testing
+	costs := map[string]KDFParams{
+		KDFPBKDF2SHA1:   {Iterations: 1},
+		KDFPBKDF2SHA256: {Iterations: 1},
+		KDFArgon2id:     {Iterations: 1, Memory: 64, Parallelism: 1},
+		KDFScrypt:       {Iterations: 2, Memory: 1, Parallelism: 1},
+		KDFHKDFSHA256:   {},
+	}
+
+	for kdf, params := range costs {
+		key1, err := DeriveKey(kdf, "secret", &params, 32)
+		if err != nil {
+			t.Fatal(kdf, err)
+		}
+		key2, _ := DeriveKey(kdf, "secret", &params, 32)
+		params.Salt = []byte("deployment salt")
+		key3, _ := DeriveKey(kdf, "secret", &params, 32)
+
+		if len(key1) != 32 || !bytes.Equal(key1, key2) {
+			t.Fatal(kdf, "not deterministic")
+		}
+		if bytes.Equal(key1, key3) {
+			t.Fatal(kdf, "salt ignored")
+		}
+	}
+}
+
+func TestDeriveKeyErrors(t *testing.T) {
+	if _, err := DeriveKey("md5", "secret", nil, 32); err == nil {
+		t.Fatal("unknown kdf accepted")
+	}
+	if _, err := DeriveKey(KDFRawHex, "0011", nil, 32); err == nil {
+		t.Fatal("short raw key accepted")
+	}
+	if _, err := DeriveKey(KDFRawHex, "not hex", nil, 32); err == nil {
+		t.Fatal("invalid hex accepted")
+	}
+	if _, err := DeriveKey(KDFScrypt, "secret", &KDFParams{Iterations: 3}, 32); err == nil {
+		t.Fatal("invalid scrypt cost accepted")
+	}
+}
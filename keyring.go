@@ -0,0 +1,162 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// keyIDSize defines the size of the key ID prepended to the packets of a keyring.
+	// | key id(1 byte) | packet of the key |
+	keyIDSize = 1
+)
+
+var (
+	errUnknownKey = errors.New("unknown key id")
+	errCurrentKey = errors.New("can't remove the current key")
+)
+
+// Keyring holds a set of active keys identified by a short key ID on the wire,
+// packets are encrypted with the current key, and decrypted with the key named
+// in the packet. It allows a chain to roll keys hop by hop without losing packets:
+//
+//  1. Add the new key on both ends of a link, both keys are accepted.
+//  2. Use the new key on both ends, in any order.
+//  3. Remove the old key on both ends, once the packets in flight are drained.
+//
+// Keys can be added, used and removed at runtime, while the keyring is in use. The crypters
+// removed or replaced are destroyed, see Destroyer.
+type Keyring struct {
+	crypters map[byte]Crypter
+	current  byte
+	mu       sync.RWMutex
+}
+
+// NewKeyring creates a keyring with the key `id` as the current key, the crypter
+// may be nil to leave the packets unencrypted.
+func NewKeyring(id byte, crypter Crypter) *Keyring {
+	k := new(Keyring)
+	k.crypters = map[byte]Crypter{id: crypter}
+	k.current = id
+	return k
+}
+
+// Add adds or replaces the key `id`, packets encrypted by it are accepted from now on.
+func (k *Keyring) Add(id byte, crypter Crypter) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if old, ok := k.crypters[id]; ok && old != crypter {
+		Destroy(old)
+	}
+	k.crypters[id] = crypter
+}
+
+// Use makes the key `id` current, which must have been added.
+func (k *Keyring) Use(id byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.crypters[id]; !ok {
+		return errors.WithStack(errUnknownKey)
+	}
+	k.current = id
+	return nil
+}
+
+// Remove removes the key `id`, packets encrypted by it are rejected from now on.
+func (k *Keyring) Remove(id byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if id == k.current {
+		return errors.WithStack(errCurrentKey)
+	}
+	crypter, ok := k.crypters[id]
+	if !ok {
+		return errors.WithStack(errUnknownKey)
+	}
+	Destroy(crypter)
+	delete(k.crypters, id)
+	return nil
+}
+
+// Destroy zeroes the keys of all the crypters, the keyring must not be used afterwards.
+func (k *Keyring) Destroy() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, crypter := range k.crypters {
+		Destroy(crypter)
+	}
+}
+
+// Current returns the ID of the current key.
+func (k *Keyring) Current() byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current
+}
+
+// IDs returns the IDs of the active keys in ascending order.
+func (k *Keyring) IDs() []byte {
+	k.mu.RLock()
+	ids := make([]byte, 0, len(k.crypters))
+	for id := range k.crypters {
+		ids = append(ids, id)
+	}
+	k.mu.RUnlock()
+	slices.Sort(ids)
+	return ids
+}
+
+// SealPacket encrypts data with the current key, prepending its ID. The lock is held until
+// encrypted, so the key is not destroyed meanwhile.
+func (k *Keyring) isCrypter() {}
+
+func (k *Keyring) SealPacket(data []byte) []byte {
+	k.mu.RLock()
+	id := k.current
+	sealed := encryptPacket(k.crypters[id], data)
+	k.mu.RUnlock()
+
+	packet := make([]byte, keyIDSize+len(sealed))
+	packet[0] = id
+	copy(packet[keyIDSize:], sealed)
+	return packet
+}
+
+// OpenPacket decrypts the packet with the key named in it.
+func (k *Keyring) OpenPacket(packet []byte) ([]byte, error) {
+	if len(packet) < keyIDSize {
+		return nil, errShortPacket
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	crypter, ok := k.crypters[packet[0]]
+	if !ok {
+		return nil, errUnknownKey
+	}
+	return decryptPacket(crypter, packet[keyIDSize:])
+}
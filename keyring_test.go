@@ -0,0 +1,115 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeyring(t *testing.T) {
+	key1, key2 := make([]byte, 32), make([]byte, 32)
+	key2[0] = 1
+	aes, _ := NewAESBlockCrypt(key1)
+	gcm, _ := NewAESGCMCrypt(key2)
+
+	sender := NewKeyring(1, aes)
+	receiver := NewKeyring(1, aes)
+	data := []byte("hello")
+
+	packet := encryptPacket(sender, data)
+	if packet[0] != 1 {
+		t.Fatal("unexpected key id", packet[0])
+	}
+	if out, err := decryptPacket(receiver, packet); err != nil || !bytes.Equal(out, data) {
+		t.Fatal("decrypt failed", err)
+	}
+
+	// rotate the sender first, the receiver accepts both keys
+	receiver.Add(2, gcm)
+	sender.Add(2, gcm)
+	if err := sender.Use(2); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := decryptPacket(receiver, encryptPacket(sender, data)); err != nil || !bytes.Equal(out, data) {
+		t.Fatal("decrypt with the new key failed", err)
+	}
+	if out, err := decryptPacket(receiver, encryptPacket(NewKeyring(1, aes), data)); err != nil || !bytes.Equal(out, data) {
+		t.Fatal("decrypt with the old key failed", err)
+	}
+
+	if err := receiver.Remove(1); err == nil {
+		t.Fatal("removed the current key")
+	}
+	if err := receiver.Use(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := receiver.Remove(1); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(receiver.IDs(), []byte{2}) || receiver.Current() != 2 {
+		t.Fatal("unexpected keys", receiver.IDs(), receiver.Current())
+	}
+
+	// the old key is rejected
+	if _, err := decryptPacket(receiver, encryptPacket(NewKeyring(1, aes), data)); err != errUnknownKey {
+		t.Fatal("expected errUnknownKey, got", err)
+	}
+	if err := receiver.Use(3); err == nil {
+		t.Fatal("used an unknown key")
+	}
+	if _, err := decryptPacket(receiver, nil); err != errShortPacket {
+		t.Fatal("expected errShortPacket, got", err)
+	}
+}
+
+func TestKeyringDestroy(t *testing.T) {
+	key1, _ := NewSalsa20BlockCrypt(pass[:32])
+	key2, _ := NewSalsa20BlockCrypt(pass[:32])
+	key3, _ := NewSalsa20BlockCrypt(pass[:32])
+	keyring := NewKeyring(1, key1)
+	keyring.Add(2, key2)
+
+	// adding the same crypter again keeps it
+	keyring.Add(1, key1)
+	if isZero(key1.(*salsa20BlockCrypt).key[:]) {
+		t.Fatal("key destroyed when added again")
+	}
+
+	// the keys replaced and removed are destroyed
+	keyring.Add(2, key3)
+	if !isZero(key2.(*salsa20BlockCrypt).key[:]) {
+		t.Fatal("replaced key not destroyed")
+	}
+	if err := keyring.Remove(2); err != nil {
+		t.Fatal(err)
+	}
+	if !isZero(key3.(*salsa20BlockCrypt).key[:]) {
+		t.Fatal("removed key not destroyed")
+	}
+
+	keyring.Destroy()
+	if !isZero(key1.(*salsa20BlockCrypt).key[:]) {
+		t.Fatal("current key not destroyed")
+	}
+}
@@ -0,0 +1,181 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// MACHMACSHA256 selects HMAC-SHA256 as the packet MAC.
+	MACHMACSHA256 = "hmac-sha256"
+	// MACBLAKE2b selects keyed BLAKE2b-512 as the packet MAC.
+	MACBLAKE2b = "blake2b"
+
+	// minTagSize defines the shortest MAC tag accepted.
+	minTagSize = 8
+
+	// macNonceSize defines the size of the nonce encrypted along with the data.
+	macNonceSize = nonceSize
+)
+
+var (
+	errMACMethod  = errors.New("unsupported mac method")
+	errMACTagSize = errors.New("invalid mac tag size")
+	errMACCrypter = errors.New("mac requires a non-authenticated crypter")
+)
+
+// macCrypt adds encrypt-then-MAC integrity to a BlockCrypt, packets are framed as
+// | E(nonce(8) | data) | tag |, where the tag is computed over the ciphertext with
+// a key independent from the cipher key.
+type macCrypt struct {
+	block   BlockCrypt
+	tagSize int
+	size    int       // output size of the hash
+	key     []byte    // allocated by NewSecret
+	hashes  sync.Pool // keyed hash.Hash
+	destroy sync.Once
+}
+
+// NewMACCrypt wraps crypter with a keyed MAC, mac is one of MACHMACSHA256 or MACBLAKE2b,
+// key must be derived separately from the cipher key, and tagSize is the number
+// of MAC bytes appended to each packet.
+func NewMACCrypt(crypter BlockCrypt, mac string, key []byte, tagSize int) (AEADCrypt, error) {
+	if crypter == nil {
+		return nil, errors.WithStack(errMACCrypter)
+	}
+	if _, ok := crypter.(PacketCrypt); ok {
+		return nil, errors.WithStack(errMACCrypter)
+	}
+
+	c := new(macCrypt)
+	c.block = crypter
+	switch mac {
+	case MACHMACSHA256:
+		c.size = sha256.Size
+		c.hashes.New = func() any { return hmac.New(sha256.New, c.key) }
+	case MACBLAKE2b:
+		if _, err := blake2b.New512(key); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		c.size = blake2b.Size
+		c.hashes.New = func() any { h, _ := blake2b.New512(c.key); return h }
+	default:
+		return nil, errors.Wrap(errMACMethod, mac)
+	}
+
+	if tagSize < minTagSize || tagSize > c.size {
+		return nil, errors.WithStack(errMACTagSize)
+	}
+	c.tagSize = tagSize
+	c.key = cloneSecret(key)
+	return c, nil
+}
+
+func (c *macCrypt) isCrypter()                    {}
+func (c *macCrypt) SealPacket(data []byte) []byte { return sealPacket(c, data, nil) }
+
+func (c *macCrypt) OpenPacket(packet []byte) ([]byte, error) { return openPacket(c, packet, nil) }
+
+// Destroy zeroes the keys of the crypter and the MAC key, the keyed hashes already
+// created are opaque.
+func (c *macCrypt) Destroy() {
+	Destroy(c.block)
+	c.destroy.Do(func() { WipeSecret(c.key) })
+}
+
+// NonceSize returns 0, the nonce is carried inside the encrypted body.
+func (c *macCrypt) NonceSize() int     { return 0 }
+func (c *macCrypt) Overhead() int      { return macNonceSize + c.tagSize }
+func (c *macCrypt) FillNonce(_ []byte) {}
+
+// sum computes the tag of the additional data and ciphertext, appended to b.
+// The additional data goes in as its keyed digest, so the tags with additional
+// data never collide with the tags of other ciphertexts.
+func (c *macCrypt) sum(b, additionalData, ciphertext []byte) []byte {
+	h := c.hashes.Get().(hash.Hash)
+	h.Reset()
+	if len(additionalData) > 0 {
+		var digest [blake2b.Size]byte
+		h.Write(additionalData)
+		d := h.Sum(digest[:0])
+		h.Reset()
+		h.Write(d)
+	}
+	h.Write(ciphertext)
+	b = h.Sum(b)
+	c.hashes.Put(h)
+	return b
+}
+
+func (c *macCrypt) Seal(dst, _, plaintext, additionalData []byte) []byte {
+	ret, out := sliceForAppend(dst, macNonceSize+len(plaintext)+c.tagSize)
+	body := out[:macNonceSize+len(plaintext)]
+	copy(body[macNonceSize:], plaintext)
+	_, _ = io.ReadFull(nonceReader(c.block), body[:macNonceSize])
+	c.block.Encrypt(body, body)
+
+	var tag [blake2b.Size]byte
+	copy(out[len(body):], c.sum(tag[:0], additionalData, body))
+	return ret
+}
+
+// Open verifies the tag in constant time before decrypting, ciphertext is
+// decrypted in place.
+func (c *macCrypt) Open(dst, _, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < c.Overhead() {
+		return nil, errShortPacket
+	}
+
+	body := ciphertext[:len(ciphertext)-c.tagSize]
+	var tag [blake2b.Size]byte
+	if !hmac.Equal(c.sum(tag[:0], additionalData, body)[:c.tagSize], ciphertext[len(body):]) {
+		return nil, errAuthFailed
+	}
+
+	c.block.Decrypt(body, body)
+	ret, out := sliceForAppend(dst, len(body)-macNonceSize)
+	copy(out, body[macNonceSize:])
+	return ret, nil
+}
+
+// sliceForAppend takes a slice and a requested number of bytes. It returns a
+// slice with the contents of the given slice followed by that many bytes and a
+// second slice that aliases into it and contains only the extra bytes.
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
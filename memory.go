@@ -0,0 +1,173 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// secretSize is the size of the slots of the locked memory, the secrets larger than
+// a slot are allocated on the heap.
+const secretSize = 64
+
+// secrets allocates the secrets in slots of locked pages, a page is unlocked and its memory
+// is returned to the system once all its slots are free, and locked again when it's reused.
+var secrets struct {
+	pages []*secretPage
+	err   error // the first error locking the pages
+	mu    sync.Mutex
+}
+
+// secretPage is a page of slots for the secrets.
+type secretPage struct {
+	mem  []byte
+	used []bool // the slots in use
+	n    int    // the number of slots in use, the page is released at 0
+}
+
+// Destroyer is implemented by the crypters holding secrets. Destroy zeroes the key material
+// held by this package, of the crypter and the crypters it wraps, the crypter must not be
+// used afterwards. Destroying a crypter again does nothing.
+//
+// The key material held by this package is the keys of salsa20 and qpp, the key schedules
+// of camellia, aria and ascon128, the MAC keys, the mark keys of wire v2, the PSKs and the
+// keys of the handshake sessions. The states derived from the keys by the standard library
+// and the vendored packages can't be reached, they are neither locked nor zeroed, and left
+// to the garbage collector: the key schedules of AES, SM4, TEA, XTEA, Blowfish, Twofish,
+// CAST5 and 3DES, the states of AES-GCM, ChaCha20-Poly1305 and XChaCha20-Poly1305, the
+// keyed hashes of the MACs and the permutation pads of qpp.
+type Destroyer interface {
+	Destroy()
+}
+
+// Destroy zeroes the keys held by crypter if it's a Destroyer, crypter may be nil.
+func Destroy(crypter Crypter) {
+	if d, ok := crypter.(Destroyer); ok {
+		d.Destroy()
+	}
+}
+
+// NewSecret returns a zeroed buffer of n bytes for key material, to be released by
+// WipeSecret. On Linux, the buffers of up to 64 bytes are locked into memory by mlock,
+// so they are never swapped out, and excluded from core dumps. Elsewhere, or if the
+// memory can't be allocated, it returns an ordinary slice, see SecretLockError.
+func NewSecret(n int) []byte {
+	if n <= 0 || n > secretSize {
+		return make([]byte, n)
+	}
+
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+	page := availablePage()
+	if page == nil {
+		mem, err := allocPage()
+		if err != nil && secrets.err == nil {
+			secrets.err = err
+		}
+		if mem == nil {
+			return make([]byte, n)
+		}
+		page = &secretPage{mem: mem, used: make([]bool, len(mem)/secretSize)}
+		secrets.pages = append(secrets.pages, page)
+	} else if page.n == 0 {
+		if err := lockPage(page.mem); err != nil && secrets.err == nil {
+			secrets.err = err
+		}
+	}
+
+	for i, used := range page.used {
+		if !used {
+			page.used[i] = true
+			page.n++
+			off := i * secretSize
+			return page.mem[off : off+n : off+n]
+		}
+	}
+	panic("unreachable")
+}
+
+// availablePage returns a page with a free slot, preferring the pages in use to the
+// released ones, nil if all the pages are full.
+func availablePage() *secretPage {
+	var released *secretPage
+	for _, page := range secrets.pages {
+		if page.n == 0 {
+			if released == nil {
+				released = page
+			}
+		} else if page.n < len(page.used) {
+			return page
+		}
+	}
+	return released
+}
+
+// WipeSecret zeroes secret, and releases it if it's been allocated by NewSecret,
+// so it must not be used afterwards. Any other slice is zeroed only. A secret must
+// be wiped once, since its slot may be reused by another secret afterwards, so the
+// crypters wipe their keys once however many times they're destroyed.
+//
+// The page of the last secret released in it is unlocked and its memory returned to the
+// system, the page stays mapped, reading as zeros, so wiping a secret again is harmless.
+func WipeSecret(secret []byte) {
+	clear(secret)
+	if len(secret) == 0 || len(secret) > secretSize {
+		return
+	}
+
+	p := uintptr(unsafe.Pointer(unsafe.SliceData(secret)))
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+	for _, page := range secrets.pages {
+		off := int(p - uintptr(unsafe.Pointer(unsafe.SliceData(page.mem))))
+		if off < 0 || off >= len(page.mem) {
+			continue
+		}
+		i := off / secretSize
+		if off%secretSize != 0 || !page.used[i] {
+			return // not a slot, or released already
+		}
+		page.used[i] = false
+		page.n--
+		if page.n == 0 {
+			releasePage(page.mem)
+		}
+		return
+	}
+}
+
+// SecretLockError returns the first error locking the memory of the secrets, nil if
+// all the secrets allocated by NewSecret so far are locked.
+func SecretLockError() error {
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+	return secrets.err
+}
+
+// cloneSecret returns a copy of key allocated by NewSecret.
+func cloneSecret(key []byte) []byte {
+	secret := NewSecret(len(key))
+	copy(secret, key)
+	return secret
+}
@@ -0,0 +1,55 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// allocPage maps a page for the secrets, excluded from core dumps and locked into memory.
+// The page is returned along with the error if it can't be locked, e.g. by RLIMIT_MEMLOCK.
+func allocPage() ([]byte, error) {
+	page, err := unix.Mmap(-1, 0, os.Getpagesize(), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return nil, errors.Wrap(err, "mmap")
+	}
+	if err := unix.Madvise(page, unix.MADV_DONTDUMP); err != nil {
+		return page, errors.Wrap(err, "madvise")
+	}
+	return page, lockPage(page)
+}
+
+// lockPage locks a page of the secrets into memory.
+func lockPage(page []byte) error {
+	return errors.Wrap(unix.Mlock(page), "mlock")
+}
+
+// releasePage unlocks a page of the secrets whose slots are all free, and returns its memory
+// to the system, the mapping is kept and reads as zeros until the page is reused.
+func releasePage(page []byte) {
+	_ = unix.Munlock(page)
+	_ = unix.Madvise(page, unix.MADV_DONTNEED)
+}
@@ -0,0 +1,98 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+// TestSecretLocked checks the page of a secret is excluded from core dumps(dd), and
+// locked(lo) unless mlock is not permitted.
+func TestSecretLocked(t *testing.T) {
+	secret := NewSecret(32)
+	defer WipeSecret(secret)
+	flags := vmFlags(t, uintptr(unsafe.Pointer(unsafe.SliceData(secret))))
+	if !strings.Contains(flags, " dd") {
+		t.Fatal("secret not excluded from core dumps:", flags)
+	}
+	if err := SecretLockError(); err != nil {
+		t.Skip("mlock not permitted:", err)
+	}
+	if !strings.Contains(flags, " lo") {
+		t.Fatal("secret not locked:", flags)
+	}
+}
+
+// TestSecretPageUnlocked checks a page is unlocked once its slots are all free, and locked
+// again when it's reused.
+func TestSecretPageUnlocked(t *testing.T) {
+	if err := SecretLockError(); err != nil {
+		t.Skip("mlock not permitted:", err)
+	}
+	page, allocated := newSecretPage(t)
+	addr := uintptr(unsafe.Pointer(unsafe.SliceData(page.mem)))
+	for _, secret := range allocated {
+		WipeSecret(secret)
+	}
+	if flags := vmFlags(t, addr); strings.Contains(flags, " lo") {
+		t.Fatal("released page still locked:", flags)
+	}
+
+	_, allocated = newSecretPage(t)
+	defer func() {
+		for _, secret := range allocated {
+			WipeSecret(secret)
+		}
+	}()
+	if flags := vmFlags(t, addr); !strings.Contains(flags, " lo") || !strings.Contains(flags, " dd") {
+		t.Fatal("reused page not locked:", flags)
+	}
+}
+
+// vmFlags returns the VmFlags of the mapping at addr in /proc/self/smaps.
+func vmFlags(t *testing.T, addr uintptr) string {
+	f, err := os.Open("/proc/self/smaps")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer f.Close()
+
+	found := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		var start, end uintptr
+		if n, _ := fmt.Sscanf(line, "%x-%x", &start, &end); n == 2 {
+			found = addr >= start && addr < end
+		} else if found && strings.HasPrefix(line, "VmFlags:") {
+			return line
+		}
+	}
+	t.Fatalf("mapping of %#x not found", addr)
+	return ""
+}
@@ -0,0 +1,46 @@
+//go:build !linux
+
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+var errMemoryLock = errors.New("memory locking is only supported on linux")
+
+// allocPage allocates a page for the secrets on the heap, which is not locked.
+func allocPage() ([]byte, error) {
+	return make([]byte, os.Getpagesize()), errors.WithStack(errMemoryLock)
+}
+
+// lockPage reports the page can't be locked.
+func lockPage(_ []byte) error {
+	return errors.WithStack(errMemoryLock)
+}
+
+// releasePage does nothing, the free slots of the heap pages are zeroed already.
+func releasePage(_ []byte) {}
@@ -0,0 +1,188 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"bytes"
+	"testing"
+	"unsafe"
+)
+
+func TestSecret(t *testing.T) {
+	secret := NewSecret(32)
+	if len(secret) != 32 || cap(secret) != 32 || !isZero(secret) {
+		t.Fatal("unexpected secret", len(secret), cap(secret))
+	}
+	copy(secret, pass)
+	WipeSecret(secret)
+	if !isZero(secret) {
+		t.Fatal("secret not wiped")
+	}
+
+	// wiping twice doesn't release the slot twice
+	WipeSecret(secret)
+	a, b := NewSecret(16), NewSecret(16)
+	if unsafe.SliceData(a) == unsafe.SliceData(b) {
+		t.Fatal("slot allocated twice")
+	}
+	WipeSecret(a)
+	WipeSecret(b)
+
+	// larger secrets are on the heap
+	large := NewSecret(secretSize + 1)
+	copy(large, pass)
+	WipeSecret(large)
+	if len(large) != secretSize+1 || !isZero(large) {
+		t.Fatal("large secret not wiped")
+	}
+}
+
+// secretPageOf returns the page of the secret allocated by NewSecret.
+func secretPageOf(t *testing.T, secret []byte) *secretPage {
+	p := uintptr(unsafe.Pointer(unsafe.SliceData(secret)))
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+	for _, page := range secrets.pages {
+		base := uintptr(unsafe.Pointer(unsafe.SliceData(page.mem)))
+		if p >= base && p < base+uintptr(len(page.mem)) {
+			return page
+		}
+	}
+	t.Fatal("secret not in a page")
+	return nil
+}
+
+// newSecretPage allocates secrets until one is the first of its page, and returns the page
+// along with the secrets.
+func newSecretPage(t *testing.T) (*secretPage, [][]byte) {
+	var allocated [][]byte
+	for {
+		secret := NewSecret(32)
+		allocated = append(allocated, secret)
+		if page := secretPageOf(t, secret); page.n == 1 {
+			return page, allocated
+		}
+	}
+}
+
+func TestSecretPageReleased(t *testing.T) {
+	page, allocated := newSecretPage(t)
+	for _, secret := range allocated {
+		copy(secret, pass)
+		WipeSecret(secret)
+	}
+	if page.n != 0 {
+		t.Fatal("slots of the page still in use", page.n)
+	}
+	if !isZero(page.mem) {
+		t.Fatal("released page not zeroed")
+	}
+
+	// wiping again leaves the released page alone, and the page is reused
+	WipeSecret(allocated[len(allocated)-1])
+	if page.n != 0 {
+		t.Fatal("released slot released again")
+	}
+	reused, allocated := newSecretPage(t)
+	for _, secret := range allocated {
+		WipeSecret(secret)
+	}
+	if reused != page {
+		t.Fatal("released page not reused")
+	}
+}
+
+func TestDestroyTwice(t *testing.T) {
+	salsa, _ := NewSalsa20BlockCrypt(pass[:32])
+	qpp, _ := NewQPPCrypt(pass[:32])
+	mac, _ := NewMACCrypt(salsa, MACHMACSHA256, pass[:32], 16)
+	for _, crypter := range []Crypter{mac, qpp} {
+		Destroy(crypter)
+	}
+
+	// the slots released may be reused, destroying again must leave them alone
+	var live [][]byte
+	for range 4 {
+		secret := NewSecret(32)
+		copy(secret, pass)
+		live = append(live, secret)
+	}
+	for _, crypter := range []Crypter{mac, qpp, salsa} {
+		Destroy(crypter)
+	}
+	for _, secret := range live {
+		if !bytes.Equal(secret, pass[:32]) {
+			t.Fatal("live secret wiped by destroying a crypter twice")
+		}
+		WipeSecret(secret)
+	}
+}
+
+func TestDestroy(t *testing.T) {
+	data := []byte("hello")
+	for _, method := range []string{"qpp", "salsa20", "camellia", "aria", "ascon128"} {
+		keyLen, _ := CipherKeyLen(method)
+		crypter, err := NewCipher(method, pass[:keyLen])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block, ok := crypter.(BlockCrypt); ok {
+			if crypter, err = NewMACCrypt(block, MACHMACSHA256, pass[:32], 16); err != nil {
+				t.Fatal(err)
+			}
+		}
+		padded, _ := NewPaddingCrypt(crypter, MTUPadding(), 0)
+
+		packet := encryptPacket(padded, data)
+		if out, err := decryptPacket(padded, bytes.Clone(packet)); err != nil || !bytes.Equal(out, data) {
+			t.Fatal(method, "decrypt failed", err)
+		}
+		// the keyed hashes of the MAC may still pass the tag, the data is lost all the same
+		Destroy(padded)
+		if out, err := decryptPacket(padded, packet); err == nil && bytes.Equal(out, data) {
+			t.Fatal(method, "decrypted after destroyed")
+		}
+	}
+
+	qpp, _ := NewQPPCrypt(pass[:32])
+	mac, _ := NewMACCrypt(qpp, MACBLAKE2b, pass[:32], 16)
+	Destroy(mac)
+	if !isZero(qpp.(*qppCrypt).key) || !isZero(mac.(*macCrypt).key) {
+		t.Fatal("qpp keys not wiped")
+	}
+
+	// crypters without secrets to wipe are left as they are
+	Destroy(nil)
+	aes, _ := NewAESBlockCrypt(pass[:32])
+	Destroy(aes)
+	cryptTest(t, aes)
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
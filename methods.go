@@ -0,0 +1,177 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+var errUnknownMethod = errors.New("no crypto method decrypts the packet")
+
+// Methods holds the crypters of several crypto methods accepted side by side from the
+// clients, so a chain can migrate from one method to another without changing both ends
+// of a link at once. Each client is identified by trial decryption with the methods in
+// the order added, and the method found is remembered for the later packets of the client
+// and the replies to it, which skip the trial decryption until a packet fails the method.
+// The usage of each method tells when an old method can be removed.
+type Methods struct {
+	methods []*method
+	clients map[string]*method // client address -> method in use
+	buffers sync.Pool          // copies of packets for the trial decryption
+	mu      sync.RWMutex
+}
+
+// method is a crypto method of Methods.
+type method struct {
+	name    string
+	crypter Crypter
+	packets atomic.Uint64 // packets decrypted
+}
+
+// MethodUsage is the usage of a crypto method, see Methods.Usage.
+type MethodUsage struct {
+	Name    string // name of the method
+	Packets uint64 // packets decrypted by the method
+	Clients int    // clients using the method
+}
+
+// NewMethods creates an empty set of crypto methods.
+func NewMethods() *Methods {
+	m := new(Methods)
+	m.clients = make(map[string]*method)
+	m.buffers.New = func() any {
+		buf := make([]byte, mtuLimit)
+		return &buf
+	}
+	return m
+}
+
+// Add appends the crypto method `name` to be tried after the methods added before. A nil
+// crypter leaves the packets unencrypted and accepts any packet, so it's only tried if it's
+// the only method, any garbage would be taken for an unencrypted client otherwise.
+func (m *Methods) Add(name string, crypter Crypter) {
+	m.mu.Lock()
+	m.methods = append(m.methods, &method{name: name, crypter: crypter})
+	m.mu.Unlock()
+}
+
+// Usage returns the usage of the methods in the order added.
+func (m *Methods) Usage() []MethodUsage {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	usage := make([]MethodUsage, len(m.methods))
+	for i, method := range m.methods {
+		usage[i] = MethodUsage{Name: method.name, Packets: method.packets.Load()}
+		for _, inUse := range m.clients {
+			if inUse == method {
+				usage[i].Clients++
+			}
+		}
+	}
+	return usage
+}
+
+// Destroy zeroes the keys of the crypters of all the methods, the methods must not be
+// used afterwards.
+func (m *Methods) Destroy() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, method := range m.methods {
+		Destroy(method.crypter)
+	}
+}
+
+// open decrypts a packet from client with the method in use, or identifies the method by
+// trial decryption if the client is new or the packet fails the method in use, remembering
+// it for the later packets and replies.
+func (m *Methods) open(client string, packet []byte) ([]byte, error) {
+	m.mu.RLock()
+	inUse := m.clients[client]
+	data, found := m.identify(inUse, packet)
+	m.mu.RUnlock()
+	if found == nil {
+		return nil, errUnknownMethod
+	}
+
+	found.packets.Add(1)
+	if found != inUse {
+		// the client may have been identified by another packet meanwhile
+		m.mu.Lock()
+		if m.clients[client] == inUse {
+			m.clients[client] = found
+		}
+		m.mu.Unlock()
+	}
+	return data, nil
+}
+
+// identify decrypts the packet with the method in use, then with the others in order, the
+// packets too short for a method are left nil without errors. It returns the data and the
+// method decrypting the packet, or a nil method if none does.
+func (m *Methods) identify(inUse *method, packet []byte) ([]byte, *method) {
+	if inUse != nil {
+		buf := m.buffers.Get().(*[]byte)
+		defer m.buffers.Put(buf)
+		saved := append((*buf)[:0], packet...)
+		if data, err := decryptPacket(inUse.crypter, packet); err == nil && data != nil {
+			return data, inUse
+		}
+		copy(packet, saved)
+	}
+
+	for _, method := range m.methods {
+		if method == inUse || (method.crypter == nil && len(m.methods) > 1) {
+			continue
+		}
+		if data, err := decryptPacket(method.crypter, bytes.Clone(packet)); err == nil && data != nil {
+			return data, method
+		}
+	}
+	return nil, nil
+}
+
+// seal encrypts data to client with the method in use, it returns nil if the client has
+// not been identified.
+func (m *Methods) seal(client string, data []byte) []byte {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	method, ok := m.clients[client]
+	if !ok {
+		return nil
+	}
+	return encryptPacket(method.crypter, data)
+}
+
+// remove forgets the method of client.
+func (m *Methods) remove(client string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	delete(m.clients, client)
+	m.mu.Unlock()
+}
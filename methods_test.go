@@ -0,0 +1,104 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMethods(t *testing.T) {
+	qpp, _ := NewQPPCrypt(pass[:32])
+	gcm, _ := NewAESGCMCrypt(pass[:32])
+	methods := NewMethods()
+	methods.Add("qpp", qpp)
+	methods.Add("aes-gcm", gcm)
+	data := []byte("hello")
+
+	// client a migrated to aes-gcm, client b still uses qpp
+	for range 3 {
+		if out, err := methods.open("a", encryptPacket(gcm, data)); err != nil || !bytes.Equal(out, data) {
+			t.Fatal("client a", err)
+		}
+	}
+	if out, err := methods.open("b", encryptPacket(qpp, data)); err != nil || !bytes.Equal(out, data) {
+		t.Fatal("client b", err)
+	}
+	if out, err := decryptPacket(gcm, methods.seal("a", data)); err != nil || !bytes.Equal(out, data) {
+		t.Fatal("reply to client a", err)
+	}
+	if out, err := decryptPacket(qpp, methods.seal("b", data)); err != nil || !bytes.Equal(out, data) {
+		t.Fatal("reply to client b", err)
+	}
+	if methods.seal("c", data) != nil {
+		t.Fatal("reply to an unknown client")
+	}
+
+	usage := methods.Usage()
+	expected := []MethodUsage{{"qpp", 1, 1}, {"aes-gcm", 3, 1}}
+	if len(usage) != len(expected) || usage[0] != expected[0] || usage[1] != expected[1] {
+		t.Fatal("unexpected usage", usage)
+	}
+
+	// a client changing its method at the same address is identified again
+	if out, err := methods.open("a", encryptPacket(qpp, data)); err != nil || !bytes.Equal(out, data) {
+		t.Fatal("client a changing its method", err)
+	}
+	if out, err := decryptPacket(qpp, methods.seal("a", data)); err != nil || !bytes.Equal(out, data) {
+		t.Fatal("reply to client a after changing its method", err)
+	}
+	if _, err := methods.open("a", []byte("garbage packet of no method")); err != errUnknownMethod {
+		t.Fatal("expected errUnknownMethod, got", err)
+	}
+	if out, err := methods.open("a", encryptPacket(qpp, data)); err != nil || !bytes.Equal(out, data) {
+		t.Fatal("client a after a garbage packet", err)
+	}
+	if _, err := methods.open("c", []byte("garbage packet of no method")); err != errUnknownMethod {
+		t.Fatal("expected errUnknownMethod, got", err)
+	}
+
+	// a removed client is identified again
+	methods.remove("b")
+	if out, err := methods.open("b", encryptPacket(gcm, data)); err != nil || !bytes.Equal(out, data) {
+		t.Fatal("client b after removed", err)
+	}
+	if usage := methods.Usage(); usage[0].Clients != 1 || usage[1].Clients != 1 {
+		t.Fatal("unexpected usage", usage)
+	}
+
+	// unencrypted packets are not taken for a client along with other methods
+	methods.Add("none", nil)
+	if _, err := methods.open("c", data); err != errUnknownMethod {
+		t.Fatal("unencrypted packet accepted along with other methods", err)
+	}
+
+	// but they are if it's the only method
+	plain := NewMethods()
+	plain.Add("none", nil)
+	if out, err := plain.open("c", data); err != nil || !bytes.Equal(out, data) {
+		t.Fatal("unencrypted client", err)
+	}
+	if !bytes.Equal(plain.seal("c", data), data) {
+		t.Fatal("reply to the unencrypted client encrypted")
+	}
+}
@@ -0,0 +1,215 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"hash/maphash"
+	"io"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// Mimicry profiles.
+const (
+	MimicryNone      = "none"
+	MimicryQUIC      = "quic"      // QUIC 1-RTT packets with a short header
+	MimicryQUICLong  = "quic-long" // QUIC v1 Handshake packets with a long header
+	MimicryDTLS      = "dtls"      // DTLS 1.2 application data records
+	MimicryWireGuard = "wireguard" // WireGuard transport data messages
+)
+
+const (
+	// quicCIDSize defines the size of the connection IDs of the QUIC profiles.
+	quicCIDSize = 8
+	// quicPNSize defines the size of the packet numbers of the QUIC profiles, which
+	// are masked by the header protection of QUIC, so random bytes pass for them.
+	quicPNSize = 4
+
+	// | 01xxxxxx | destination connection id | packet number | payload |
+	quicShortHeaderSize = 1 + quicCIDSize + quicPNSize
+	// | 1110xxxx | version | dcid len | dcid | scid len | scid | length(varint, 2 bytes) | packet number | payload |
+	quicLongHeaderSize = 1 + 4 + 1 + quicCIDSize + 1 + quicCIDSize + 2 + quicPNSize
+	quicVersion1       = 1
+
+	// | content type | version | epoch | sequence number(6 bytes) | length | fragment |
+	dtlsHeaderSize        = 13
+	dtlsApplicationData   = 23
+	dtlsVersion12         = 0xfefd
+	dtlsEpoch             = 1
+	dtlsMaxSequenceNumber = 1<<48 - 1
+
+	// | type(4) | reserved(3 bytes) | receiver index(LE) | counter(LE, 8 bytes) | encrypted packet |
+	wireGuardHeaderSize    = 16
+	wireGuardTransportData = 4
+)
+
+var (
+	errMimicry        = errors.New("datagram not framed by the mimicry profile")
+	errMimicryProfile = errors.New("unsupported mimicry profile")
+)
+
+// Mimicry frames the datagrams on a side of a listener like the datagrams of another protocol,
+// so that middleboxes throttling unknown UDP traffic let them pass. The framing is outside of
+// the encryption and hides nothing, the connection IDs and receiver indexes are stable per
+// client, and the sequence numbers and counters increase like those of real sessions.
+type Mimicry struct {
+	profile string
+	seed    maphash.Seed  // seeds the connection IDs of the clients
+	counter atomic.Uint64 // sequence numbers and counters
+}
+
+// NewMimicry creates the mimicry of a profile, nil for MimicryNone.
+func NewMimicry(profile string) (*Mimicry, error) {
+	switch profile {
+	case MimicryNone:
+		return nil, nil
+	case MimicryQUIC, MimicryQUICLong, MimicryDTLS, MimicryWireGuard:
+	default:
+		return nil, errors.Wrapf(errMimicryProfile, "%q", profile)
+	}
+
+	m := &Mimicry{profile: profile, seed: maphash.MakeSeed()}
+	var counter [8]byte
+	_, _ = io.ReadFull(rand.Reader, counter[:2])
+	m.counter.Store(binary.LittleEndian.Uint64(counter[:]))
+	return m, nil
+}
+
+// MimicryProfiles returns the names of the mimicry profiles.
+func MimicryProfiles() []string {
+	return []string{MimicryNone, MimicryQUIC, MimicryQUICLong, MimicryDTLS, MimicryWireGuard}
+}
+
+// Profile returns the name of the profile.
+func (m *Mimicry) Profile() string {
+	if m == nil {
+		return MimicryNone
+	}
+	return m.profile
+}
+
+// Overhead returns the size of the framing added to each datagram.
+func (m *Mimicry) Overhead() int {
+	return mimicryOverhead(m.Profile())
+}
+
+// mimicryOverhead returns the size of the framing of profile.
+func mimicryOverhead(profile string) int {
+	switch profile {
+	case MimicryQUIC:
+		return quicShortHeaderSize
+	case MimicryQUICLong:
+		return quicLongHeaderSize
+	case MimicryDTLS:
+		return dtlsHeaderSize
+	case MimicryWireGuard:
+		return wireGuardHeaderSize
+	}
+	return 0
+}
+
+// flowID returns the connection ID of the packets with the client `flow`.
+func (m *Mimicry) flowID(flow string, n byte) uint64 {
+	var h maphash.Hash
+	h.SetSeed(m.seed)
+	h.WriteByte(n)
+	h.WriteString(flow)
+	return h.Sum64()
+}
+
+// wrap frames the packet with the client `flow`, the packet is returned as is without mimicry.
+func (m *Mimicry) wrap(flow string, packet []byte) []byte {
+	if m == nil {
+		return packet
+	}
+
+	datagram := make([]byte, m.Overhead()+len(packet))
+	header := datagram[:m.Overhead()]
+	copy(datagram[len(header):], packet)
+
+	switch m.profile {
+	case MimicryQUIC:
+		_, _ = io.ReadFull(rand.Reader, header[:1])
+		header[0] = 0x40 | header[0]&0x3f // fixed bit, then the spin bit and protected bits
+		binary.BigEndian.PutUint64(header[1:], m.flowID(flow, 0))
+		_, _ = io.ReadFull(rand.Reader, header[1+quicCIDSize:])
+	case MimicryQUICLong:
+		_, _ = io.ReadFull(rand.Reader, header[:1])
+		header[0] = 0xe0 | header[0]&0x0f // long header, fixed bit, Handshake, then the protected bits
+		binary.BigEndian.PutUint32(header[1:], quicVersion1)
+		header[5] = quicCIDSize
+		binary.BigEndian.PutUint64(header[6:], m.flowID(flow, 0))
+		header[6+quicCIDSize] = quicCIDSize
+		binary.BigEndian.PutUint64(header[7+quicCIDSize:], m.flowID(flow, 1))
+		binary.BigEndian.PutUint16(header[7+2*quicCIDSize:], 0x4000|uint16(quicPNSize+len(packet)))
+		_, _ = io.ReadFull(rand.Reader, header[9+2*quicCIDSize:])
+	case MimicryDTLS:
+		header[0] = dtlsApplicationData
+		binary.BigEndian.PutUint16(header[1:], dtlsVersion12)
+		binary.BigEndian.PutUint16(header[3:], dtlsEpoch)
+		seq := m.counter.Add(1) & dtlsMaxSequenceNumber
+		binary.BigEndian.PutUint16(header[5:], uint16(seq>>32))
+		binary.BigEndian.PutUint32(header[7:], uint32(seq))
+		binary.BigEndian.PutUint16(header[11:], uint16(len(packet)))
+	case MimicryWireGuard:
+		header[0] = wireGuardTransportData
+		binary.LittleEndian.PutUint32(header[4:], uint32(m.flowID(flow, 0)))
+		binary.LittleEndian.PutUint64(header[8:], m.counter.Add(1))
+	}
+	return datagram
+}
+
+// unwrap strips the framing of a datagram, the datagram is returned as is without mimicry.
+func (m *Mimicry) unwrap(datagram []byte) ([]byte, error) {
+	if m == nil {
+		return datagram, nil
+	}
+	if len(datagram) < m.Overhead() {
+		return nil, errors.WithStack(errMimicry)
+	}
+
+	header, packet := datagram[:m.Overhead()], datagram[m.Overhead():]
+	var ok bool
+	switch m.profile {
+	case MimicryQUIC:
+		ok = header[0]&0xc0 == 0x40
+	case MimicryQUICLong:
+		ok = header[0]&0xf0 == 0xe0 &&
+			binary.BigEndian.Uint32(header[1:]) == quicVersion1 &&
+			header[5] == quicCIDSize && header[6+quicCIDSize] == quicCIDSize &&
+			int(binary.BigEndian.Uint16(header[7+2*quicCIDSize:])) == 0x4000|(quicPNSize+len(packet))
+	case MimicryDTLS:
+		ok = header[0] == dtlsApplicationData &&
+			binary.BigEndian.Uint16(header[1:]) == dtlsVersion12 &&
+			int(binary.BigEndian.Uint16(header[11:])) == len(packet)
+	case MimicryWireGuard:
+		ok = header[0] == wireGuardTransportData && header[1] == 0 && header[2] == 0 && header[3] == 0
+	}
+	if !ok {
+		return nil, errors.WithStack(errMimicry)
+	}
+	return packet, nil
+}
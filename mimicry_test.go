@@ -0,0 +1,110 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestMimicry(t *testing.T) {
+	packet := knownAnswerData()
+	for _, profile := range MimicryProfiles()[1:] {
+		m, err := NewMimicry(profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Profile() != profile {
+			t.Fatal("profile", m.Profile(), "expected", profile)
+		}
+
+		a1 := m.wrap("192.0.2.1:1000", packet)
+		a2 := m.wrap("192.0.2.1:1000", packet)
+		b1 := m.wrap("192.0.2.2:1000", packet)
+		if len(a1) != m.Overhead()+len(packet) {
+			t.Fatalf("%v: datagram of %d bytes, expected %d", profile, len(a1), m.Overhead()+len(packet))
+		}
+		for _, datagram := range [][]byte{a1, a2, b1} {
+			unwrapped, err := m.unwrap(bytes.Clone(datagram))
+			if err != nil || !bytes.Equal(unwrapped, packet) {
+				t.Fatalf("%v: unwrap failed: %v", profile, err)
+			}
+		}
+
+		// the framing of each protocol, with connection IDs stable per client
+		switch profile {
+		case MimicryQUIC:
+			if a1[0]&0xc0 != 0x40 || !bytes.Equal(a1[1:9], a2[1:9]) || bytes.Equal(a1[1:9], b1[1:9]) {
+				t.Fatalf("%v: invalid header %x", profile, a1[:quicShortHeaderSize])
+			}
+		case MimicryQUICLong:
+			if a1[0]&0xf0 != 0xe0 || binary.BigEndian.Uint32(a1[1:]) != 1 || !bytes.Equal(a1[5:23], a2[5:23]) || bytes.Equal(a1[6:14], b1[6:14]) {
+				t.Fatalf("%v: invalid header %x", profile, a1[:quicLongHeaderSize])
+			}
+			if length := binary.BigEndian.Uint16(a1[23:]); length != 0x4000|uint16(quicPNSize+len(packet)) {
+				t.Fatalf("%v: invalid length %x", profile, length)
+			}
+		case MimicryDTLS:
+			if !bytes.Equal(a1[:5], []byte{23, 0xfe, 0xfd, 0, 1}) || binary.BigEndian.Uint16(a1[11:]) != uint16(len(packet)) {
+				t.Fatalf("%v: invalid header %x", profile, a1[:dtlsHeaderSize])
+			}
+			if binary.BigEndian.Uint64(a2[3:])&dtlsMaxSequenceNumber != binary.BigEndian.Uint64(a1[3:])&dtlsMaxSequenceNumber+1 {
+				t.Fatalf("%v: sequence number not increasing", profile)
+			}
+		case MimicryWireGuard:
+			if !bytes.Equal(a1[:4], []byte{4, 0, 0, 0}) || !bytes.Equal(a1[4:8], a2[4:8]) || bytes.Equal(a1[4:8], b1[4:8]) {
+				t.Fatalf("%v: invalid header %x", profile, a1[:wireGuardHeaderSize])
+			}
+			if binary.LittleEndian.Uint64(a2[8:]) != binary.LittleEndian.Uint64(a1[8:])+1 {
+				t.Fatalf("%v: counter not increasing", profile)
+			}
+		}
+
+		// the datagrams of other profiles, and short ones are dropped
+		for _, other := range MimicryProfiles()[1:] {
+			if other == profile || (profile == MimicryQUIC && other == MimicryDTLS) {
+				continue // a dtls record passes for a short header
+			}
+			o, _ := NewMimicry(other)
+			if _, err := m.unwrap(o.wrap("192.0.2.1:1000", packet)); err == nil {
+				t.Fatalf("%v: accepted a datagram of %v", profile, other)
+			}
+		}
+		if _, err := m.unwrap(a1[:m.Overhead()-1]); err == nil {
+			t.Fatalf("%v: accepted a short datagram", profile)
+		}
+	}
+
+	// none passes the packets through
+	m, err := NewMimicry(MimicryNone)
+	if err != nil || m != nil || m.Profile() != MimicryNone || m.Overhead() != 0 {
+		t.Fatal("mimicry none", m, err)
+	}
+	if unwrapped, err := m.unwrap(m.wrap("192.0.2.1:1000", packet)); err != nil || !bytes.Equal(unwrapped, packet) {
+		t.Fatal("mimicry none altered the packet")
+	}
+	if _, err := NewMimicry("tls"); err == nil {
+		t.Fatal("unsupported profile accepted")
+	}
+}
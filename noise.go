@@ -0,0 +1,499 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// The handshake follows the Noise NNpsk0 pattern(https://noiseprotocol.org/noise.html):
+//
+//	-> psk, e
+//	<- e, ee
+//
+// Both sides prove the knowledge of the pre-shared key, and the traffic keys are
+// derived from ephemeral X25519 keys, so leaking the pre-shared key later doesn't
+// decrypt the captured sessions.
+//
+// The hybrid variant adds an ephemeral ML-KEM-768 encapsulation key to the initiation,
+// and the ciphertext encapsulated to it to the response:
+//
+//	-> psk, e, ekem
+//	<- e, ee, ct, kem
+//
+// The traffic keys are mixed from both X25519 and ML-KEM shared secrets, so they remain
+// secret as long as either of them is unbroken, e.g. against the captured traffic being
+// decrypted by quantum computers in the future.
+//
+// With static identities, the handshake follows the Noise IKpsk0 pattern instead, the
+// initiator knows the static key of the responder in advance and sends its own encrypted:
+//
+//	<- s
+//	...
+//	-> psk, e, es, s, ss
+//	<- e, ee, se
+//
+// So only the holders of the identities can complete the handshake, and each side learns
+// who the other is. The hybrid variant adds the ML-KEM-768 tokens the same way.
+//
+// The payload of the initiation carries a TAI64N timestamp, so a captured initiation can't
+// be replayed to make the responder allocate sessions: with static identities, the responder
+// accepts only timestamps greater than the last one of each initiator, as in WireGuard,
+// otherwise it accepts timestamps within handshakeSkew of its clock, and each ephemeral key once.
+const (
+	noiseProtocolName               = "Noise_NNpsk0_25519_ChaChaPoly_SHA256"
+	noiseHybridProtocolName         = "Noise_NNpsk0hybrid_25519+MLKEM768_ChaChaPoly_SHA256"
+	noiseIdentityProtocolName       = "Noise_IKpsk0_25519_ChaChaPoly_SHA256"
+	noiseHybridIdentityProtocolName = "Noise_IKpsk0hybrid_25519+MLKEM768_ChaChaPoly_SHA256"
+
+	noiseKeySize = 32
+	noiseTagSize = chacha20poly1305.Overhead
+
+	// handshake message types
+	msgInitiation       = 1
+	msgResponse         = 2
+	msgHybridInitiation = 3
+	msgHybridResponse   = 4
+
+	// identityMessage is added to the types of the messages with static identities
+	identityMessage = 4
+
+	// timestampSize is the size of the TAI64N timestamp in the initiation payload.
+	timestampSize = 12
+
+	// | type(1) | e(32) | encrypted sender index and timestamp(4+12+16) |
+	initiationSize = 1 + noiseKeySize + 4 + timestampSize + noiseTagSize
+
+	// | type(1) | receiver index(4) | e(32) | encrypted sender index(4+16) |
+	responseSize = 1 + 4 + noiseKeySize + 4 + noiseTagSize
+
+	// | type(1) | e(32) | encrypted ekem(1184+16) | encrypted sender index and timestamp(4+12+16) |
+	hybridInitiationSize = initiationSize + mlkem.EncapsulationKeySize768 + noiseTagSize
+
+	// | type(1) | receiver index(4) | e(32) | encrypted ct(1088+16) | encrypted sender index(4+16) |
+	hybridResponseSize = responseSize + mlkem.CiphertextSize768 + noiseTagSize
+
+	// the encrypted static key(32+16) of the initiator with static identities,
+	// following the ephemeral key
+	identitySize = noiseKeySize + noiseTagSize
+
+	// handshakeSkew is the clock skew tolerance of the initiation timestamps without static identities.
+	handshakeSkew = time.Minute
+
+	// tai64nBase is the TAI64 label of the Unix epoch.
+	tai64nBase = 0x400000000000000a
+)
+
+var (
+	errHandshake      = errors.New("handshake failed")
+	errHandshakeSize  = errors.New("handshake packets exceed the mtu")
+	errSessionExpired = errors.New("session expired")
+)
+
+// tai64n returns the TAI64N timestamp of t, which compares in the order of time as bytes.
+func tai64n(t time.Time) []byte {
+	b := binary.BigEndian.AppendUint64(make([]byte, 0, timestampSize), tai64nBase+uint64(t.Unix()))
+	return binary.BigEndian.AppendUint32(b, uint32(t.Nanosecond()))
+}
+
+// parseTAI64N returns the time of a TAI64N timestamp.
+func parseTAI64N(b []byte) time.Time {
+	return time.Unix(int64(binary.BigEndian.Uint64(b)-tai64nBase), int64(binary.BigEndian.Uint32(b[8:])))
+}
+
+// initiationSizeOf returns the size of the initiations, the largest handshake messages.
+func initiationSizeOf(hybrid bool, identity bool) int {
+	size := initiationSize
+	if hybrid {
+		size = hybridInitiationSize
+	}
+	if identity {
+		size += identitySize
+	}
+	return size
+}
+
+// symmetricState implements the SymmetricState object of the Noise framework.
+type symmetricState struct {
+	ck     [sha256.Size]byte // chaining key
+	h      [sha256.Size]byte // handshake hash
+	k      [noiseKeySize]byte
+	n      uint64
+	hasKey bool
+}
+
+// newSymmetricState initializes the handshake with the psk, and the static key of the
+// responder rs known in advance with static identities, nil otherwise.
+func newSymmetricState(psk []byte, hybrid bool, rs []byte) *symmetricState {
+	s := new(symmetricState)
+	switch { // all names are longer than the hash length
+	case hybrid && rs != nil:
+		s.h = sha256.Sum256([]byte(noiseHybridIdentityProtocolName))
+	case hybrid:
+		s.h = sha256.Sum256([]byte(noiseHybridProtocolName))
+	case rs != nil:
+		s.h = sha256.Sum256([]byte(noiseIdentityProtocolName))
+	default:
+		s.h = sha256.Sum256([]byte(noiseProtocolName))
+	}
+	s.ck = s.h
+	s.mixHash(nil) // empty prologue
+	if rs != nil {
+		s.mixHash(rs) // <- s
+	}
+	s.mixKeyAndHash(psk)
+	return s
+}
+
+// mixDH mixes the X25519 shared secret of the keys into the chaining key.
+func (s *symmetricState) mixDH(private *ecdh.PrivateKey, public *ecdh.PublicKey) error {
+	shared, err := private.ECDH(public)
+	if err != nil {
+		return errors.WithStack(errHandshake)
+	}
+	s.mixKey(shared)
+	return nil
+}
+
+// hkdf implements HKDF of the Noise framework with HMAC-SHA256, returning 3 outputs.
+func (s *symmetricState) hkdf(ikm []byte) (out1, out2, out3 [sha256.Size]byte) {
+	mac := hmac.New(sha256.New, s.ck[:])
+	mac.Write(ikm)
+	temp := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, temp)
+	mac.Write([]byte{1})
+	mac.Sum(out1[:0])
+
+	mac.Reset()
+	mac.Write(out1[:])
+	mac.Write([]byte{2})
+	mac.Sum(out2[:0])
+
+	mac.Reset()
+	mac.Write(out2[:])
+	mac.Write([]byte{3})
+	mac.Sum(out3[:0])
+	return
+}
+
+func (s *symmetricState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(s.h[:])
+	h.Write(data)
+	h.Sum(s.h[:0])
+}
+
+func (s *symmetricState) mixKey(ikm []byte) {
+	s.ck, s.k, _ = s.hkdf(ikm)
+	s.n = 0
+	s.hasKey = true
+}
+
+func (s *symmetricState) mixKeyAndHash(ikm []byte) {
+	var h [sha256.Size]byte
+	s.ck, h, s.k = s.hkdf(ikm)
+	s.mixHash(h[:])
+	s.n = 0
+	s.hasKey = true
+}
+
+func (s *symmetricState) nonce() []byte {
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(nonce[4:], s.n)
+	s.n++
+	return nonce[:]
+}
+
+func (s *symmetricState) encryptAndHash(dst, plaintext []byte) []byte {
+	aead, _ := chacha20poly1305.New(s.k[:])
+	out := aead.Seal(dst, s.nonce(), plaintext, s.h[:])
+	s.mixHash(out[len(dst):])
+	return out
+}
+
+func (s *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	aead, _ := chacha20poly1305.New(s.k[:])
+	plaintext, err := aead.Open(nil, s.nonce(), ciphertext, s.h[:])
+	if err != nil {
+		return nil, errors.WithStack(errHandshake)
+	}
+	s.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split derives the traffic keys of initiator->responder and responder->initiator.
+func (s *symmetricState) split() (i2r, r2i []byte) {
+	k1, k2, _ := s.hkdf(nil)
+	return k1[:], k2[:]
+}
+
+// messageType returns the type of the initiation, or the response if response is set.
+func messageType(hybrid bool, identity bool, response bool) byte {
+	t := byte(msgInitiation)
+	if hybrid {
+		t = msgHybridInitiation
+	}
+	if identity {
+		t += identityMessage
+	}
+	if response {
+		t++
+	}
+	return t
+}
+
+// handshakeState holds the initiator state between the initiation and the response.
+type handshakeState struct {
+	ss    *symmetricState
+	e     *ecdh.PrivateKey
+	s     *ecdh.PrivateKey           // nil without static identities
+	kem   *mlkem.DecapsulationKey768 // nil if not hybrid
+	index uint32                     // sender index of the initiator
+}
+
+// newInitiation creates the handshake initiation of an initiator with its session index.
+// With static identities, s is the static key of the initiator and rs is the one of the
+// responder, both are nil otherwise.
+func newInitiation(psk []byte, index uint32, hybrid bool, s *ecdh.PrivateKey, rs *ecdh.PublicKey) (*handshakeState, []byte, error) {
+	e, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	var rspub []byte
+	if s != nil {
+		rspub = rs.Bytes()
+	}
+	hs := &handshakeState{ss: newSymmetricState(psk, hybrid, rspub), e: e, s: s, index: index}
+	msg := make([]byte, 1, initiationSizeOf(hybrid, s != nil))
+	msg[0] = messageType(hybrid, s != nil, false)
+
+	// -> psk, e
+	epub := e.PublicKey().Bytes()
+	msg = append(msg, epub...)
+	hs.ss.mixHash(epub)
+	hs.ss.mixKey(epub)
+
+	// -> es, s, ss
+	if s != nil {
+		if err := hs.ss.mixDH(e, rs); err != nil {
+			return nil, nil, err
+		}
+		msg = hs.ss.encryptAndHash(msg, s.PublicKey().Bytes())
+		if err := hs.ss.mixDH(s, rs); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// -> ekem
+	if hybrid {
+		if hs.kem, err = mlkem.GenerateKey768(); err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		msg = hs.ss.encryptAndHash(msg, hs.kem.EncapsulationKey().Bytes())
+	}
+
+	payload := binary.LittleEndian.AppendUint32(make([]byte, 0, 4+timestampSize), index)
+	msg = hs.ss.encryptAndHash(msg, append(payload, tai64n(time.Now())...))
+	return hs, msg, nil
+}
+
+// consumeInitiation validates an initiation as a responder with its session index,
+// it returns the response message, the initiator index and the traffic keys.
+// With static identities, s is the static key of the responder, and the initiation is
+// accepted only if authorize accepts the static key of the initiator. The initiation is
+// accepted only if fresh accepts its timestamp, along with the static key of the initiator,
+// nil without static identities, and its ephemeral key.
+func consumeInitiation(psk []byte, msg []byte, index uint32, hybrid bool, s *ecdh.PrivateKey, authorize func(*ecdh.PublicKey) bool, fresh func(rs, re *ecdh.PublicKey, timestamp []byte) bool) (response []byte, peer uint32, send, recv []byte, err error) {
+	var spub []byte
+	if s != nil {
+		spub = s.PublicKey().Bytes()
+	}
+	if len(msg) != initiationSizeOf(hybrid, s != nil) || msg[0] != messageType(hybrid, s != nil, false) {
+		return nil, 0, nil, nil, errors.WithStack(errHandshake)
+	}
+
+	ss := newSymmetricState(psk, hybrid, spub)
+	// -> psk, e
+	repub := msg[1 : 1+noiseKeySize]
+	re, err := ecdh.X25519().NewPublicKey(repub)
+	if err != nil {
+		return nil, 0, nil, nil, errors.WithStack(errHandshake)
+	}
+	ss.mixHash(repub)
+	ss.mixKey(repub)
+	msg = msg[1+noiseKeySize:]
+
+	// -> es, s, ss
+	var rs *ecdh.PublicKey
+	if s != nil {
+		if err := ss.mixDH(s, re); err != nil {
+			return nil, 0, nil, nil, err
+		}
+		rspub, err := ss.decryptAndHash(msg[:identitySize])
+		if err != nil {
+			return nil, 0, nil, nil, err
+		}
+		if rs, err = ecdh.X25519().NewPublicKey(rspub); err != nil || !authorize(rs) {
+			return nil, 0, nil, nil, errors.WithStack(errHandshake)
+		}
+		if err := ss.mixDH(s, rs); err != nil {
+			return nil, 0, nil, nil, err
+		}
+		msg = msg[identitySize:]
+	}
+
+	// -> ekem
+	var ekem *mlkem.EncapsulationKey768
+	if hybrid {
+		ekb, err := ss.decryptAndHash(msg[:mlkem.EncapsulationKeySize768+noiseTagSize])
+		if err != nil {
+			return nil, 0, nil, nil, err
+		}
+		if ekem, err = mlkem.NewEncapsulationKey768(ekb); err != nil {
+			return nil, 0, nil, nil, errors.WithStack(errHandshake)
+		}
+		msg = msg[mlkem.EncapsulationKeySize768+noiseTagSize:]
+	}
+
+	payload, err := ss.decryptAndHash(msg)
+	if err != nil {
+		return nil, 0, nil, nil, err
+	}
+	if !fresh(rs, re, payload[4:]) {
+		return nil, 0, nil, nil, errors.WithStack(errHandshake)
+	}
+	peer = binary.LittleEndian.Uint32(payload)
+
+	e, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, 0, nil, nil, errors.WithStack(err)
+	}
+
+	response = make([]byte, 5, hybridResponseSize)
+	response[0] = messageType(hybrid, s != nil, true)
+	binary.LittleEndian.PutUint32(response[1:], peer)
+	ss.mixHash(response[1:5])
+
+	// <- e, ee
+	epub := e.PublicKey().Bytes()
+	response = append(response, epub...)
+	ss.mixHash(epub)
+	ss.mixKey(epub)
+	if err := ss.mixDH(e, re); err != nil {
+		return nil, 0, nil, nil, err
+	}
+
+	// <- se
+	if s != nil {
+		if err := ss.mixDH(e, rs); err != nil {
+			return nil, 0, nil, nil, err
+		}
+	}
+
+	// <- ct, kem
+	if hybrid {
+		shared, ct := ekem.Encapsulate()
+		response = ss.encryptAndHash(response, ct)
+		ss.mixKey(shared)
+	}
+
+	response = ss.encryptAndHash(response, binary.LittleEndian.AppendUint32(nil, index))
+
+	i2r, r2i := ss.split()
+	return response, peer, r2i, i2r, nil
+}
+
+// responseIndex returns the initiator index a response is addressed to.
+func responseIndex(msg []byte) (uint32, bool) {
+	switch {
+	case len(msg) == responseSize && (msg[0] == msgResponse || msg[0] == msgResponse+identityMessage):
+	case len(msg) == hybridResponseSize && (msg[0] == msgHybridResponse || msg[0] == msgHybridResponse+identityMessage):
+	default:
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(msg[1:]), true
+}
+
+// consumeResponse completes the handshake as the initiator, it returns the responder
+// index and the traffic keys.
+func (hs *handshakeState) consumeResponse(msg []byte) (peer uint32, send, recv []byte, err error) {
+	if index, ok := responseIndex(msg); !ok || index != hs.index || msg[0] != messageType(hs.kem != nil, hs.s != nil, true) {
+		return 0, nil, nil, errors.WithStack(errHandshake)
+	}
+
+	ss := *hs.ss // keep the state intact for the retransmitted responses
+	ss.mixHash(msg[1:5])
+
+	// <- e, ee
+	repub := msg[5 : 5+noiseKeySize]
+	re, err := ecdh.X25519().NewPublicKey(repub)
+	if err != nil {
+		return 0, nil, nil, errors.WithStack(errHandshake)
+	}
+	ss.mixHash(repub)
+	ss.mixKey(repub)
+	if err := ss.mixDH(hs.e, re); err != nil {
+		return 0, nil, nil, err
+	}
+
+	// <- se
+	if hs.s != nil {
+		if err := ss.mixDH(hs.s, re); err != nil {
+			return 0, nil, nil, err
+		}
+	}
+	msg = msg[5+noiseKeySize:]
+
+	// <- ct, kem
+	if hs.kem != nil {
+		ct, err := ss.decryptAndHash(msg[:mlkem.CiphertextSize768+noiseTagSize])
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		shared, err := hs.kem.Decapsulate(ct)
+		if err != nil {
+			return 0, nil, nil, errors.WithStack(errHandshake)
+		}
+		ss.mixKey(shared)
+		msg = msg[mlkem.CiphertextSize768+noiseTagSize:]
+	}
+
+	payload, err := ss.decryptAndHash(msg)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	i2r, r2i := ss.split()
+	return binary.LittleEndian.Uint32(payload), i2r, r2i, nil
+}
@@ -0,0 +1,186 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"slices"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// paddingTrailerSize defines the size of the padding length appended to the padded data.
+	// | data | padding | padding length(2 bytes) |
+	paddingTrailerSize = 2
+
+	// DefaultPaddingMTU is the default size limit of padded packets, it leaves room in a
+	// 1500-byte link MTU for the IP and UDP headers, and the headers of outer layers.
+	DefaultPaddingMTU = 1400
+)
+
+var (
+	errPadding       = errors.New("invalid padding")
+	errPaddingPolicy = errors.New("invalid padding policy")
+)
+
+// PaddingPolicy decides the size of padded packets to hide the length of the data.
+type PaddingPolicy interface {
+	// PaddedSize returns the size to pad a packet of `size` bytes to, the result is
+	// clamped to [size, max(size, limit)].
+	PaddedSize(size, limit int) int
+}
+
+type bucketPadding []int
+
+// BucketPadding pads packets to the smallest bucket size fitting them, packets
+// larger than all buckets are not padded.
+func BucketPadding(sizes ...int) (PaddingPolicy, error) {
+	if len(sizes) == 0 {
+		return nil, errors.WithStack(errPaddingPolicy)
+	}
+	for _, size := range sizes {
+		if size <= 0 {
+			return nil, errors.WithStack(errPaddingPolicy)
+		}
+	}
+	buckets := slices.Clone(sizes)
+	slices.Sort(buckets)
+	return bucketPadding(buckets), nil
+}
+
+func (p bucketPadding) PaddedSize(size, limit int) int {
+	for _, bucket := range p {
+		if bucket >= size {
+			return bucket
+		}
+	}
+	return size
+}
+
+type randomPadding int
+
+// RandomPadding pads packets with 0 to n random bytes, the lengths are drawn from crypto/rand
+// so they can't be predicted from the earlier ones.
+func RandomPadding(n int) (PaddingPolicy, error) {
+	if n <= 0 {
+		return nil, errors.WithStack(errPaddingPolicy)
+	}
+	return randomPadding(n), nil
+}
+
+func (p randomPadding) PaddedSize(size, limit int) int {
+	// the modulo bias of a 64-bit draw is negligible for the padding lengths
+	var b [8]byte
+	_, _ = io.ReadFull(rand.Reader, b[:])
+	return size + int(binary.LittleEndian.Uint64(b[:])%(uint64(p)+1))
+}
+
+type mtuPadding struct{}
+
+// MTUPadding pads all packets to the size limit.
+func MTUPadding() PaddingPolicy { return mtuPadding{} }
+
+func (mtuPadding) PaddedSize(size, limit int) int { return limit }
+
+// PaddingOverhead returns the size of the layers wrapping the packets of a padded crypter, to be
+// subtracted from the size limit of the datagrams: the key ID of a Keyring if keyID, the client
+// ID of NewClientCrypt or Credentials if clientID, the session index of the handshakes if session,
+// and the framing of the mimicry profile. The header protection masks the packets in place and
+// adds nothing.
+func PaddingOverhead(keyID, clientID, session bool, profile string) int {
+	n := mimicryOverhead(profile)
+	if keyID {
+		n += keyIDSize
+	}
+	if clientID {
+		n += clientIDSize
+	}
+	if session {
+		n += sessionIndexSize
+	}
+	return n
+}
+
+// paddingCrypt pads the data before encryption, the receiver strips the padding
+// regardless of the policy of the sender.
+type paddingCrypt struct {
+	crypter  Crypter
+	policy   PaddingPolicy
+	mtu      int
+	overhead int // packet overhead of the crypter
+}
+
+// NewPaddingCrypt wraps crypter to pad the packets by policy, without exceeding mtu bytes,
+// DefaultPaddingMTU is used if mtu is 0. The layers wrapping the padded packets afterwards
+// aren't counted, the mtu must leave room for them, see PaddingOverhead. Both ends of a link
+// must wrap their crypters, a nil policy only strips the padding and pads nothing.
+func NewPaddingCrypt(crypter Crypter, policy PaddingPolicy, mtu int) (PacketCrypt, error) {
+	if mtu == 0 {
+		mtu = DefaultPaddingMTU
+	}
+	if mtu < 0 || mtu > mtuLimit {
+		return nil, errors.Wrapf(errPaddingPolicy, "mtu %d out of range", mtu)
+	}
+
+	c := &paddingCrypt{crypter: crypter, policy: policy, mtu: mtu}
+	c.overhead = len(encryptPacket(crypter, nil))
+	return c, nil
+}
+
+// Destroy zeroes the keys of the crypter.
+func (c *paddingCrypt) Destroy() { Destroy(c.crypter) }
+
+func (c *paddingCrypt) isCrypter() {}
+
+func (c *paddingCrypt) SealPacket(data []byte) []byte {
+	size := c.overhead + len(data) + paddingTrailerSize
+	padded := size
+	if c.policy != nil {
+		padded = min(max(c.policy.PaddedSize(size, c.mtu), size), max(size, c.mtu))
+	}
+	n := min(padded-size, 0xFFFF)
+
+	buf := make([]byte, len(data)+n+paddingTrailerSize)
+	copy(buf, data)
+	binary.BigEndian.PutUint16(buf[len(buf)-paddingTrailerSize:], uint16(n))
+	return encryptPacket(c.crypter, buf)
+}
+
+func (c *paddingCrypt) OpenPacket(packet []byte) ([]byte, error) {
+	data, err := decryptPacket(c.crypter, packet)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < paddingTrailerSize {
+		return nil, errPadding
+	}
+
+	n := int(binary.BigEndian.Uint16(data[len(data)-paddingTrailerSize:]))
+	if n > len(data)-paddingTrailerSize {
+		return nil, errPadding
+	}
+	return data[:len(data)-paddingTrailerSize-n], nil
+}
@@ -0,0 +1,138 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPaddingPolicies(t *testing.T) {
+	buckets, err := BucketPadding(1024, 128, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	random, err := RandomPadding(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := make([]byte, 32)
+	gcm, _ := NewAESGCMCrypt(key)
+	aes, _ := NewAESBlockCrypt(key)
+	mac, _ := NewMACCrypt(aes, MACHMACSHA256, key, 16)
+
+	for _, crypter := range []Crypter{nil, gcm, aes, mac} {
+		sender, _ := NewPaddingCrypt(crypter, buckets, 0)
+		receiver, _ := NewPaddingCrypt(crypter, nil, 0) // strips any policy
+		for _, size := range []int{0, 1, 100, 200, 1000, 1300, 1400} {
+			data := bytes.Repeat([]byte{'x'}, size)
+			packet := encryptPacket(sender, data)
+			switch {
+			case len(packet) > DefaultPaddingMTU && len(packet) != size+sender.(*paddingCrypt).overhead+paddingTrailerSize:
+				t.Fatalf("%T: padded %d bytes beyond the mtu to %d", crypter, size, len(packet))
+			case len(packet) <= 1024 && len(packet) != 128 && len(packet) != 512 && len(packet) != 1024:
+				t.Fatalf("%T: %d bytes padded to %d, not a bucket", crypter, size, len(packet))
+			}
+
+			out, err := decryptPacket(receiver, packet)
+			if err != nil || !bytes.Equal(out, data) {
+				t.Fatalf("%T: %d bytes round trip failed: %v", crypter, size, err)
+			}
+		}
+	}
+
+	sender, _ := NewPaddingCrypt(gcm, random, 0)
+	sizes := make(map[int]bool)
+	for range 100 {
+		packet := encryptPacket(sender, []byte("hello"))
+		if len(packet) > 5+sender.(*paddingCrypt).overhead+paddingTrailerSize+100 {
+			t.Fatal("random padding exceeds the bound", len(packet))
+		}
+		sizes[len(packet)] = true
+	}
+	if len(sizes) < 10 {
+		t.Fatal("random padding not random", len(sizes))
+	}
+
+	sender, _ = NewPaddingCrypt(gcm, MTUPadding(), 1200)
+	for _, size := range []int{0, 500, 1100} {
+		if packet := encryptPacket(sender, make([]byte, size)); len(packet) != 1200 {
+			t.Fatal("not padded to the mtu", len(packet))
+		}
+	}
+	if packet := encryptPacket(sender, make([]byte, 1300)); len(packet) <= 1200 {
+		t.Fatal("packet truncated", len(packet))
+	}
+}
+
+func TestPaddingErrors(t *testing.T) {
+	if _, err := BucketPadding(); err == nil {
+		t.Fatal("empty buckets accepted")
+	}
+	if _, err := BucketPadding(0, 128); err == nil {
+		t.Fatal("zero bucket accepted")
+	}
+	if _, err := RandomPadding(0); err == nil {
+		t.Fatal("zero random padding accepted")
+	}
+	if _, err := NewPaddingCrypt(nil, MTUPadding(), mtuLimit+1); err == nil {
+		t.Fatal("mtu beyond mtuLimit accepted")
+	}
+
+	// a padding length beyond the packet
+	receiver, _ := NewPaddingCrypt(nil, nil, 0)
+	if _, err := decryptPacket(receiver, []byte{'x', 0, 2}); err != errPadding {
+		t.Fatal("expected errPadding, got", err)
+	}
+	if _, err := decryptPacket(receiver, []byte{0}); err != errPadding {
+		t.Fatal("expected errPadding, got", err)
+	}
+}
+
+func TestPaddingOverhead(t *testing.T) {
+	if n := PaddingOverhead(false, false, true, MimicryNone); n != sessionIndexSize {
+		t.Fatal("unexpected overhead of the session index", n)
+	}
+	overhead := PaddingOverhead(true, true, false, MimicryQUICLong)
+	if overhead != keyIDSize+clientIDSize+quicLongHeaderSize {
+		t.Fatal("unexpected overhead", overhead)
+	}
+
+	// the datagrams of packets padded to the mtu fill the limit, with the layers around them
+	gcm, _ := NewAESGCMCrypt(make([]byte, 32))
+	padded, err := NewPaddingCrypt(gcm, MTUPadding(), DefaultPaddingMTU-overhead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crypter := NewClientCrypt(7, NewKeyring(1, padded))
+	mimicry, err := NewMimicry(MimicryQUICLong)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 500, 1200} {
+		if datagram := mimicry.wrap("client", encryptPacket(crypter, make([]byte, size))); len(datagram) != DefaultPaddingMTU {
+			t.Fatalf("%d bytes padded to a datagram of %d bytes", size, len(datagram))
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// hpHeaderSize defines the largest size of the masked header, it covers the receiver index
+	// of the handshake sessions, or the key ID and the client ID, in front of the largest nonce
+	// of the builtin ciphers, the 24-byte nonce of xchacha20-poly1305.
+	hpHeaderSize = 32
+
+	// hpSampleSize defines the largest size of the ciphertext sampled for the mask.
+	hpSampleSize = aes.BlockSize
+
+	// hpMinSample defines the size of the sample of short packets, the 8-byte checksum of the
+	// classic ciphers is the shortest tail following the nonce of a packet.
+	hpMinSample = 8
+)
+
+var errHeaderProtection = errors.New("invalid header protection")
+
+// HeaderProtection masks the headers of the packets on a side of a listener, like the header
+// protection of QUIC in RFC 9001, so the nonces, the key IDs, the client IDs and the receiver
+// indexes are not visible in clear.
+//
+// The first min(32, len-min(8, len/2)) bytes of a packet are masked by AES with the header key,
+// of the up to 16 bytes of ciphertext following them, so the header of the shortest packets is
+// masked by a sample of their checksum or authentication tag.
+type HeaderProtection struct {
+	block cipher.Block
+}
+
+// NewHeaderProtection creates the header protection with an AES header key of 16, 24 or 32 bytes,
+// which should be independent from the keys of the crypters. Both ends of a link must use the same
+// header key, see Listener.SetHeaderProtection.
+func NewHeaderProtection(key []byte) (*HeaderProtection, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(errHeaderProtection, err.Error())
+	}
+	return &HeaderProtection{block: block}, nil
+}
+
+// mask masks or unmasks the header of the packet in place and returns the packet, the sample is
+// out of the header so both are the same. A nil header protection returns the packet as it is.
+func (p *HeaderProtection) mask(packet []byte) []byte {
+	if p == nil {
+		return packet
+	}
+	n := min(hpHeaderSize, len(packet)-min(hpMinSample, len(packet)/2))
+	if n <= 0 {
+		return packet
+	}
+	sample := packet[n:min(n+hpSampleSize, len(packet))]
+
+	// the short samples are padded by 0x80 0x00 .., so they don't collide with the long ones
+	buf := cfbBuffers.Get().(*[2 * 16]byte)
+	mask, block := buf[:aes.BlockSize], buf[aes.BlockSize:]
+	clear(block)
+	copy(block, sample)
+	if len(sample) < aes.BlockSize {
+		block[len(sample)] = 0x80
+	}
+	p.block.Encrypt(mask, block)
+	if n > aes.BlockSize {
+		block[len(block)-1] ^= 1
+		p.block.Encrypt(block, block)
+	}
+	subtle.XORBytes(packet[:n], packet[:n], buf[:n])
+	cfbBuffers.Put(buf)
+	return packet
+}
@@ -0,0 +1,135 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestHeaderProtection(t *testing.T) {
+	key := knownAnswerKey()
+	hp, err := NewHeaderProtection(key[16:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := NewHeaderProtection(key[:16])
+
+	for _, method := range []string{"qpp", "salsa20", "aes", "aes-gcm", "xchacha20-poly1305", "ascon128"} {
+		keyLen, _ := CipherKeyLen(method)
+		crypter, _ := NewCipher(method, key[:keyLen])
+		v2, _ := NewVersionCrypt(crypter, WireV2)
+		for _, inner := range []Crypter{crypter, v2, NewClientCrypt(7, crypter)} {
+			for size := range 80 {
+				data := knownAnswerData()[:size]
+				clear := encryptPacket(inner, data)
+				packet := hp.mask(bytes.Clone(clear))
+
+				// the header is masked up to the sample, even for the shortest packets
+				n := min(hpHeaderSize, len(packet)-min(hpMinSample, len(packet)/2))
+				if n < hpMinSample || bytes.Equal(packet[:n], clear[:n]) {
+					t.Fatalf("%v: %d bytes header not masked", method, size)
+				}
+				if !bytes.Equal(packet[n:], clear[n:]) {
+					t.Fatalf("%v: %d bytes ciphertext altered", method, size)
+				}
+
+				out, err := decryptPacket(inner, hp.mask(bytes.Clone(packet)))
+				if err != nil || !bytes.Equal(out, data) {
+					t.Fatalf("%v: %d bytes round trip failed: %v", method, size, err)
+				}
+
+				// the header is bound to the header key, but for the empty packets of
+				// the classic ciphers, with no ciphertext chained to their nonce
+				if size == 0 {
+					continue
+				}
+				if _, err := decryptPacket(inner, other.mask(bytes.Clone(packet))); err == nil {
+					t.Fatalf("%v: %d bytes opened with another header key", method, size)
+				}
+				packet[0] ^= 1
+				if _, err := decryptPacket(inner, hp.mask(packet)); err == nil {
+					t.Fatalf("%v: %d bytes opened with a corrupted header", method, size)
+				}
+			}
+		}
+	}
+
+	if _, err := NewHeaderProtection(key[:7]); err == nil {
+		t.Fatal("invalid header key accepted")
+	}
+	if packet := []byte{1, 2, 3}; !bytes.Equal((*HeaderProtection)(nil).mask(packet), []byte{1, 2, 3}) {
+		t.Fatal("nil header protection masked")
+	}
+}
+
+// TestHeaderProtectionKnownAnswer pins the masking of the salsa20 known answer, whose
+// nonce a0 a1 .. a7 is in clear without header protection, and of its shortest packet.
+func TestHeaderProtectionKnownAnswer(t *testing.T) {
+	key := knownAnswerKey()
+	crypter, _ := NewSalsa20BlockCrypt(key)
+	defer Destroy(crypter)
+	hp, _ := NewHeaderProtection(key[:16])
+
+	for _, ka := range []struct {
+		size   int
+		packet string
+	}{
+		{100, "6a83d27d16d2cbb94e5d7cfedf4922582cee89688e50e39606540b7b36f7185b646dfdf1ee0a60fac9adfe9ae41d24662b3a50217542ae351f13fe1829893c9f7475d4466c315b6d66a0732d67c580ae79003d77f102ff8ff1cac67216024c0338be42f819ffb1a5d0e03dc6e35594326c73b726"},
+		{0, "1a2e0b17d3076a7fc1dced277c8c4877"},
+	} {
+		data := knownAnswerData()[:ka.size]
+		packet := hp.mask(encryptPacket(fixedNonceBlock{crypter, new(fixedNonces)}, data))
+		if got := hex.EncodeToString(packet); got != ka.packet {
+			t.Fatalf("%d bytes sealed %v, expected %v", ka.size, got, ka.packet)
+		}
+		if bytes.HasPrefix(packet, []byte{0xa0, 0xa1, 0xa2, 0xa3}) {
+			t.Fatal("nonce in clear")
+		}
+		if out, err := decryptPacket(crypter, hp.mask(packet)); err != nil || !bytes.Equal(out, data) {
+			t.Fatal("known answer mismatch", err)
+		}
+	}
+}
+
+func TestHeaderProtectionAllocs(t *testing.T) {
+	crypter, _ := NewSalsa20BlockCrypt(knownAnswerKey())
+	hp, _ := NewHeaderProtection(knownAnswerKey())
+	packet := encryptPacket(crypter, knownAnswerData())
+	if allocs := testing.AllocsPerRun(100, func() { hp.mask(packet) }); allocs != 0 {
+		t.Fatal("allocs per mask:", allocs)
+	}
+}
+
+func BenchmarkHeaderProtection(b *testing.B) {
+	crypter, _ := NewSalsa20BlockCrypt(make([]byte, 32))
+	hp, _ := NewHeaderProtection(make([]byte, 16))
+	data := make([]byte, 1024)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		decryptPacket(crypter, hp.mask(hp.mask(encryptPacket(crypter, data))))
+	}
+}
@@ -0,0 +1,140 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// CipherNone is the name of the cipher leaving packets unencrypted.
+const CipherNone = "none"
+
+var (
+	errUnknownCipher = errors.New("unsupported crypto method")
+	errShortKey      = errors.New("key too short")
+)
+
+// CipherFactory creates a crypter from a key of the registered length.
+type CipherFactory func(key []byte) (Crypter, error)
+
+// FactoryOf adapts a constructor of BlockCrypt, AEADCrypt or another Crypter to a CipherFactory.
+func FactoryOf[C Crypter](factory func(key []byte) (C, error)) CipherFactory {
+	return func(key []byte) (Crypter, error) {
+		crypter, err := factory(key)
+		if err != nil {
+			return nil, err
+		}
+		return crypter, nil
+	}
+}
+
+type cipherEntry struct {
+	keyLen  int
+	factory CipherFactory
+}
+
+// cipher registry
+var (
+	cipherEntries = make(map[string]cipherEntry)
+	cipherNames   []string // in registration order
+	ciphersLock   sync.RWMutex
+)
+
+func init() {
+	RegisterCipher(CipherNone, 0, func([]byte) (Crypter, error) { return nil, nil })
+	RegisterCipher("qpp", 32, FactoryOf(NewQPPCrypt))
+	RegisterCipher("sm4", 16, FactoryOf(NewSM4BlockCrypt))
+	RegisterCipher("tea", 16, FactoryOf(NewTEABlockCrypt))
+	RegisterCipher("aes", 32, FactoryOf(NewAESBlockCrypt))
+	RegisterCipher("aes-128", 16, FactoryOf(NewAESBlockCrypt))
+	RegisterCipher("aes-192", 24, FactoryOf(NewAESBlockCrypt))
+	RegisterCipher("aes-gcm", 32, FactoryOf(NewAESGCMCrypt))
+	RegisterCipher("aes-128-gcm", 16, FactoryOf(NewAESGCMCrypt))
+	RegisterCipher("blowfish", 32, FactoryOf(NewBlowfishBlockCrypt))
+	RegisterCipher("twofish", 32, FactoryOf(NewTwofishBlockCrypt))
+	RegisterCipher("cast5", 16, FactoryOf(NewCast5BlockCrypt))
+	RegisterCipher("3des", 24, FactoryOf(NewTripleDESBlockCrypt))
+	RegisterCipher("xtea", 16, FactoryOf(NewXTEABlockCrypt))
+	RegisterCipher("camellia", 32, FactoryOf(NewCamelliaBlockCrypt))
+	RegisterCipher("camellia-128", 16, FactoryOf(NewCamelliaBlockCrypt))
+	RegisterCipher("camellia-192", 24, FactoryOf(NewCamelliaBlockCrypt))
+	RegisterCipher("aria", 32, FactoryOf(NewARIABlockCrypt))
+	RegisterCipher("aria-128", 16, FactoryOf(NewARIABlockCrypt))
+	RegisterCipher("aria-192", 24, FactoryOf(NewARIABlockCrypt))
+	RegisterCipher("salsa20", 32, FactoryOf(NewSalsa20BlockCrypt))
+	RegisterCipher("chacha20-poly1305", 32, FactoryOf(NewChaCha20Poly1305Crypt))
+	RegisterCipher("xchacha20-poly1305", 32, FactoryOf(NewXChaCha20Poly1305Crypt))
+	RegisterCipher("ascon128", 16, FactoryOf(NewAscon128Crypt))
+}
+
+// RegisterCipher makes a cipher selectable by name, e.g. as the crypto method of the CLI.
+// The factory is called with keys of keyLen bytes. It panics if the name is registered twice
+// or the factory is nil, it's intended to be called from init functions.
+func RegisterCipher(name string, keyLen int, factory CipherFactory) {
+	ciphersLock.Lock()
+	defer ciphersLock.Unlock()
+	if factory == nil {
+		panic("grasshopper: RegisterCipher factory is nil")
+	}
+	if _, dup := cipherEntries[name]; dup {
+		panic("grasshopper: RegisterCipher called twice for " + name)
+	}
+	cipherEntries[name] = cipherEntry{keyLen: keyLen, factory: factory}
+	cipherNames = append(cipherNames, name)
+}
+
+// Ciphers returns the names of the registered ciphers in registration order.
+func Ciphers() []string {
+	ciphersLock.RLock()
+	defer ciphersLock.RUnlock()
+	return append([]string(nil), cipherNames...)
+}
+
+// CipherKeyLen returns the key length of the registered cipher.
+func CipherKeyLen(name string) (int, bool) {
+	ciphersLock.RLock()
+	defer ciphersLock.RUnlock()
+	entry, ok := cipherEntries[name]
+	return entry.keyLen, ok
+}
+
+// NewCipher creates the crypter of the registered cipher, with the first keyLen bytes of key.
+// The crypter is nil for CipherNone.
+func NewCipher(name string, key []byte) (Crypter, error) {
+	ciphersLock.RLock()
+	entry, ok := cipherEntries[name]
+	ciphersLock.RUnlock()
+	if !ok {
+		return nil, errors.Wrap(errUnknownCipher, name)
+	}
+	if len(key) < entry.keyLen {
+		return nil, errors.Wrapf(errShortKey, "%s requires %d bytes", name, entry.keyLen)
+	}
+	crypter, err := entry.factory(key[:entry.keyLen])
+	if err != nil {
+		return nil, err
+	}
+	return crypter, nil
+}
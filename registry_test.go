@@ -0,0 +1,104 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+// rot13Crypt is a toy cipher for testing the registry.
+type rot13Crypt struct{}
+
+func (rot13Crypt) Encrypt(dst, src []byte) {
+	for i := range src {
+		dst[i] = src[i] + 13
+	}
+}
+
+func (rot13Crypt) Decrypt(dst, src []byte) {
+	for i := range src {
+		dst[i] = src[i] - 13
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	for _, name := range []string{CipherNone, "qpp", "aes", "aes-gcm", "xchacha20-poly1305"} {
+		if !slices.Contains(Ciphers(), name) {
+			t.Fatal("missing builtin cipher", name)
+		}
+	}
+
+	key := make([]byte, 32)
+	for _, name := range Ciphers() {
+		crypter, err := NewCipher(name, key)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if (crypter == nil) != (name == CipherNone) {
+			t.Fatal(name, "unexpected crypter", crypter)
+		}
+		_, block := crypter.(BlockCrypt)
+		_, packet := crypter.(PacketCrypt)
+		if block && packet {
+			t.Fatal(name, "crypter is both a BlockCrypt and a PacketCrypt")
+		}
+	}
+
+	if _, err := NewCipher("aes-192", key[:16]); err == nil {
+		t.Fatal("short key accepted")
+	}
+	if _, err := NewCipher("rot0", key); err == nil {
+		t.Fatal("unknown cipher accepted")
+	}
+}
+
+func TestRegisterCipher(t *testing.T) {
+	factory := FactoryOf(func([]byte) (BlockCrypt, error) { return CustomBlockCrypt(rot13Crypt{}), nil })
+	if _, ok := CipherKeyLen("rot13-test"); !ok { // registered by an earlier run with -count
+		RegisterCipher("rot13-test", 0, factory)
+	}
+	if !slices.Contains(Ciphers(), "rot13-test") {
+		t.Fatal("cipher not registered")
+	}
+	if keyLen, ok := CipherKeyLen("rot13-test"); !ok || keyLen != 0 {
+		t.Fatal("unexpected key length", keyLen, ok)
+	}
+
+	crypter, err := NewCipher("rot13-test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("hello")
+	if out, err := decryptPacket(crypter, encryptPacket(crypter, data)); err != nil || !bytes.Equal(out, data) {
+		t.Fatal("round trip failed", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registered twice")
+		}
+	}()
+	RegisterCipher("rot13-test", 0, factory)
+}
@@ -0,0 +1,196 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// replayHeaderSize defines the size of the replay header prepended to the data before encryption.
+	// | sender id(8 bytes) | counter(8 bytes) | timestamp(4 bytes) | data |
+	replayHeaderSize = 20
+
+	// replayBlockBits defines the number of packets tracked by each word of the window bitmap.
+	replayBlockBits = 64
+)
+
+var (
+	errReplayed  = errors.New("replayed packet")
+	errClockSkew = errors.New("packet timestamp out of tolerance")
+	errSkew      = errors.New("clock skew tolerance below the minimum")
+)
+
+// minReplaySkew is the minimum clock skew tolerance, the timestamps are in seconds.
+const minReplaySkew = time.Second
+
+// replayGuard stamps outgoing packets with its random sender ID, a monotonically increasing
+// counter and the sending time, and drops incoming packets seen before or stamped out of the
+// skew tolerance, with a sliding window for each sender.
+//
+// The header is inside the encryption, so the windows are keyed by an identity authenticated
+// along with the packet rather than by the source address, a packet replayed from another
+// address hits the window of its sender.
+type replayGuard struct {
+	blocks  int           // number of bitmap words of each window
+	skew    time.Duration // clock skew tolerance
+	sender  uint64        // random ID of the guard as a sender
+	counter atomic.Uint64 // counter of outgoing packets
+	snmp    *Snmp         // statistics of the listener, the drops are counted in DefaultSnmp too
+
+	windows     map[uint64]*replayWindow // sender id -> window
+	swept       time.Time                // last sweep of the idle windows
+	windowsLock sync.Mutex
+}
+
+// replayWindow tracks the counters seen from a sender, as in RFC 6479.
+type replayWindow struct {
+	highest uint64    // the highest counter accepted
+	bitmap  []uint64  // ring of counter bits
+	used    time.Time // when the last packet was accepted
+}
+
+// newReplayGuard creates a replay guard tracking at least window packets per peer, counting
+// the drops in snmp.
+func newReplayGuard(window int, skew time.Duration, snmp *Snmp) *replayGuard {
+	g := new(replayGuard)
+	g.snmp = snmp
+	// one more word than required, so the window always covers full words.
+	g.blocks = (window+replayBlockBits-1)/replayBlockBits + 1
+	g.skew = skew
+	g.windows = make(map[uint64]*replayWindow)
+	g.swept = time.Now()
+	var sender [8]byte
+	_, _ = io.ReadFull(rand.Reader, sender[:])
+	g.sender = binary.LittleEndian.Uint64(sender[:])
+	// start from the wall clock, counters keep growing across restarts of the sender.
+	g.counter.Store(uint64(time.Now().UnixNano()))
+	return g
+}
+
+// seal prepends the replay header to data, it returns data untouched on a nil guard.
+func (g *replayGuard) seal(data []byte) []byte {
+	if g == nil {
+		return data
+	}
+
+	packet := make([]byte, replayHeaderSize+len(data))
+	binary.LittleEndian.PutUint64(packet, g.sender)
+	binary.LittleEndian.PutUint64(packet[8:], g.counter.Add(1))
+	binary.LittleEndian.PutUint32(packet[16:], uint32(time.Now().Unix()))
+	copy(packet[replayHeaderSize:], data)
+	return packet
+}
+
+// open validates the replay header of the data and strips it, it returns data untouched
+// on a nil guard.
+func (g *replayGuard) open(data []byte) ([]byte, error) {
+	if g == nil {
+		return data, nil
+	}
+
+	if len(data) < replayHeaderSize {
+		return nil, errShortPacket
+	}
+
+	sender := binary.LittleEndian.Uint64(data)
+	counter := binary.LittleEndian.Uint64(data[8:])
+	now := time.Now()
+	sent := time.Unix(int64(binary.LittleEndian.Uint32(data[16:])), 0)
+	if skew := now.Sub(sent); skew > g.skew || skew < -g.skew {
+		atomic.AddUint64(&DefaultSnmp.SkewDrops, 1)
+		atomic.AddUint64(&g.snmp.SkewDrops, 1)
+		return nil, errClockSkew
+	}
+
+	g.windowsLock.Lock()
+	g.sweep(now)
+	w, ok := g.windows[sender]
+	if !ok {
+		w = &replayWindow{bitmap: make([]uint64, g.blocks)}
+		g.windows[sender] = w
+	}
+	accepted := w.accept(counter)
+	if accepted {
+		w.used = now
+	}
+	g.windowsLock.Unlock()
+
+	if !accepted {
+		atomic.AddUint64(&DefaultSnmp.ReplayDrops, 1)
+		atomic.AddUint64(&g.snmp.ReplayDrops, 1)
+		return nil, errReplayed
+	}
+	return data[replayHeaderSize:], nil
+}
+
+// sweep forgets the windows of the senders idle for twice the skew tolerance, at most once
+// per skew. The packets they accepted were sent no later than the skew after their last use,
+// so the replays of them are out of the tolerance by now.
+func (g *replayGuard) sweep(now time.Time) {
+	if now.Sub(g.swept) < g.skew {
+		return
+	}
+	g.swept = now
+	for sender, w := range g.windows {
+		if now.Sub(w.used) > 2*g.skew {
+			delete(g.windows, sender)
+		}
+	}
+}
+
+// accept marks counter as seen, it returns false if the counter is a replay or
+// too old to be tracked by the window.
+func (w *replayWindow) accept(counter uint64) bool {
+	blocks := uint64(len(w.bitmap))
+	size := (blocks - 1) * replayBlockBits
+	if w.highest >= size && counter <= w.highest-size {
+		return false
+	}
+
+	index := counter / replayBlockBits
+	if counter > w.highest {
+		// slide the window forward, clearing the words passed over.
+		current := w.highest / replayBlockBits
+		diff := min(index-current, blocks)
+		for i := uint64(1); i <= diff; i++ {
+			w.bitmap[(current+i)%blocks] = 0
+		}
+		w.highest = counter
+	}
+
+	word := &w.bitmap[index%blocks]
+	bit := uint64(1) << (counter % replayBlockBits)
+	if *word&bit != 0 {
+		return false
+	}
+	*word |= bit
+	return true
+}
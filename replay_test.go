@@ -0,0 +1,118 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestReplayWindow(t *testing.T) {
+	w := &replayWindow{bitmap: make([]uint64, 3)} // tracks 128 packets
+	base := uint64(time.Now().UnixNano())
+
+	if !w.accept(base) {
+		t.Fatal("first packet dropped")
+	}
+	if w.accept(base) {
+		t.Fatal("replay accepted")
+	}
+
+	// out of order packets within the window
+	if !w.accept(base + 100) {
+		t.Fatal("newer packet dropped")
+	}
+	if !w.accept(base + 50) {
+		t.Fatal("reordered packet dropped")
+	}
+	if w.accept(base + 50) {
+		t.Fatal("reordered replay accepted")
+	}
+
+	// slide far away, the old counters fall out of the window
+	if !w.accept(base + 1000) {
+		t.Fatal("newer packet dropped")
+	}
+	if w.accept(base + 100) {
+		t.Fatal("packet older than the window accepted")
+	}
+	if !w.accept(base + 1000 - 127) {
+		t.Fatal("packet at the edge of the window dropped")
+	}
+}
+
+func TestReplayGuard(t *testing.T) {
+	sender := newReplayGuard(1024, time.Minute, newSnmp())
+	receiver := newReplayGuard(1024, time.Minute, newSnmp())
+
+	packet := sender.seal([]byte("hello"))
+	data, err := receiver.open(append([]byte(nil), packet...))
+	if err != nil || string(data) != "hello" {
+		t.Fatal("packet dropped:", err)
+	}
+
+	// replays are dropped wherever they come from, the window is of the sender
+	replays := DefaultSnmp.Copy().ReplayDrops
+	if _, err := receiver.open(append([]byte(nil), packet...)); err != errReplayed {
+		t.Fatal("replay accepted:", err)
+	}
+	if DefaultSnmp.Copy().ReplayDrops != replays+1 || receiver.snmp.ReplayDrops != 1 {
+		t.Fatal("replay not counted")
+	}
+
+	// the windows of senders are independent
+	another := newReplayGuard(1024, time.Minute, newSnmp())
+	another.counter.Store(sender.counter.Load() - 1)
+	if _, err := receiver.open(another.seal([]byte("hello"))); err != nil {
+		t.Fatal("packet dropped:", err)
+	}
+
+	// stamped out of the tolerance
+	stale := sender.seal([]byte("hello"))
+	binary.LittleEndian.PutUint32(stale[16:], uint32(time.Now().Add(-2*time.Minute).Unix()))
+	if _, err := receiver.open(stale); err != errClockSkew {
+		t.Fatal("stale packet accepted:", err)
+	}
+	if receiver.snmp.SkewDrops != 1 || sender.snmp.SkewDrops != 0 {
+		t.Fatal("skew drop not counted by the receiver")
+	}
+}
+
+func TestReplayGuardSweep(t *testing.T) {
+	sender := newReplayGuard(1024, time.Second, newSnmp())
+	receiver := newReplayGuard(1024, time.Second, newSnmp())
+	if _, err := receiver.open(sender.seal(nil)); err != nil {
+		t.Fatal("packet dropped:", err)
+	}
+
+	// idle windows are kept within twice the skew
+	receiver.sweep(time.Now().Add(1500 * time.Millisecond))
+	if len(receiver.windows) != 1 {
+		t.Fatal("window forgotten too early")
+	}
+	receiver.sweep(time.Now().Add(3 * time.Second))
+	if len(receiver.windows) != 0 {
+		t.Fatal("idle window kept")
+	}
+}
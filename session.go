@@ -0,0 +1,594 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// sessionIndexSize defines the size of the receiver index prepended to session packets.
+	// | receiver index(4 bytes) | packet |
+	sessionIndexSize = 4
+
+	// handshakeRetry defines the retransmission interval of handshake initiations.
+	handshakeRetry = time.Second
+
+	// handshakeTimeout defines how long an initiator keeps retransmitting without a response.
+	handshakeTimeout = 10 * handshakeRetry
+
+	// maxQueuedPackets limits the packets waiting for the first session to a next hop.
+	maxQueuedPackets = 128
+
+	// defaultRekeyInterval is the rekey interval if not specified.
+	defaultRekeyInterval = 2 * time.Minute
+)
+
+// HandshakeConfig defines the forward secret handshake on a side of the listener,
+// see Listener.SetHandshake.
+type HandshakeConfig struct {
+	// PSK is the pre-shared key authenticating the handshake, both ends of a link must agree.
+	PSK []byte
+
+	// NewCrypt creates the session crypter from a derived traffic key(32 bytes).
+	NewCrypt CipherFactory
+
+	// RekeyInterval defines how often the initiator negotiates new session keys,
+	// sessions expire after 3 intervals.
+	RekeyInterval time.Duration
+
+	// PostQuantum enables the hybrid ML-KEM-768 + X25519 key agreement, both ends of a link must agree.
+	PostQuantum bool
+
+	// Identity enables the mutual authentication by static identities, with the Noise IKpsk0
+	// handshake, both ends of a link must agree. Peers lists the identities authorized.
+	Identity *Identity
+
+	// Peers are the identities of the peers authorized with Identity. A responder accepts
+	// handshakes only from the peers listed, and an initiator handshakes only with the next
+	// hops listed by their addresses, the packets to other next hops are dropped.
+	Peers []Peer
+
+	// MTU limits the size of the handshake packets encrypted by the crypter of the side, not
+	// counting the mimicry framing, DefaultPaddingMTU is used if it's 0. The hybrid initiations
+	// are the largest, a crypter with too much overhead is refused rather than fragmenting them.
+	MTU int
+}
+
+// Peer is an identity authorized in the handshakes, see HandshakeConfig.Peers.
+type Peer struct {
+	// PublicKey is the public key of the identity.
+	PublicKey PublicKey
+
+	// Address is the "IP:port" of the next hop with the identity, ignored by responders.
+	Address string
+}
+
+// session holds the traffic crypters negotiated by a handshake.
+type session struct {
+	local   uint32  // index of the session on this side
+	remote  uint32  // index of the session on the peer
+	send    Crypter // crypter for the packets to the peer
+	recv    Crypter // crypter for the packets from the peer
+	created time.Time
+
+	destroyed bool         // the keys have been zeroed
+	mu        sync.RWMutex // held while encrypting and decrypting, so the keys are not destroyed meanwhile
+}
+
+// outgoing is a packet to be sent by the listener, to the client `ctx` via the
+// listener socket if conn is nil, or via conn to the next hop otherwise.
+type outgoing struct {
+	conn   net.Conn
+	ctx    net.Addr
+	packet []byte
+}
+
+// nextHopState tracks the handshake of the initiator with a next hop.
+type nextHopState struct {
+	current *session
+	pending *handshakeState
+	started time.Time // when the pending handshake started
+	sent    time.Time // when the initiation was sent last time
+	conn    net.Conn  // the connection to retransmit on
+	ctx     net.Addr
+	queue   []outgoing // packets waiting for the first session
+
+	initiating bool // an initiation is being created outside of h.mu
+}
+
+// handshaker negotiates and holds the sessions of one side of the listener,
+// it initiates handshakes on the side of next hops and responds on the side of clients.
+// The public key operations of the handshakes run outside of h.mu, which is held only
+// to look up and install the sessions, so the packets of the established sessions are
+// not held up by a flood of handshakes.
+type handshaker struct {
+	config    HandshakeConfig
+	static    Crypter // crypter for handshake messages
+	lifetime  time.Duration
+	initiator bool
+
+	identity   *ecdh.PrivateKey           // nil without static identities
+	authorized map[[32]byte]bool          // responder: X25519 public keys of the authorized peers
+	peerKeys   map[string]*ecdh.PublicKey // initiator: next hop address -> X25519 public key
+
+	sessions map[uint32]*session      // local index -> session
+	peers    map[string]*session      // responder: peer address -> latest session
+	nextHops map[string]*nextHopState // initiator: next hop address -> handshake state
+
+	timestamps  map[[32]byte][]byte    // responder: static key of the initiator -> latest initiation timestamp
+	initiations map[[32]byte]time.Time // responder: ephemeral key of the recent initiations -> timestamp
+	mu          sync.Mutex
+	pskMu       sync.RWMutex // held for reading by the handshakes outside of h.mu, so the PSK is not wiped meanwhile
+}
+
+func newHandshaker(config *HandshakeConfig, static Crypter, initiator bool) *handshaker {
+	h := new(handshaker)
+	h.config = *config
+	h.config.PSK = cloneSecret(config.PSK)
+	if h.config.RekeyInterval <= 0 {
+		h.config.RekeyInterval = defaultRekeyInterval
+	}
+	h.lifetime = 3 * h.config.RekeyInterval
+	h.static = static
+	h.initiator = initiator
+	h.sessions = make(map[uint32]*session)
+	h.peers = make(map[string]*session)
+	h.nextHops = make(map[string]*nextHopState)
+	h.timestamps = make(map[[32]byte][]byte)
+	h.initiations = make(map[[32]byte]time.Time)
+	if config.Identity != nil {
+		h.identity = config.Identity.static
+		h.authorized = make(map[[32]byte]bool)
+		h.peerKeys = make(map[string]*ecdh.PublicKey)
+		for _, peer := range config.Peers {
+			pub, err := peer.PublicKey.x25519()
+			if err != nil {
+				continue // never authorized
+			}
+			h.authorized[[32]byte(pub.Bytes())] = true
+			if peer.Address != "" {
+				h.peerKeys[peer.Address] = pub
+			}
+		}
+	}
+	return h
+}
+
+// authorize reports whether the X25519 public key of a peer is authorized.
+func (h *handshaker) authorize(pub *ecdh.PublicKey) bool {
+	return h.authorized[[32]byte(pub.Bytes())]
+}
+
+// checkHandshakeMTU returns an error if the initiations encrypted by static exceed the mtu of config.
+func checkHandshakeMTU(config *HandshakeConfig, static Crypter) error {
+	mtu := config.MTU
+	if mtu == 0 {
+		mtu = DefaultPaddingMTU
+	}
+	size := len(encryptPacket(static, make([]byte, initiationSizeOf(config.PostQuantum, config.Identity != nil))))
+	if size > mtu {
+		return errors.Wrapf(errHandshakeSize, "initiation of %d bytes, mtu %d", size, mtu)
+	}
+	return nil
+}
+
+// fresh reports whether an initiation is not replayed, by its timestamp along with the static key
+// of the initiator, or its ephemeral key without static identities, h.mu must be held.
+func (h *handshaker) fresh(rs, re *ecdh.PublicKey, timestamp []byte) bool {
+	if rs != nil {
+		key := [32]byte(rs.Bytes())
+		if bytes.Compare(timestamp, h.timestamps[key]) <= 0 {
+			return false
+		}
+		h.timestamps[key] = bytes.Clone(timestamp)
+		return true
+	}
+
+	t := parseTAI64N(timestamp)
+	if d := time.Since(t); d > handshakeSkew || d < -handshakeSkew {
+		return false
+	}
+	key := [32]byte(re.Bytes())
+	if _, ok := h.initiations[key]; ok {
+		return false
+	}
+	h.initiations[key] = t
+	return true
+}
+
+// newIndex allocates a random unused session index, h.mu must be held.
+func (h *handshaker) newIndex() uint32 {
+	var b [4]byte
+	for {
+		_, _ = rand.Read(b[:])
+		index := binary.LittleEndian.Uint32(b[:])
+		if _, ok := h.sessions[index]; !ok && index != 0 {
+			return index
+		}
+	}
+}
+
+// newSession installs a session from the negotiated traffic keys, h.mu must be held.
+func (h *handshaker) newSession(local, remote uint32, send, recv []byte) (*session, error) {
+	defer clear(send)
+	defer clear(recv)
+
+	s := &session{local: local, remote: remote, created: time.Now()}
+	var err error
+	if s.send, err = h.config.NewCrypt(send); err != nil {
+		return nil, err
+	}
+	if s.recv, err = h.config.NewCrypt(recv); err != nil {
+		Destroy(s.send)
+		return nil, err
+	}
+	h.sessions[local] = s
+	return s, nil
+}
+
+// destroy zeroes the keys of the session.
+func (s *session) destroy() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.destroyed {
+		s.destroyed = true
+		Destroy(s.send)
+		Destroy(s.recv)
+	}
+}
+
+// seal encrypts data with the session for the packet, prepending the receiver index.
+// It returns nil if the session has expired meanwhile.
+func (s *session) seal(data []byte) []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.destroyed {
+		return nil
+	}
+	sealed := encryptPacket(s.send, data)
+
+	packet := make([]byte, sessionIndexSize+len(sealed))
+	binary.LittleEndian.PutUint32(packet, s.remote)
+	copy(packet[sessionIndexSize:], sealed)
+	return packet
+}
+
+// open decrypts a packet from peer, handshake messages are consumed and answered
+// with the returned outgoing packets, leaving data nil.
+func (h *handshaker) open(peer net.Addr, packet []byte) (data []byte, out []outgoing, err error) {
+	if len(packet) >= sessionIndexSize {
+		h.mu.Lock()
+		s, ok := h.sessions[binary.LittleEndian.Uint32(packet)]
+		h.mu.Unlock()
+
+		if ok {
+			s.mu.RLock()
+			if s.destroyed {
+				err = errors.WithStack(errSessionExpired)
+			} else {
+				data, err = decryptPacket(s.recv, packet[sessionIndexSize:])
+			}
+			s.mu.RUnlock()
+			if err != nil {
+				return nil, nil, err
+			}
+			if !h.initiator {
+				h.mu.Lock()
+				h.peers[peer.String()] = s
+				h.mu.Unlock()
+			}
+			return data, nil, nil
+		}
+	}
+
+	// not a session packet, try to read a handshake message
+	msg, err := decryptPacket(h.static, packet)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if h.initiator {
+		return nil, h.consumeResponse(msg), nil
+	}
+	return nil, h.consumeInitiation(peer, msg), nil
+}
+
+// consumeInitiation answers an initiation and installs the session as a responder.
+func (h *handshaker) consumeInitiation(peer net.Addr, msg []byte) []outgoing {
+	h.mu.Lock()
+	local := h.newIndex()
+	h.mu.Unlock()
+
+	fresh := func(rs, re *ecdh.PublicKey, timestamp []byte) bool {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return h.fresh(rs, re, timestamp)
+	}
+	h.pskMu.RLock()
+	if h.config.PSK == nil {
+		h.pskMu.RUnlock()
+		return nil // destroyed
+	}
+	response, remote, send, recv, err := consumeInitiation(h.config.PSK, msg, local, h.config.PostQuantum, h.identity, h.authorize, fresh)
+	h.pskMu.RUnlock()
+	if err != nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.sessions[local]; ok {
+		// the index was taken by another handshake meanwhile, the initiator retries
+		clear(send)
+		clear(recv)
+		return nil
+	}
+	s, err := h.newSession(local, remote, send, recv)
+	if err != nil {
+		return nil
+	}
+	h.peers[peer.String()] = s
+	return []outgoing{{ctx: peer, packet: encryptPacket(h.static, response)}}
+}
+
+// consumeResponse completes a pending handshake as an initiator, flushing the queued packets.
+func (h *handshaker) consumeResponse(msg []byte) (out []outgoing) {
+	index, ok := responseIndex(msg)
+	if !ok {
+		return nil
+	}
+
+	h.mu.Lock()
+	var state *nextHopState
+	for _, s := range h.nextHops {
+		if s.pending != nil && s.pending.index == index {
+			state = s
+			break
+		}
+	}
+	if state == nil {
+		h.mu.Unlock()
+		return nil
+	}
+	pending := state.pending
+	h.mu.Unlock()
+
+	remote, send, recv, err := pending.consumeResponse(msg)
+	if err != nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if state.pending != pending {
+		// completed, retransmitted or given up meanwhile
+		clear(send)
+		clear(recv)
+		return nil
+	}
+	s, err := h.newSession(index, remote, send, recv)
+	if err != nil {
+		return nil
+	}
+
+	// the previous session is kept in h.sessions until it expires, for the packets in flight.
+	state.current = s
+	state.pending = nil
+	for _, p := range state.queue {
+		out = append(out, outgoing{conn: p.conn, ctx: p.ctx, packet: s.seal(p.packet)})
+	}
+	state.queue = nil
+	return out
+}
+
+// sealTo encrypts data to the next hop behind conn as an initiator, starting a
+// handshake if the session is missing or due to rekey. The data is queued if no
+// session is available yet.
+func (h *handshaker) sealTo(conn net.Conn, ctx net.Addr, data []byte) (out []outgoing) {
+	nextHop := conn.RemoteAddr().String()
+	if h.identity != nil && h.peerKeys[nextHop] == nil {
+		return nil // unverifiable next hop
+	}
+
+	h.mu.Lock()
+	state, ok := h.nextHops[nextHop]
+	if !ok {
+		state = new(nextHopState)
+		h.nextHops[nextHop] = state
+	}
+
+	now := time.Now()
+	var index uint32
+	start := state.pending == nil && !state.initiating && (state.current == nil || now.Sub(state.current.created) > h.config.RekeyInterval)
+	if start {
+		state.initiating = true
+		index = h.newIndex()
+	}
+
+	if state.pending != nil || state.initiating {
+		// retransmit on the latest connection in use
+		state.conn, state.ctx = conn, ctx
+	}
+
+	current := state.current
+	if current == nil && len(state.queue) < maxQueuedPackets {
+		state.queue = append(state.queue, outgoing{conn: conn, ctx: ctx, packet: data})
+	}
+	h.mu.Unlock()
+
+	if start {
+		hs, packet := h.initiate(nextHop, index)
+		h.mu.Lock()
+		state.initiating = false
+		if hs != nil {
+			state.pending = hs
+			state.started = now
+			state.sent = now
+		}
+		h.mu.Unlock()
+		if packet != nil {
+			out = append(out, outgoing{conn: conn, ctx: ctx, packet: packet})
+		}
+	}
+
+	if current != nil {
+		if packet := current.seal(data); packet != nil {
+			out = append(out, outgoing{conn: conn, ctx: ctx, packet: packet})
+		}
+	}
+	return out
+}
+
+// initiate creates an initiation of the handshake with a next hop, returning the handshake
+// state and the packet, or nils if it fails. The retransmissions are new initiations with the
+// same index, since the responder refuses the initiations seen before. h.mu must not be held,
+// the public key operations are done outside of it.
+func (h *handshaker) initiate(nextHop string, index uint32) (*handshakeState, []byte) {
+	h.pskMu.RLock()
+	defer h.pskMu.RUnlock()
+	if h.config.PSK == nil {
+		return nil, nil // destroyed
+	}
+	hs, msg, err := newInitiation(h.config.PSK, index, h.config.PostQuantum, h.identity, h.peerKeys[nextHop])
+	if err != nil {
+		return nil, nil
+	}
+	return hs, encryptPacket(h.static, msg)
+}
+
+// seal encrypts data to peer as a responder, it returns nil if the peer has no session.
+func (h *handshaker) seal(peer net.Addr, data []byte) []byte {
+	h.mu.Lock()
+	s, ok := h.peers[peer.String()]
+	h.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return s.seal(data)
+}
+
+// remove forgets the session used by peer.
+func (h *handshaker) remove(peer net.Addr) {
+	h.mu.Lock()
+	delete(h.peers, peer.String())
+	h.mu.Unlock()
+}
+
+// destroy zeroes the keys of the sessions and the PSK.
+func (h *handshaker) destroy() {
+	h.mu.Lock()
+	for _, s := range h.sessions {
+		s.destroy()
+	}
+	h.mu.Unlock()
+
+	h.pskMu.Lock()
+	defer h.pskMu.Unlock()
+	WipeSecret(h.config.PSK)
+	h.config.PSK = nil
+}
+
+// tick retransmits the pending initiations and expires the sessions, it's called
+// periodically and returns the packets to send.
+func (h *handshaker) tick(now time.Time) (out []outgoing) {
+	type retransmission struct {
+		state   *nextHopState
+		nextHop string
+		pending *handshakeState
+	}
+	var retransmissions []retransmission
+
+	h.mu.Lock()
+	for index, s := range h.sessions {
+		if now.Sub(s.created) > h.lifetime {
+			delete(h.sessions, index)
+			s.destroy()
+		}
+	}
+
+	for peer, s := range h.peers {
+		if _, ok := h.sessions[s.local]; !ok {
+			delete(h.peers, peer)
+		}
+	}
+
+	// the initiations out of the skew are refused by their timestamps already
+	for key, t := range h.initiations {
+		if now.Sub(t) > handshakeSkew {
+			delete(h.initiations, key)
+		}
+	}
+
+	for nextHop, state := range h.nextHops {
+		if state.current != nil {
+			if _, ok := h.sessions[state.current.local]; !ok {
+				state.current = nil
+			}
+		}
+
+		if state.pending == nil {
+			if state.current == nil && !state.initiating {
+				delete(h.nextHops, nextHop)
+			}
+			continue
+		}
+
+		if now.Sub(state.started) > handshakeTimeout {
+			// give up, the next packet to the next hop starts over.
+			state.pending = nil
+			state.queue = nil
+			continue
+		}
+
+		if now.Sub(state.sent) >= handshakeRetry {
+			state.sent = now
+			retransmissions = append(retransmissions, retransmission{state, nextHop, state.pending})
+		}
+	}
+	h.mu.Unlock()
+
+	// the new initiations are created outside of h.mu, and replace the pending ones unless
+	// the handshakes are completed or given up meanwhile.
+	for _, r := range retransmissions {
+		hs, packet := h.initiate(r.nextHop, r.pending.index)
+		if hs == nil {
+			continue
+		}
+		h.mu.Lock()
+		if r.state.pending == r.pending {
+			r.state.pending = hs
+			out = append(out, outgoing{conn: r.state.conn, ctx: r.state.ctx, packet: packet})
+		}
+		h.mu.Unlock()
+	}
+	return out
+}
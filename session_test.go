@@ -0,0 +1,437 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// newHandshakePair creates an initiator and a responder sharing the psk, and a
+// connection standing for the next hop of the initiator.
+func newHandshakePair(t *testing.T, rekey time.Duration) (initiator, responder *handshaker, conn net.Conn) {
+	return newHandshakePairWithConfig(t, &HandshakeConfig{
+		PSK:           []byte("psk"),
+		NewCrypt:      func(key []byte) (Crypter, error) { return NewAESGCMCrypt(key) },
+		RekeyInterval: rekey,
+	})
+}
+
+func newHandshakePairWithConfig(t *testing.T, config *HandshakeConfig) (initiator, responder *handshaker, conn net.Conn) {
+	pass := make([]byte, 32)
+	static, _ := NewAESGCMCrypt(pass)
+
+	conn, err := net.Dial("udp", "127.0.0.1:9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return newHandshaker(config, static, true), newHandshaker(config, static, false), conn
+}
+
+// deliver passes the packets from the initiator to the responder, returning the data and the replies.
+func deliver(t *testing.T, responder *handshaker, peer net.Addr, out []outgoing) (data [][]byte, replies []outgoing) {
+	for _, o := range out {
+		d, r, err := responder.open(peer, bytes.Clone(o.packet)) // decrypted in place
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d != nil {
+			data = append(data, d)
+		}
+		replies = append(replies, r...)
+	}
+	return data, replies
+}
+
+func TestHandshake(t *testing.T) {
+	initiator, responder, conn := newHandshakePair(t, time.Minute)
+	client := conn.LocalAddr()
+	peer := conn.LocalAddr() // the address of the initiator seen by the responder
+
+	// the first packet is queued behind the initiation
+	out := initiator.sealTo(conn, client, []byte("hello"))
+	if len(out) != 1 {
+		t.Fatalf("expected 1 initiation, got %d packets", len(out))
+	}
+
+	data, replies := deliver(t, responder, peer, out)
+	if len(data) != 0 || len(replies) != 1 {
+		t.Fatalf("unexpected handshake result: %d data, %d replies", len(data), len(replies))
+	}
+
+	// the response flushes the queue
+	_, flushed, err := initiator.open(conn.RemoteAddr(), replies[0].packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = deliver(t, responder, peer, flushed)
+	if len(data) != 1 || !bytes.Equal(data[0], []byte("hello")) {
+		t.Fatal("queued packet mismatch")
+	}
+
+	// data in both directions
+	data, _ = deliver(t, responder, peer, initiator.sealTo(conn, client, []byte("world")))
+	if len(data) != 1 || !bytes.Equal(data[0], []byte("world")) {
+		t.Fatal("session packet mismatch")
+	}
+
+	packet := responder.seal(peer, []byte("reply"))
+	if packet == nil {
+		t.Fatal("no session on responder")
+	}
+	reply, _, err := initiator.open(conn.RemoteAddr(), packet)
+	if err != nil || !bytes.Equal(reply, []byte("reply")) {
+		t.Fatal("reply mismatch", err)
+	}
+
+	// session keys are not the handshake keys
+	if _, err := decryptPacket(initiator.static, packet[sessionIndexSize:]); err == nil {
+		t.Fatal("session packet decrypted by the static crypter")
+	}
+}
+
+func TestHandshakeDestroyed(t *testing.T) {
+	initiator, responder, conn := newHandshakePair(t, time.Minute)
+	peer := conn.LocalAddr()
+
+	_, replies := deliver(t, responder, peer, initiator.sealTo(conn, peer, []byte("hello")))
+	if _, _, err := initiator.open(conn.RemoteAddr(), replies[0].packet); err != nil {
+		t.Fatal(err)
+	}
+	packet := initiator.sealTo(conn, peer, []byte("world"))[0].packet
+
+	// the sessions destroyed neither seal nor open
+	responder.destroy()
+	responder.destroy()
+	if responder.seal(peer, []byte("reply")) != nil {
+		t.Fatal("sealed by a destroyed session")
+	}
+	if _, _, err := responder.open(peer, packet); errors.Cause(err) != errSessionExpired {
+		t.Fatal("expected errSessionExpired, got", err)
+	}
+}
+
+func TestHandshakeLoss(t *testing.T) {
+	initiator, responder, conn := newHandshakePair(t, time.Minute)
+	client := conn.LocalAddr()
+	peer := conn.LocalAddr()
+
+	// drop the initiation
+	initiator.sealTo(conn, client, []byte("hello"))
+	if out := initiator.tick(time.Now()); len(out) != 0 {
+		t.Fatal("retransmitted too early")
+	}
+
+	// drop the response of the retransmission
+	out := initiator.tick(time.Now().Add(handshakeRetry))
+	if len(out) != 1 {
+		t.Fatalf("expected 1 retransmission, got %d", len(out))
+	}
+	deliver(t, responder, peer, out)
+
+	// the responder answers the next retransmission again
+	out = initiator.tick(time.Now().Add(2 * handshakeRetry))
+	_, replies := deliver(t, responder, peer, out)
+	if len(replies) != 1 {
+		t.Fatalf("expected 1 response, got %d", len(replies))
+	}
+
+	_, flushed, err := initiator.open(conn.RemoteAddr(), replies[0].packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := deliver(t, responder, peer, flushed)
+	if len(data) != 1 || !bytes.Equal(data[0], []byte("hello")) {
+		t.Fatal("queued packet mismatch")
+	}
+
+	// give up after the handshake timeout
+	initiator, _, conn = newHandshakePair(t, time.Minute)
+	initiator.sealTo(conn, client, []byte("hello"))
+	initiator.tick(time.Now().Add(handshakeTimeout + time.Second))
+	if out := initiator.tick(time.Now().Add(handshakeTimeout + 2*time.Second)); len(out) != 0 {
+		t.Fatal("retransmitted after timeout")
+	}
+}
+
+func TestHandshakeRekey(t *testing.T) {
+	initiator, responder, conn := newHandshakePair(t, time.Millisecond)
+	client := conn.LocalAddr()
+	peer := conn.LocalAddr()
+
+	var indexes []uint32
+	for range 3 {
+		out := initiator.sealTo(conn, client, []byte("data"))
+		_, replies := deliver(t, responder, peer, out[:1])
+		if len(replies) != 1 {
+			t.Fatalf("expected 1 response, got %d", len(replies))
+		}
+		if _, _, err := initiator.open(conn.RemoteAddr(), replies[0].packet); err != nil {
+			t.Fatal(err)
+		}
+
+		state := initiator.nextHops[conn.RemoteAddr().String()]
+		indexes = append(indexes, state.current.local)
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	if indexes[0] == indexes[1] || indexes[1] == indexes[2] {
+		t.Fatal("session not rekeyed", indexes)
+	}
+
+	// the old sessions expire
+	initiator.tick(time.Now().Add(time.Second))
+	if len(initiator.sessions) != 0 {
+		t.Fatal("sessions not expired", len(initiator.sessions))
+	}
+}
+
+func TestHandshakeWrongPSK(t *testing.T) {
+	initiator, responder, conn := newHandshakePair(t, time.Minute)
+	responder.config.PSK = []byte("wrong")
+
+	out := initiator.sealTo(conn, conn.LocalAddr(), []byte("hello"))
+	data, replies := deliver(t, responder, conn.LocalAddr(), out)
+	if len(data) != 0 || len(replies) != 0 {
+		t.Fatal("handshake accepted with wrong psk")
+	}
+}
+
+func TestHandshakeHybrid(t *testing.T) {
+	initiator, responder, conn := newHandshakePairWithConfig(t, &HandshakeConfig{
+		PSK:         []byte("psk"),
+		NewCrypt:    func(key []byte) (Crypter, error) { return NewQPPCrypt(key) },
+		PostQuantum: true,
+	})
+	peer := conn.LocalAddr()
+
+	out := initiator.sealTo(conn, peer, []byte("hello"))
+	if len(out) != 1 {
+		t.Fatalf("expected 1 initiation, got %d packets", len(out))
+	}
+	_, replies := deliver(t, responder, peer, out)
+	if len(replies) != 1 {
+		t.Fatalf("expected 1 response, got %d", len(replies))
+	}
+	_, flushed, err := initiator.open(conn.RemoteAddr(), replies[0].packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := deliver(t, responder, peer, flushed)
+	if len(data) != 1 || !bytes.Equal(data[0], []byte("hello")) {
+		t.Fatal("queued packet mismatch")
+	}
+
+	// a classic responder doesn't accept hybrid initiations
+	responder.config.PostQuantum = false
+	initiator.nextHops = make(map[string]*nextHopState)
+	out = initiator.sealTo(conn, peer, []byte("hello"))
+	if _, replies = deliver(t, responder, peer, out); len(replies) != 0 {
+		t.Fatal("hybrid initiation accepted by classic responder")
+	}
+}
+
+func TestHandshakeMTU(t *testing.T) {
+	key := make([]byte, 32)
+	aes, _ := NewAESBlockCrypt(key)
+	gcm, _ := NewAESGCMCrypt(key)
+	mac, _ := NewMACCrypt(aes, MACBLAKE2b, key, 64)
+	qpp, _ := NewQPPCrypt(key)
+	padded, _ := NewPaddingCrypt(gcm, MTUPadding(), 0)
+	id, _ := GenerateIdentity()
+
+	// the largest message, the hybrid initiation with static identities
+	_, initiation, err := newInitiation([]byte("psk"), 1, true, id.static, id.static.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(initiation) != initiationSizeOf(true, true) {
+		t.Fatalf("initiation size %d, expected %d", len(initiation), initiationSizeOf(true, true))
+	}
+
+	config := &HandshakeConfig{PSK: []byte("psk"), PostQuantum: true, Identity: id}
+	for _, static := range []Crypter{nil, aes, gcm, mac, qpp, padded} {
+		if err := checkHandshakeMTU(config, static); err != nil {
+			t.Fatalf("%T: %v", static, err)
+		}
+		if len(encryptPacket(static, initiation)) > DefaultPaddingMTU {
+			t.Fatalf("%T: initiation exceeds mtu %d", static, DefaultPaddingMTU)
+		}
+	}
+
+	// a listener refuses the handshake if the initiations don't fit
+	listener, err := ListenWithOptions("localhost:0", []string{"127.0.0.1:9"}, 1024*1024, time.Second, mac, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	small := *config
+	small.MTU = initiationSizeOf(true, true)
+	if err := listener.SetHandshake(&small, nil); errors.Cause(err) != errHandshakeSize {
+		t.Fatal("oversized handshake accepted", err)
+	}
+	small.PostQuantum = false
+	if err := listener.SetHandshake(&small, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandshakeReplay(t *testing.T) {
+	initiator, responder, conn := newHandshakePair(t, time.Minute)
+	peer := conn.LocalAddr()
+
+	out := initiator.sealTo(conn, peer, []byte("hello"))
+	if _, replies := deliver(t, responder, peer, out); len(replies) != 1 {
+		t.Fatalf("expected 1 response, got %d", len(replies))
+	}
+
+	// a replayed initiation allocates nothing, from any address
+	for _, from := range []net.Addr{peer, conn.RemoteAddr()} {
+		if _, replies := deliver(t, responder, from, out); len(replies) != 0 || len(responder.sessions) != 1 {
+			t.Fatal("replayed initiation accepted")
+		}
+	}
+
+	// nor does an initiation out of the clock skew
+	hs, _, err := newInitiation(responder.config.PSK, 1, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !responder.fresh(nil, hs.e.PublicKey(), tai64n(time.Now())) {
+		t.Fatal("fresh initiation refused")
+	}
+	if responder.fresh(nil, hs.e.PublicKey(), tai64n(time.Now().Add(handshakeSkew+time.Second))) {
+		t.Fatal("initiation out of skew accepted")
+	}
+
+	// with static identities, the timestamps of each initiator only move forward
+	id, _ := GenerateIdentity()
+	rs, now := id.static.PublicKey(), time.Now()
+	if !responder.fresh(rs, nil, tai64n(now)) || responder.fresh(rs, nil, tai64n(now)) || responder.fresh(rs, nil, tai64n(now.Add(-time.Second))) {
+		t.Fatal("stale initiation accepted")
+	}
+	if !responder.fresh(rs, nil, tai64n(now.Add(time.Nanosecond))) {
+		t.Fatal("later initiation refused")
+	}
+
+	// the retransmissions are new initiations
+	initiator.nextHops = make(map[string]*nextHopState)
+	initiator.sealTo(conn, peer, []byte("hello"))
+	first := initiator.tick(time.Now().Add(handshakeRetry))
+	second := initiator.tick(time.Now().Add(2 * handshakeRetry))
+	if len(first) != 1 || len(second) != 1 || bytes.Equal(first[0].packet, second[0].packet) {
+		t.Fatal("initiation retransmitted as is")
+	}
+	for _, o := range [][]outgoing{first, second} {
+		if _, replies := deliver(t, responder, peer, o); len(replies) != 1 {
+			t.Fatal("retransmission refused")
+		}
+	}
+
+	// the initiations out of the skew are forgotten
+	responder.tick(time.Now().Add(handshakeSkew + time.Second))
+	if len(responder.initiations) != 0 {
+		t.Fatal("initiations not swept", len(responder.initiations))
+	}
+}
+
+func TestHandshakeIdentity(t *testing.T) {
+	static, _ := NewAESGCMCrypt(make([]byte, 32))
+	conn, err := net.Dial("udp", "127.0.0.1:9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer := conn.LocalAddr()
+	nextHop := conn.RemoteAddr().String()
+
+	var ids [3]*Identity
+	for i := range ids {
+		if ids[i], err = GenerateIdentity(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hop, responderID, stranger := ids[0], ids[1], ids[2]
+
+	newPair := func(initiatorID *Identity, nextHopKey PublicKey, hybrid bool) (initiator, responder *handshaker) {
+		config := HandshakeConfig{
+			PSK:         []byte("psk"),
+			NewCrypt:    func(key []byte) (Crypter, error) { return NewAESGCMCrypt(key) },
+			PostQuantum: hybrid,
+		}
+		in, out := config, config
+		out.Identity, out.Peers = initiatorID, []Peer{{PublicKey: nextHopKey, Address: nextHop}}
+		in.Identity, in.Peers = responderID, []Peer{{PublicKey: hop.PublicKey()}}
+		return newHandshaker(&out, static, true), newHandshaker(&in, static, false)
+	}
+
+	for _, hybrid := range []bool{false, true} {
+		initiator, responder := newPair(hop, responderID.PublicKey(), hybrid)
+		out := initiator.sealTo(conn, peer, []byte("hello"))
+		if len(out) != 1 {
+			t.Fatalf("expected 1 initiation, got %d packets", len(out))
+		}
+		_, replies := deliver(t, responder, peer, out)
+		if len(replies) != 1 {
+			t.Fatalf("hybrid %v: expected 1 response, got %d", hybrid, len(replies))
+		}
+		_, flushed, err := initiator.open(conn.RemoteAddr(), replies[0].packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := deliver(t, responder, peer, flushed)
+		if len(data) != 1 || !bytes.Equal(data[0], []byte("hello")) {
+			t.Fatal("queued packet mismatch")
+		}
+	}
+
+	// an unknown initiator is refused
+	initiator, responder := newPair(stranger, responderID.PublicKey(), false)
+	if _, replies := deliver(t, responder, peer, initiator.sealTo(conn, peer, []byte("hello"))); len(replies) != 0 {
+		t.Fatal("handshake accepted from unknown peer")
+	}
+
+	// a responder without the expected identity can't answer
+	initiator, responder = newPair(hop, stranger.PublicKey(), false)
+	if _, replies := deliver(t, responder, peer, initiator.sealTo(conn, peer, []byte("hello"))); len(replies) != 0 {
+		t.Fatal("handshake accepted for another identity")
+	}
+
+	// an initiation without identity is refused
+	initiator, responder = newPair(hop, responderID.PublicKey(), false)
+	anonymous := newHandshaker(&HandshakeConfig{PSK: []byte("psk"), NewCrypt: initiator.config.NewCrypt}, static, true)
+	if _, replies := deliver(t, responder, peer, anonymous.sealTo(conn, peer, []byte("hello"))); len(replies) != 0 {
+		t.Fatal("handshake accepted without identity")
+	}
+
+	// nothing is sent to next hops not listed
+	initiator.peerKeys = nil
+	if out := initiator.sealTo(conn, peer, []byte("hello")); len(out) != 0 || len(initiator.nextHops) != 0 {
+		t.Fatal("packets sent to unverified next hop")
+	}
+}
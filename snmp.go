@@ -0,0 +1,97 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Snmp defines network statistics indicator
+type Snmp struct {
+	InPkts      uint64 // packets received from clients and next hops
+	OutPkts     uint64 // packets forwarded to clients and next hops
+	InErrs      uint64 // packets failed to decrypt or authenticate
+	ReplayDrops uint64 // packets dropped as replays
+	SkewDrops   uint64 // packets dropped for clock skew
+	QueueDrops  uint64 // packets dropped for full worker queues
+}
+
+func newSnmp() *Snmp {
+	return new(Snmp)
+}
+
+// Header returns all field names
+func (s *Snmp) Header() []string {
+	return []string{
+		"InPkts",
+		"OutPkts",
+		"InErrs",
+		"ReplayDrops",
+		"SkewDrops",
+		"QueueDrops",
+	}
+}
+
+// ToSlice returns current snmp info as slice
+func (s *Snmp) ToSlice() []string {
+	snmp := s.Copy()
+	return []string{
+		fmt.Sprint(snmp.InPkts),
+		fmt.Sprint(snmp.OutPkts),
+		fmt.Sprint(snmp.InErrs),
+		fmt.Sprint(snmp.ReplayDrops),
+		fmt.Sprint(snmp.SkewDrops),
+		fmt.Sprint(snmp.QueueDrops),
+	}
+}
+
+// Copy make a copy of current snmp snapshot
+func (s *Snmp) Copy() *Snmp {
+	d := newSnmp()
+	d.InPkts = atomic.LoadUint64(&s.InPkts)
+	d.OutPkts = atomic.LoadUint64(&s.OutPkts)
+	d.InErrs = atomic.LoadUint64(&s.InErrs)
+	d.ReplayDrops = atomic.LoadUint64(&s.ReplayDrops)
+	d.SkewDrops = atomic.LoadUint64(&s.SkewDrops)
+	d.QueueDrops = atomic.LoadUint64(&s.QueueDrops)
+	return d
+}
+
+// Reset values to zero
+func (s *Snmp) Reset() {
+	atomic.StoreUint64(&s.InPkts, 0)
+	atomic.StoreUint64(&s.OutPkts, 0)
+	atomic.StoreUint64(&s.InErrs, 0)
+	atomic.StoreUint64(&s.ReplayDrops, 0)
+	atomic.StoreUint64(&s.SkewDrops, 0)
+	atomic.StoreUint64(&s.QueueDrops, 0)
+}
+
+// DefaultSnmp is the global grasshopper connection statistics collector, adding up the
+// statistics of all the listeners, see Listener.Snmp for those of a listener.
+var DefaultSnmp *Snmp
+
+func init() {
+	DefaultSnmp = newSnmp()
+}
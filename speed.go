@@ -0,0 +1,91 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var errSpeed = errors.New("cipher speed measurement failed")
+
+// speedBatch is the number of packets between the checks of the elapsed time.
+const speedBatch = 64
+
+// CipherSpeed is the speed of a crypter measured by MeasureCipher.
+type CipherSpeed struct {
+	Size    int           // bytes of data in a packet
+	Packets int           // packets encrypted and decrypted
+	Elapsed time.Duration // time taken
+}
+
+// NsPerPacket returns the nanoseconds taken to encrypt and decrypt a packet.
+func (s CipherSpeed) NsPerPacket() float64 {
+	if s.Packets == 0 {
+		return 0
+	}
+	return float64(s.Elapsed.Nanoseconds()) / float64(s.Packets)
+}
+
+// Throughput returns the bytes of data encrypted and decrypted per second.
+func (s CipherSpeed) Throughput() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Size) * float64(s.Packets) / s.Elapsed.Seconds()
+}
+
+// MeasureCipher measures the speed of crypter encrypting and decrypting packets of size
+// bytes of random data for about duration, framed the same as the listener does. It fails
+// if a packet is not decrypted to its data.
+func MeasureCipher(crypter Crypter, size int, duration time.Duration) (CipherSpeed, error) {
+	if size <= 0 || size > mtuLimit {
+		return CipherSpeed{}, errors.Wrapf(errSpeed, "invalid packet size %d", size)
+	}
+	data := make([]byte, size)
+	_, _ = io.ReadFull(rand.Reader, data)
+
+	// warm up, and check the round trip once
+	if out, err := decryptPacket(crypter, encryptPacket(crypter, data)); err != nil {
+		return CipherSpeed{}, errors.Wrap(errSpeed, err.Error())
+	} else if !bytes.Equal(out, data) {
+		return CipherSpeed{}, errors.Wrap(errSpeed, "data mismatch")
+	}
+
+	speed := CipherSpeed{Size: size}
+	start := time.Now()
+	for speed.Elapsed < duration {
+		for range speedBatch {
+			if _, err := decryptPacket(crypter, encryptPacket(crypter, data)); err != nil {
+				return CipherSpeed{}, errors.Wrap(errSpeed, err.Error())
+			}
+		}
+		speed.Packets += speedBatch
+		speed.Elapsed = time.Since(start)
+	}
+	return speed, nil
+}
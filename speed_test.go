@@ -0,0 +1,55 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMeasureCipher(t *testing.T) {
+	for _, method := range []string{"none", "qpp", "aes", "aes-gcm"} {
+		keyLen, _ := CipherKeyLen(method)
+		crypter, _ := NewCipher(method, pass[:keyLen])
+		speed, err := MeasureCipher(crypter, 512, 10*time.Millisecond)
+		if err != nil {
+			t.Fatal(method, err)
+		}
+		if speed.Size != 512 || speed.Packets < speedBatch || speed.Elapsed < 10*time.Millisecond {
+			t.Fatalf("%v: unexpected speed %+v", method, speed)
+		}
+		if speed.NsPerPacket() <= 0 || speed.Throughput() <= 0 {
+			t.Fatalf("%v: invalid speed %v ns/packet, %v B/s", method, speed.NsPerPacket(), speed.Throughput())
+		}
+	}
+
+	crypter, _ := NewAESBlockCrypt(pass[:32])
+	for _, size := range []int{0, mtuLimit + 1} {
+		if _, err := MeasureCipher(crypter, size, time.Millisecond); err == nil {
+			t.Fatal("invalid size accepted", size)
+		}
+	}
+	if (CipherSpeed{}).NsPerPacket() != 0 || (CipherSpeed{}).Throughput() != 0 {
+		t.Fatal("speed of nothing")
+	}
+}
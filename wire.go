@@ -0,0 +1,213 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"crypto/md5"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// WireV1 is the original wire format, | nonce(8) | checksum(8) | data | for block
+	// ciphers, or | nonce | ciphertext | tag | for AEADs.
+	WireV1 = 1
+
+	// WireV2 carries a version header before the data inside the encryption,
+	// | version(1) | header length(1) | header extensions | data |, and binds the
+	// version to the checksum or the AEAD tag, so it's never mistaken for v1.
+	// Receivers skip the header extensions they don't know. AEAD packets start with
+	// a keyed mark of the bytes after it, | mark(1) | nonce | ciphertext | tag |, so
+	// receivers tell v2 from v1 without opening the packet twice.
+	WireV2 = 2
+
+	// v2HeaderSize defines the size of the v2 header without extensions.
+	v2HeaderSize = 2
+)
+
+var (
+	errWireVersion = errors.New("unsupported wire version")
+	errWireHeader  = errors.New("invalid wire header")
+)
+
+// v2Domain separates the checksum or the AEAD additional data of v2 packets from v1.
+var v2Domain = []byte("grasshopper wire v2")
+
+// v2MarkDomain derives the key of the nonce marks of v2 AEAD packets.
+var v2MarkDomain = []byte("grasshopper wire v2 mark")
+
+// versionCrypt emits packets of a wire version, and accepts both v1 and v2 packets.
+type versionCrypt struct {
+	crypter Crypter
+	block   BlockCrypt // the crypter if it's not an AEAD
+	aead    AEADCrypt  // the crypter if it's an AEAD
+	markKey []byte     // keys the marks of v2 AEAD packets
+	version int
+	buffers sync.Pool // copies of v1 AEAD packets carrying a mark by chance
+}
+
+// NewVersionCrypt wraps crypter to emit packets of the wire version, WireV1 or WireV2,
+// and to accept packets of both versions side by side. The version is hidden inside the
+// encryption, so crypter must not be nil, and it must be the cipher itself or the cipher
+// wrapped by NewMACCrypt, other wrappers like padding and keyrings go outside of it.
+func NewVersionCrypt(crypter Crypter, version int) (PacketCrypt, error) {
+	if version != WireV1 && version != WireV2 {
+		return nil, errors.Wrapf(errWireVersion, "version %d", version)
+	}
+	if crypter == nil {
+		return nil, errors.Wrap(errWireVersion, "wire versions require a crypter")
+	}
+
+	c := &versionCrypt{crypter: crypter, version: version}
+	if aead, ok := crypter.(AEADCrypt); ok {
+		c.aead = aead
+		c.markKey = markKey(aead)
+	} else {
+		if _, ok := crypter.(PacketCrypt); ok {
+			return nil, errors.Wrap(errWireVersion, "wire versions require a cipher")
+		}
+		c.block = crypter.(BlockCrypt)
+	}
+	c.buffers.New = func() any {
+		buf := make([]byte, mtuLimit)
+		return &buf
+	}
+	return c, nil
+}
+
+// Destroy zeroes the keys of the crypter and the mark key.
+func (c *versionCrypt) Destroy() {
+	Destroy(c.crypter)
+	clear(c.markKey)
+}
+
+func (c *versionCrypt) isCrypter() {}
+
+func (c *versionCrypt) SealPacket(data []byte) []byte {
+	if c.version == WireV1 {
+		return encryptPacket(c.crypter, data)
+	}
+
+	if c.aead != nil {
+		body := make([]byte, v2HeaderSize+len(data))
+		body[0], body[1] = WireV2, v2HeaderSize
+		copy(body[v2HeaderSize:], data)
+		return c.sealAEAD(body)
+	}
+
+	packet := make([]byte, headerSize+v2HeaderSize+len(data))
+	packet[headerSize], packet[headerSize+1] = WireV2, v2HeaderSize
+	copy(packet[headerSize+v2HeaderSize:], data)
+	sealChecksum(c.block, packet, v2Domain)
+	return packet
+}
+
+// markKey derives the key of the v2 marks from the keys of aead.
+func markKey(aead AEADCrypt) []byte {
+	var key []byte
+	if mac, ok := aead.(*macCrypt); ok {
+		// the MAC crypter draws its nonces inside Seal, its keyed hash is deterministic
+		key = mac.sum(nil, v2MarkDomain, nil)
+	} else {
+		// the tag of an empty message under a fixed nonce is only known to the key holders
+		key = aead.Seal(nil, make([]byte, aead.NonceSize()), nil, v2MarkDomain)
+	}
+	return key[:min(len(key), md5.Size)]
+}
+
+// sealAEAD seals the v2 body into | mark | nonce | ciphertext | tag |.
+func (c *versionCrypt) sealAEAD(body []byte) []byte {
+	nonceSize := c.aead.NonceSize()
+	packet := make([]byte, 1+nonceSize, 1+nonceSize+len(body)+c.aead.Overhead())
+	c.aead.FillNonce(packet[1:])
+	sealed := c.aead.Seal(packet[1:], packet[1:1+nonceSize], body, v2Domain)
+	packet = packet[:1+len(sealed)]
+	packet[0] = c.mark(sealed)
+	return packet
+}
+
+// mark returns the mark of a sealed packet, the first byte of a keyed md5 of its
+// first bytes, which are random to anyone without the key.
+func (c *versionCrypt) mark(sealed []byte) byte {
+	var buf [2 * md5.Size]byte
+	n := copy(buf[:], c.markKey)
+	n += copy(buf[n:], sealed[:min(len(sealed), md5.Size)])
+	sum := md5.Sum(buf[:n])
+	return sum[0]
+}
+
+func (c *versionCrypt) OpenPacket(packet []byte) ([]byte, error) {
+	if c.aead != nil {
+		return c.openAEAD(packet)
+	}
+
+	if len(packet) < headerSize {
+		return nil, errChecksum
+	}
+	c.block.Decrypt(packet, packet)
+	// the version byte dispatches, only v1 data that starts like a v2 header is checked twice
+	if isV2(packet[headerSize:]) && verifyChecksum(packet, v2Domain) {
+		return openV2(packet[headerSize:])
+	}
+	if verifyChecksum(packet, nil) {
+		return packet[headerSize:], nil
+	}
+	return nil, errChecksum
+}
+
+// openAEAD dispatches on the mark. v1 packets carry a mark by chance once in 256
+// packets, those are retried as v1 on a copy, as an AEAD may clear the packet when
+// the authentication fails.
+func (c *versionCrypt) openAEAD(packet []byte) ([]byte, error) {
+	if len(packet) == 0 || packet[0] != c.mark(packet[1:]) {
+		return openPacket(c.aead, packet, nil)
+	}
+
+	buf := c.buffers.Get().(*[]byte)
+	defer c.buffers.Put(buf)
+	saved := append((*buf)[:0], packet...)
+
+	if body, err := openPacket(c.aead, packet[1:], v2Domain); err == nil {
+		return openV2(body)
+	}
+	copy(packet, saved)
+	return openPacket(c.aead, packet, nil)
+}
+
+// isV2 reports whether body starts with a well-formed v2 header.
+func isV2(body []byte) bool {
+	if len(body) < v2HeaderSize || body[0] != WireV2 {
+		return false
+	}
+	n := int(body[1])
+	return n >= v2HeaderSize && n <= len(body)
+}
+
+// openV2 strips the v2 header of body.
+func openV2(body []byte) ([]byte, error) {
+	if !isV2(body) {
+		return nil, errWireHeader
+	}
+	return body[body[1]:], nil
+}
@@ -0,0 +1,160 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2024 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grasshopper
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestVersionCrypt(t *testing.T) {
+	key := make([]byte, 32)
+	gcm, _ := NewAESGCMCrypt(key)
+	aes, _ := NewAESBlockCrypt(key)
+	mac, _ := NewMACCrypt(aes, MACHMACSHA256, key, 16)
+	chacha, _ := NewChaCha20Poly1305Crypt(key)
+
+	for _, crypter := range []Crypter{gcm, aes, mac, chacha} {
+		v1, _ := NewVersionCrypt(crypter, WireV1)
+		v2, _ := NewVersionCrypt(crypter, WireV2)
+		for _, size := range []int{0, 1, 100, 1400} {
+			data := bytes.Repeat([]byte{'x'}, size)
+			for _, sender := range []Crypter{crypter, v1, v2} {
+				for _, receiver := range []Crypter{v1, v2} {
+					out, err := decryptPacket(receiver, encryptPacket(sender, data))
+					if err != nil || !bytes.Equal(out, data) {
+						t.Fatalf("%T: %d bytes round trip failed: %v", crypter, size, err)
+					}
+				}
+			}
+
+			// v1 is unchanged on the wire, and v2 is never mistaken for v1
+			if _, err := decryptPacket(crypter, encryptPacket(v1, data)); err != nil {
+				t.Fatalf("%T: v1 rejected by a plain crypter: %v", crypter, err)
+			}
+			if _, err := decryptPacket(crypter, encryptPacket(v2, data)); err == nil {
+				t.Fatalf("%T: v2 accepted by a plain crypter", crypter)
+			}
+		}
+	}
+}
+
+func TestVersionCryptHeader(t *testing.T) {
+	gcm, _ := NewAESGCMCrypt(make([]byte, 32))
+	v1, _ := NewVersionCrypt(gcm, WireV1)
+	sealV2 := v1.(*versionCrypt).sealAEAD
+
+	// unknown header extensions are skipped
+	packet := sealV2([]byte{WireV2, 4, 0xEE, 0xEE, 'h', 'i'})
+	if out, err := decryptPacket(v1, packet); err != nil || string(out) != "hi" {
+		t.Fatal("header extensions not skipped", out, err)
+	}
+
+	for _, body := range [][]byte{{}, {WireV2}, {WireV2, 1}, {WireV2, 3}, {3, 2}} {
+		packet := sealV2(body)
+		if _, err := decryptPacket(v1, packet); err == nil {
+			t.Fatal("invalid header accepted", body)
+		}
+	}
+
+	if _, err := NewVersionCrypt(gcm, 3); err == nil {
+		t.Fatal("unsupported version accepted")
+	}
+	if _, err := NewVersionCrypt(nil, WireV2); err == nil {
+		t.Fatal("nil crypter accepted")
+	}
+	padding, _ := NewPaddingCrypt(gcm, nil, 0)
+	if _, err := NewVersionCrypt(padding, WireV2); err == nil {
+		t.Fatal("wrapper accepted")
+	}
+}
+
+// countingAEAD counts the packets an AEAD tries to open.
+type countingAEAD struct {
+	AEADCrypt
+	opens int
+}
+
+func (c *countingAEAD) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	c.opens++
+	return c.AEADCrypt.Open(dst, nonce, ciphertext, additionalData)
+}
+
+func TestVersionCryptDispatch(t *testing.T) {
+	gcm, _ := NewAESGCMCrypt(make([]byte, 32))
+	counting := &countingAEAD{AEADCrypt: gcm}
+	v2, _ := NewVersionCrypt(counting, WireV2)
+	receiver := v2.(*versionCrypt)
+
+	// every packet is opened once, the v1 packets carrying a mark by chance are retried
+	retries := 0
+	for i := 0; i < 1024; i++ {
+		sender := Crypter(gcm)
+		if i%2 == 0 {
+			sender = v2
+		}
+		packet := encryptPacket(sender, []byte("data"))
+		marked := packet[0] == receiver.mark(packet[1:])
+		counting.opens = 0
+		if out, err := decryptPacket(v2, packet); err != nil || string(out) != "data" {
+			t.Fatal("round trip failed", err)
+		}
+		if counting.opens > 1 {
+			if sender == v2 || !marked {
+				t.Fatal("packet opened twice")
+			}
+			retries++
+		}
+	}
+	if retries > 32 {
+		t.Fatal("too many v1 packets retried", retries)
+	}
+
+	// packets failing the authentication are opened once unless they carry a mark
+	counting.opens = 0
+	garbage := make([]byte, 64)
+	garbage[0] = receiver.mark(garbage[1:]) + 1
+	if _, err := decryptPacket(v2, garbage); err == nil || counting.opens != 1 {
+		t.Fatal("garbage opened", counting.opens, err)
+	}
+
+	// block ciphers dispatch on the version byte, v1 data that looks like a v2 header stays v1
+	aes, _ := NewAESBlockCrypt(make([]byte, 32))
+	v2, _ = NewVersionCrypt(aes, WireV2)
+	data := []byte{WireV2, v2HeaderSize, 'h', 'i'}
+	if out, err := decryptPacket(v2, encryptPacket(aes, data)); err != nil || !bytes.Equal(out, data) {
+		t.Fatal("v1 data taken for a v2 header", out, err)
+	}
+}
+
+func BenchmarkVersionCryptV2(b *testing.B) {
+	gcm, _ := NewAESGCMCrypt(make([]byte, 32))
+	v2, _ := NewVersionCrypt(gcm, WireV2)
+	data := make([]byte, 1024)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		decryptPacket(v2, encryptPacket(v2, data))
+	}
+}